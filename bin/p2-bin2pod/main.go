@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/square/p2/Godeps/_workspace/src/golang.org/x/crypto/openpgp"
 	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/alecthomas/kingpin.v2"
+	"github.com/square/p2/pkg/archive"
+	"github.com/square/p2/pkg/auth"
+	"github.com/square/p2/pkg/digest"
 	"github.com/square/p2/pkg/pods"
 	"github.com/square/p2/pkg/uri"
 	"github.com/square/p2/pkg/version"
@@ -43,12 +50,19 @@ var (
 	location      = bin2pod.Flag("location", "The location where the outputted tar will live. The characters {} will be replaced with the unique basename of the tar, including its SHA. If not provided, the location will be a file path to the resulting tar from the build, which is included in the output of this script. Users must copy the resultant tar to the new location if it is different from the default output path.").String()
 	workDirectory = bin2pod.Flag("work-dir", "A directory where the results will be written.").ExistingDir()
 	config        = bin2pod.Flag("config", "a list of key=value assignments. Each key will be set in the config section.").Strings()
+	format        = bin2pod.Flag("format", "The archive format of the artifact.").Default("tar.gz").Enum("tar.gz", "tar.zst", "tar.xz", "tar", "zip")
+	writeDigest   = bin2pod.Flag("digest", "Write a digest of the artifact's files next to the artifact, and set the launchable's digest_location to the final location followed by .digest. If the digest is signed, the signature is written alongside it with the suffix .digest.sig. Users must copy these files along with the tar.").Bool()
+	embedDigest   = bin2pod.Flag("embed-digest", fmt.Sprintf("Embed a digest of the artifact's files in the artifact at %s, which is used to verify the launchable if it has no digest_location. If the digest is signed, the signature is embedded at %s.", digest.EmbeddedDigestPath, digest.EmbeddedSignaturePath)).Bool()
+	keyring       = bin2pod.Flag("keyring", "A keyring with an unencrypted private key to sign the digest with. Requires --digest or --embed-digest.").ExistingFile()
+	signingKey    = bin2pod.Flag("signing-key", "The hex ID of the key in the keyring to sign with. Defaults to the first key with a private key.").String()
 )
 
 type Result struct {
-	TarPath       string `json:"tar_path"`
-	ManifestPath  string `json:"manifest_path"`
-	FinalLocation string `json:"final_location"`
+	TarPath             string `json:"tar_path"`
+	ManifestPath        string `json:"manifest_path"`
+	FinalLocation       string `json:"final_location"`
+	DigestPath          string `json:"digest_path,omitempty"`
+	DigestSignaturePath string `json:"digest_signature_path,omitempty"`
 }
 
 func podId() string {
@@ -83,20 +97,40 @@ func main() {
 
 	workingDir := activeDir()
 
+	if *keyring != "" && !*writeDigest && !*embedDigest {
+		log.Fatalln("--keyring requires --digest or --embed-digest")
+	}
+
 	err := addManifestConfig(manifestBuilder)
-	tarLocation, err := makeTar(workingDir)
+	tarLocation, digestData, signature, err := makeTar(workingDir)
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
 	res.TarPath = tarLocation
 
 	if *location != "" {
-		stanza.Location = *location
 		res.FinalLocation = *location
 	} else {
-		stanza.Location = tarLocation
 		res.FinalLocation = tarLocation
 	}
+	stanza.Location = res.FinalLocation
+
+	if *writeDigest {
+		res.DigestPath = tarLocation + ".digest"
+		err = ioutil.WriteFile(res.DigestPath, digestData, 0644)
+		if err != nil {
+			log.Fatalf("Couldn't write digest: %s", err)
+		}
+		stanza.DigestLocation = res.FinalLocation + ".digest"
+		if signature != nil {
+			res.DigestSignaturePath = res.DigestPath + ".sig"
+			err = ioutil.WriteFile(res.DigestSignaturePath, signature, 0644)
+			if err != nil {
+				log.Fatalf("Couldn't write digest signature: %s", err)
+			}
+			stanza.DigestSignatureLocation = stanza.DigestLocation + ".sig"
+		}
+	}
 
 	manifestBuilder.SetLaunchables(map[string]pods.LaunchableStanza{
 		podId(): stanza,
@@ -122,33 +156,133 @@ func main() {
 	}
 }
 
-func makeTar(workingDir string) (string, error) {
+// makeTar builds the artifact, and returns its path along with the digest of its files
+// and the digest's signature, if they were requested.
+func makeTar(workingDir string) (string, []byte, []byte, error) {
 	tarContents := path.Join(workingDir, fmt.Sprintf("%s.workd", podId()))
 	err := os.MkdirAll(tarContents, 0744)
 	defer os.RemoveAll(tarContents)
 	if err != nil {
-		return "", fmt.Errorf("Couldn't make a new working directory %s for tarring: %s", tarContents, err)
+		return "", nil, nil, fmt.Errorf("Couldn't make a new working directory %s for tarring: %s", tarContents, err)
 	}
 	err = os.MkdirAll(path.Join(tarContents, "bin"), 0744)
 	if err != nil {
-		return "", fmt.Errorf("Couldn't make bin directory in %s: %s", tarContents, err)
+		return "", nil, nil, fmt.Errorf("Couldn't make bin directory in %s: %s", tarContents, err)
 	}
 	launchablePath := path.Join(tarContents, "bin", "launch")
 	err = uri.URICopy(*executable, launchablePath)
 	if err != nil {
-		return "", fmt.Errorf("Couldn't copy from %s.: %s", *executable, err)
+		return "", nil, nil, fmt.Errorf("Couldn't copy from %s.: %s", *executable, err)
 	}
 	err = os.Chmod(launchablePath, 0755) // make file executable by all.
 	if err != nil {
-		return "", fmt.Errorf("Couldn't make %s executable: %s", launchablePath, err)
+		return "", nil, nil, fmt.Errorf("Couldn't make %s executable: %s", launchablePath, err)
+	}
+
+	var digestData, signature []byte
+	if *writeDigest || *embedDigest {
+		digestData, signature, err = makeDigest(tarContents)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	if *embedDigest {
+		err = embed(tarContents, digestData, signature)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("Couldn't embed the digest: %s", err)
+		}
+	}
+
+	artifactFormat, ok := archive.ForName(*format)
+	if !ok {
+		return "", nil, nil, fmt.Errorf("Unsupported artifact format %s", *format)
 	}
-	tarPath := path.Join(workingDir, fmt.Sprintf("%s_%s.tar.gz", path.Base(*executable), randomSuffix()))
-	cmd := exec.Command("tar", "-czvf", tarPath, "-C", tarContents, ".")
+	tarPath := path.Join(workingDir, fmt.Sprintf("%s_%s%s", path.Base(*executable), randomSuffix(), artifactFormat.Extensions[0]))
+	cmd := archiveCommand(tarPath, tarContents)
 	err = cmd.Run()
 	if err != nil {
-		return "", fmt.Errorf("Couldn't build tar: %s", err)
+		return "", nil, nil, fmt.Errorf("Couldn't build %s: %s", *format, err)
+	}
+	return tarPath, digestData, signature, nil
+}
+
+// makeDigest returns the digest of the files in dir, and its signature if a keyring
+// was given.
+func makeDigest(dir string) ([]byte, []byte, error) {
+	digestData, err := digest.Generate(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't generate digest: %s", err)
+	}
+	if *keyring == "" {
+		return digestData, nil, nil
+	}
+	signer, err := loadSigner(*keyring, *signingKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	signature := &bytes.Buffer{}
+	err = openpgp.DetachSign(signature, signer, bytes.NewReader(digestData), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't sign digest: %s", err)
+	}
+	return digestData, signature.Bytes(), nil
+}
+
+// loadSigner returns the key in the keyring to sign with: the one with the given hex
+// ID, or the first one with a private key.
+func loadSigner(keyringPath string, keyID string) (*openpgp.Entity, error) {
+	keyring, err := auth.LoadKeyring(keyringPath)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load keyring %s: %s", keyringPath, err)
+	}
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		if keyID != "" && !strings.EqualFold(entity.PrimaryKey.KeyIdString(), keyID) && !strings.EqualFold(entity.PrimaryKey.KeyIdShortString(), keyID) {
+			continue
+		}
+		if entity.PrivateKey.Encrypted {
+			return nil, fmt.Errorf("The private key %s is encrypted", entity.PrimaryKey.KeyIdString())
+		}
+		return entity, nil
+	}
+	return nil, fmt.Errorf("No private key to sign with in %s", keyringPath)
+}
+
+// embed writes the digest and its signature into dir at the embedded digest paths.
+func embed(dir string, digestData []byte, signature []byte) error {
+	err := os.MkdirAll(filepath.Join(dir, filepath.Dir(digest.EmbeddedDigestPath)), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, digest.EmbeddedDigestPath), digestData, 0644)
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(dir, digest.EmbeddedSignaturePath), signature, 0644)
+}
+
+// archiveCommand returns the command that archives the contents of dir in the chosen
+// format.
+func archiveCommand(archivePath string, dir string) *exec.Cmd {
+	switch *format {
+	case "zip":
+		cmd := exec.Command("zip", "-q", "-r", "-y", archivePath, ".")
+		cmd.Dir = dir
+		return cmd
+	case "tar.zst":
+		return exec.Command("tar", "--zstd", "-cf", archivePath, "-C", dir, ".")
+	case "tar.xz":
+		return exec.Command("tar", "-cJf", archivePath, "-C", dir, ".")
+	case "tar":
+		return exec.Command("tar", "-cf", archivePath, "-C", dir, ".")
+	default:
+		return exec.Command("tar", "-czvf", archivePath, "-C", dir, ".")
 	}
-	return tarPath, nil
 }
 
 func addManifestConfig(manifestBuilder pods.ManifestBuilder) error {
@@ -155,9 +155,14 @@ func loadEnvDir(dir string) error {
 //   cgroup:
 //     cpus: 4
 //     memory: 123456
+//   pod_cgroup:
+//     cpus: 8
+//     memory: 246912
 // and the <launchablename> and <cgroupname>
 // a cgroup with the name <cgroupname> will be created, using the parameters for
 // <launchablename> found in the platform configuration
+// if there is a pod_cgroup and <cgroupname> is nested, as in <pod>/<launchable>,
+// its parent is created first with the pod_cgroup parameters
 // then, the current PID will be added to that cgroup
 func cgEnter(platconf, launchableName, cgroupName string) error {
 	platconfBuf, err := ioutil.ReadFile(platconf)
@@ -183,6 +188,17 @@ func cgEnter(platconf, launchableName, cgroupName string) error {
 	if err != nil {
 		return util.Errorf("Could not find cgroupfs mount point: %s", err)
 	}
+	podConfig, ok := cgMap[launchableName]["pod_cgroup"]
+	if parent := filepath.Dir(cgroupName); ok && parent != "." {
+		podConfig.Name = parent
+		err = cg.Write(podConfig)
+		if _, ok := err.(cgroups.UnsupportedError); ok {
+			// the launchable's own cgroup is still entered below
+			log.Printf("Unsupported subsystem (%s) in pod cgroup, continuing\n", err)
+		} else if err != nil {
+			return util.Errorf("Could not set pod cgroup parameters: %s", err)
+		}
+	}
 	err = cg.Write(cgConfig)
 	if _, ok := err.(cgroups.UnsupportedError); ok {
 		// if a subsystem is not supported, just log
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/square/p2/Godeps/_workspace/src/golang.org/x/crypto/openpgp"
+	"github.com/square/p2/Godeps/_workspace/src/golang.org/x/crypto/openpgp/clearsign"
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/alecthomas/kingpin.v2"
+	"github.com/square/p2/pkg/auth"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/util"
+	"github.com/square/p2/pkg/version"
+)
+
+const (
+	CMD_VALIDATE     = "validate"
+	CMD_DIFF         = "diff"
+	CMD_CANONICALIZE = "canonicalize"
+	CMD_SIGN         = "sign"
+	CMD_VERIFY       = "verify"
+	CMD_EXPLAIN      = "explain"
+)
+
+var (
+	app = kingpin.New("p2-manifest", `Work with pod manifests.
+
+EXAMPLES
+
+$ p2-manifest validate mypod.yaml
+
+$ p2-manifest diff old.yaml new.yaml
+
+$ p2-manifest sign --keyring secring.gpg mypod.yaml > mypod.yaml.asc
+
+$ p2-manifest verify --keyring pubring.gpg mypod.yaml.asc
+
+`)
+
+	cmdValidate       = app.Command(CMD_VALIDATE, "Check pod manifests for unknown fields and invalid values. Every problem is reported with its YAML path.")
+	validateManifests = cmdValidate.Arg("manifest", "the manifest files to check").Required().ExistingFiles()
+
+	cmdDiff     = app.Command(CMD_DIFF, "Compare two manifests by the fields they set, ignoring formatting, key order and signatures.")
+	diffOld     = cmdDiff.Arg("old", "the original manifest").Required().ExistingFile()
+	diffNew     = cmdDiff.Arg("new", "the updated manifest").Required().ExistingFile()
+	diffQuietly = cmdDiff.Flag("quiet", "print nothing, only exit 1 if the manifests differ").Short('q').Bool()
+
+	cmdCanonicalize      = app.Command(CMD_CANONICALIZE, "Print the normalized YAML of a manifest, whose SHA256 is the manifest's SHA.")
+	canonicalizeManifest = cmdCanonicalize.Arg("manifest", "the manifest to normalize").Required().ExistingFile()
+	canonicalizeJSON     = cmdCanonicalize.Flag("json", "print the manifest as a JSON object, which has the same SHA").Bool()
+
+	cmdSign            = app.Command(CMD_SIGN, "Clearsign a manifest and print the signed manifest.")
+	signManifest       = cmdSign.Arg("manifest", "the manifest to sign").Required().ExistingFile()
+	signKeyring        = cmdSign.Flag("keyring", "keyring containing the private signing key, armored or binary").Required().ExistingFile()
+	signKeyID          = cmdSign.Flag("key-id", "hex key ID or fingerprint of the signing key. Defaults to the first private key on the keyring").String()
+	signPassphraseFile = cmdSign.Flag("passphrase-file", "file containing the passphrase of the signing key, if it is encrypted").ExistingFile()
+
+	cmdVerify         = app.Command(CMD_VERIFY, "Check that a manifest is signed by a key on a keyring, as the preparer's keyring auth policy does.")
+	verifyManifest    = cmdVerify.Arg("manifest", "the signed manifest to verify").Required().ExistingFile()
+	verifyKeyring     = cmdVerify.Flag("keyring", "keyring of trusted public keys, armored or binary").Required().ExistingFile()
+	verifyAuthorizers = cmdVerify.Flag("authorized-deployer", "fingerprint of a key allowed to deploy the manifest's pod. Can be specified multiple times. Defaults to any key on the keyring").Strings()
+
+	cmdExplain     = app.Command(CMD_EXPLAIN, "Show where the preparer would place a manifest's files on disk.")
+	explainPodRoot = cmdExplain.Flag("pod-root", "the directory the preparer installs pods into").Default(pods.DEFAULT_PATH).String()
+	explainFile    = cmdExplain.Arg("manifest", "the manifest to explain").Required().ExistingFile()
+)
+
+func main() {
+	app.Version(version.VERSION)
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	switch cmd {
+	case CMD_VALIDATE:
+		if !validate(*validateManifests) {
+			os.Exit(1)
+		}
+	case CMD_DIFF:
+		same, err := diff(*diffOld, *diffNew, *diffQuietly)
+		exitOnError(err)
+		if !same {
+			os.Exit(1)
+		}
+	case CMD_CANONICALIZE:
+		exitOnError(canonicalize(*canonicalizeManifest, *canonicalizeJSON))
+	case CMD_SIGN:
+		exitOnError(sign(*signManifest, *signKeyring, *signKeyID, *signPassphraseFile))
+	case CMD_VERIFY:
+		exitOnError(verify(*verifyManifest, *verifyKeyring, *verifyAuthorizers))
+	case CMD_EXPLAIN:
+		exitOnError(explain(*explainFile, *explainPodRoot))
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "p2-manifest: %s\n", err)
+		os.Exit(2)
+	}
+}
+
+// validate prints every problem with the given manifest files. Returns true if there
+// were none.
+func validate(paths []string) bool {
+	valid := true
+	for _, path := range paths {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			valid = false
+			continue
+		}
+		for _, problem := range pods.ValidateManifestBytes(bytes) {
+			fmt.Printf("%s: %s\n", path, problem)
+			valid = false
+		}
+	}
+	return valid
+}
+
+// diff prints the changes between two manifests. Returns true if there were none.
+func diff(oldPath, newPath string, quiet bool) (bool, error) {
+	oldManifest, err := pods.ManifestFromPath(oldPath)
+	if err != nil {
+		return false, util.Errorf("%s: %s", oldPath, err)
+	}
+	newManifest, err := pods.ManifestFromPath(newPath)
+	if err != nil {
+		return false, util.Errorf("%s: %s", newPath, err)
+	}
+	changes, err := pods.DiffManifests(oldManifest, newManifest)
+	if err != nil {
+		return false, err
+	}
+	if !quiet {
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+	}
+	return len(changes) == 0, nil
+}
+
+func canonicalize(path string, asJSON bool) error {
+	manifest, err := pods.ManifestFromPath(path)
+	if err != nil {
+		return err
+	}
+	var canonical []byte
+	if asJSON {
+		canonical, err = manifest.MarshalJSON()
+		canonical = append(canonical, '\n')
+	} else {
+		canonical, err = manifest.GetBuilder().GetManifest().Marshal()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(canonical)
+	return err
+}
+
+// sign clearsigns the manifest's YAML exactly as written. A manifest that is already
+// signed has its signature replaced.
+func sign(path, keyringPath, keyID, passphraseFile string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err = pods.ManifestFromBytes(data); err != nil {
+		return err
+	}
+	if signed, _ := clearsign.Decode(data); signed != nil {
+		data = signed.Plaintext
+	}
+
+	keyring, err := auth.LoadKeyring(keyringPath)
+	if err != nil {
+		return err
+	}
+	signer, err := signingKey(keyring, keyID)
+	if err != nil {
+		return err
+	}
+	if signer.PrivateKey.Encrypted {
+		if passphraseFile == "" {
+			return util.Errorf("signing key is encrypted, --passphrase-file is required")
+		}
+		passphrase, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return err
+		}
+		err = signer.PrivateKey.Decrypt(bytes.TrimRight(passphrase, "\r\n"))
+		if err != nil {
+			return util.Errorf("could not decrypt signing key: %s", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	plaintext, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = plaintext.Write(data); err != nil {
+		return err
+	}
+	if err = plaintext.Close(); err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(buf.Bytes())
+	return err
+}
+
+// signingKey finds the key on the keyring that has a private key and matches the
+// given key ID or fingerprint, or the first key with a private key if no ID is given.
+func signingKey(keyring openpgp.EntityList, keyID string) (*openpgp.Entity, error) {
+	keyID = strings.ToUpper(strings.Replace(keyID, " ", "", -1))
+	for _, entity := range keyring {
+		if entity.PrivateKey == nil {
+			continue
+		}
+		fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+		if keyID == "" || strings.HasSuffix(fingerprint, keyID) {
+			return entity, nil
+		}
+	}
+	if keyID == "" {
+		return nil, util.Errorf("keyring has no private keys")
+	}
+	return nil, util.Errorf("keyring has no private key %s", keyID)
+}
+
+// verify checks the manifest's signature with the keyring auth policy.
+func verify(path, keyringPath string, authorizedDeployers []string) error {
+	manifest, err := pods.ManifestFromPath(path)
+	if err != nil {
+		return err
+	}
+	// the policy compares upper-case fingerprints
+	var deployers []string
+	for _, fingerprint := range authorizedDeployers {
+		deployers = append(deployers, strings.ToUpper(strings.Replace(fingerprint, " ", "", -1)))
+	}
+	policy, err := auth.LoadKeyringPolicy(keyringPath, map[string][]string{manifest.ID(): deployers})
+	if err != nil {
+		return err
+	}
+	defer policy.Close()
+	err = policy.AuthorizeApp(manifest, logging.DefaultLogger)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: signature OK\n", path)
+	return nil
+}
+
+func explain(path, podRoot string) error {
+	manifest, err := pods.ManifestFromPath(path)
+	if err != nil {
+		return err
+	}
+	pod := pods.NewPod(manifest.ID(), pods.PodPath(podRoot, manifest.ID()))
+	layout, err := pod.Layout(manifest)
+	if err != nil {
+		return err
+	}
+
+	runAs := manifest.RunAsUser()
+	fmt.Printf("pod %s, running as %s\n", manifest.ID(), runAs)
+	fmt.Printf("  home:             %s\n", layout.Home)
+	fmt.Printf("  current manifest: %s\n", layout.CurrentManifest)
+	fmt.Printf("  config:           %s\n", layout.ConfigPath)
+	fmt.Printf("  platform config:  %s\n", layout.PlatformConfigPath)
+	if layout.SecretsDir != "" {
+		fmt.Printf("  secrets (tmpfs):  %s\n", layout.SecretsDir)
+	}
+	if layout.Cgroup != "" {
+		cgroup := manifest.GetCgroupConfig()
+		fmt.Printf("  cgroup:           %s (cpus: %d, memory: %s)\n", layout.Cgroup, cgroup.CPUs, cgroup.Memory)
+	}
+	volumeNames := make([]string, 0, len(layout.Volumes))
+	for name := range layout.Volumes {
+		volumeNames = append(volumeNames, name)
+	}
+	sort.Strings(volumeNames)
+	for _, name := range volumeNames {
+		volume := manifest.GetVolumes()[name]
+		fmt.Printf("  volume %s:  %s (%s on uninstall)\n", name, layout.Volumes[name], volume.GetRetention())
+	}
+	printEnv("  ", layout.EnvDir, layout.Env)
+	for _, launchable := range layout.Launchables {
+		fmt.Printf("launchable %s (%s), ID %s\n", launchable.Key, launchable.Type, launchable.ID)
+		fmt.Printf("  install dir:      %s\n", launchable.InstallDir)
+		if len(launchable.DependsOn) > 0 {
+			fmt.Printf("  depends on:       %s\n", strings.Join(launchable.DependsOn, ", "))
+		}
+		printEnv("  ", launchable.EnvDir, launchable.Env)
+		if launchable.Type == "hoist" {
+			fmt.Printf("  services:         %s__<script> for each script in bin/launch\n", launchable.ID)
+		}
+	}
+	return nil
+}
+
+func printEnv(indent, dir string, env map[string]string) {
+	fmt.Printf("%senv dir:          %s\n", indent, dir)
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s  %s=%s\n", indent, name, env[name])
+	}
+}
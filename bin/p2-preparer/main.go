@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,6 +16,8 @@ import (
 	"github.com/square/p2/pkg/watch"
 )
 
+var planOnly = kingpin.Flag("plan", "Print what the preparer would do on this node as JSON, then exit without changing anything.").Bool()
+
 func main() {
 	// Other packages define flags, and they need parsing here.
 	kingpin.Parse()
@@ -33,14 +36,16 @@ func main() {
 		logger.WithError(err).Fatalln("invalid parameter")
 	}
 
+	if *planOnly {
+		printPlan(preparerConfig, logger)
+		return
+	}
+
 	statusServer, err := preparer.NewStatusServer(preparerConfig.StatusPort, preparerConfig.StatusSocket, &logger)
 	if err == preparer.NoServerConfigured {
 		logger.NoFields().Warningln("No status port or socket provided, no status server configured")
 	} else if err != nil {
 		logger.WithError(err).Fatalln("Could not start status server")
-	} else {
-		go statusServer.Serve()
-		defer statusServer.Close()
 	}
 
 	prep, err := preparer.New(preparerConfig, logger)
@@ -49,6 +54,12 @@ func main() {
 	}
 	defer prep.Close()
 
+	if statusServer != nil {
+		statusServer.Planner = prep
+		go statusServer.Serve()
+		defer statusServer.Close()
+	}
+
 	logger.WithFields(logrus.Fields{
 		"starting":    true,
 		"node_name":   preparerConfig.NodeName,
@@ -60,6 +71,9 @@ func main() {
 		"version":     version.VERSION,
 	}).Infoln("Preparer started successfully")
 
+	prep.RemovePartialDownloads()
+	prep.ResumeTransitions()
+
 	quitMainUpdate := make(chan struct{})
 	quitHookUpdate := make(chan struct{})
 	quitChans := []chan struct{}{quitHookUpdate}
@@ -67,21 +81,50 @@ func main() {
 	go prep.WatchForPodManifestsForNode(quitMainUpdate)
 	go prep.WatchForHooks(quitHookUpdate)
 
+	quitPrestage := make(chan struct{})
+	go prep.WatchForPrestages(quitPrestage)
+	quitChans = append(quitChans, quitPrestage)
+
 	// Launch health checking watch. This watch tracks health of
 	// all pods on this host and writes the information to consul
 	quitMonitorPodHealth := make(chan struct{})
 	go watch.MonitorPodHealth(preparerConfig, &logger, quitMonitorPodHealth)
 	quitChans = append(quitChans, quitMonitorPodHealth)
 
-	waitForTermination(logger, quitMainUpdate, quitChans)
+	waitForTermination(logger, configPath, prep, quitMainUpdate, quitChans)
 
 	logger.NoFields().Infoln("Terminating")
 }
 
-func waitForTermination(logger logging.Logger, quitMainUpdate chan struct{}, quitChans []chan struct{}) {
+func printPlan(preparerConfig *preparer.PreparerConfig, logger logging.Logger) {
+	// planning downloads nothing, and must not touch the running preparer's cache
+	planConfig := *preparerConfig
+	planConfig.ArtifactCache = nil
+	prep, err := preparer.New(&planConfig, logger)
+	if err != nil {
+		logger.WithError(err).Fatalln("Could not initialize preparer")
+	}
+	defer prep.Close()
+
+	plan, err := prep.Plan()
+	if err != nil {
+		logger.WithError(err).Fatalln("Could not compute plan")
+	}
+	out, err := json.MarshalIndent(plan, "", "    ")
+	if err != nil {
+		logger.WithError(err).Fatalln("Could not marshal plan to JSON")
+	}
+	os.Stdout.Write(append(out, '\n'))
+}
+
+func waitForTermination(logger logging.Logger, configPath string, prep *preparer.Preparer, quitMainUpdate chan struct{}, quitChans []chan struct{}) {
 	signalCh := make(chan os.Signal, 2)
-	signal.Notify(signalCh, syscall.SIGTERM, os.Interrupt)
+	signal.Notify(signalCh, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
 	received := <-signalCh
+	for received == syscall.SIGHUP {
+		reloadConfig(logger, configPath, prep)
+		received = <-signalCh
+	}
 	logger.WithField("signal", received.String()).Infoln("Stopping work")
 	for _, quitCh := range quitChans {
 		quitCh <- struct{}{}
@@ -89,3 +132,18 @@ func waitForTermination(logger logging.Logger, quitMainUpdate chan struct{}, qui
 	quitMainUpdate <- struct{}{}
 	<-quitMainUpdate // acknowledgement
 }
+
+// reloadConfig rereads the preparer's config file and applies it. Errors are logged,
+// and the preparer keeps running with its previous configuration.
+func reloadConfig(logger logging.Logger, configPath string, prep *preparer.Preparer) {
+	logger.WithField("config_path", configPath).Infoln("Reloading configuration")
+	preparerConfig, err := preparer.LoadConfig(configPath)
+	if err != nil {
+		logger.WithError(err).Errorln("could not load preparer config, keeping the current config")
+		return
+	}
+	err = prep.Reload(preparerConfig)
+	if err != nil {
+		logger.WithError(err).Errorln("could not reload preparer config, keeping the current config")
+	}
+}
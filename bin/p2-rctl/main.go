@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 	"time"
 
@@ -41,6 +42,7 @@ const (
 	CMD_ROLL     = "rolling-update"
 	CMD_FARM     = "farm"
 	CMD_SCHEDUP  = "schedule-update"
+	CMD_PRESTAGE = "prestage"
 )
 
 var (
@@ -88,6 +90,10 @@ var (
 	schedupWant   = cmdSchedup.Flag("desired", "number of replicas desired").Required().Short('d').Int()
 	schedupNeed   = cmdSchedup.Flag("minimum", "minimum number of healthy replicas during update").Required().Short('m').Int()
 	schedupDelete = cmdSchedup.Flag("delete", "delete pods during update").Bool()
+
+	cmdPrestage     = kingpin.Command(CMD_PRESTAGE, "Fetch and verify the launchables of a replication controller on its eligible nodes, without launching them")
+	prestageID      = cmdPrestage.Arg("id", "replication controller uuid to pre-stage").Required().String()
+	prestageTimeout = cmdPrestage.Flag("timeout", "how long to wait for the nodes to become ready. Zero does not wait.").Default("10m").Duration()
 )
 
 func main() {
@@ -152,6 +158,8 @@ func main() {
 		rctl.Farm()
 	case CMD_SCHEDUP:
 		rctl.ScheduleUpdate(*schedupOldID, *schedupNewID, *schedupWant, *schedupNeed, *schedupDelete)
+	case CMD_PRESTAGE:
+		rctl.Prestage(*prestageID, *prestageTimeout)
 	}
 }
 
@@ -367,3 +375,95 @@ func (r RCtl) ScheduleUpdate(oldID, newID string, want, need int, deletes bool)
 		r.logger.WithField("id", newID).Infoln("Created new rolling update")
 	}
 }
+
+// Prestage asks the preparer of every node the replication controller could schedule
+// on to fetch and verify its manifest, then waits for them and prints whether each
+// node is ready. It exits with an error if any node is not ready.
+func (r RCtl) Prestage(id string, timeout time.Duration) {
+	rcFields, err := r.rcs.Get(rc_fields.ID(id))
+	if err != nil {
+		r.logger.WithError(err).Fatalln("Could not get replication controller in Consul")
+	}
+	nodes, err := r.sched.EligibleNodes(rcFields.Manifest, rcFields.NodeSelector)
+	if err != nil {
+		r.logger.WithError(err).Fatalln("Could not find eligible nodes")
+	}
+
+	podID := rcFields.Manifest.ID()
+	// the SHA of the manifest requested on each node
+	shas := make(map[string]string)
+	results := make(map[string]string)
+	for _, node := range nodes {
+		manifest, err := rc.NodeManifest(rcFields, node, r.labeler)
+		if err == nil {
+			shas[node], err = manifest.SHA()
+		}
+		if err == nil {
+			// every status read after this was reported for this request
+			err = r.kps.DeletePrestageStatus(node, podID)
+		}
+		if err == nil {
+			_, err = r.kps.SetPod(kp.PrestagePath(node, podID), manifest)
+		}
+		if err != nil {
+			r.logger.WithErrorAndFields(err, logrus.Fields{"node": node}).Errorln("Could not request pre-stage")
+			results[node] = fmt.Sprintf("failed: %s", err)
+			delete(shas, node)
+		}
+	}
+	r.logger.WithFields(logrus.Fields{
+		"id":    id,
+		"nodes": len(shas),
+	}).Infoln("Requested pre-stage")
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := 0
+		for node, sha := range shas {
+			status, ok, err := r.kps.PrestageStatus(node, podID)
+			switch {
+			case err != nil:
+				results[node] = fmt.Sprintf("pending: %s", err)
+				pending++
+			case !ok && r.installed(node, podID, sha):
+				// the preparer removes the request once the manifest is installed
+				results[node] = "ready"
+			case !ok || status.SHA != sha:
+				results[node] = "pending"
+				pending++
+			case status.Ready:
+				results[node] = "ready"
+			default:
+				results[node] = fmt.Sprintf("failed: %s", status.Error)
+			}
+		}
+		if pending == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	sortedNodes := make([]string, 0, len(results))
+	for node := range results {
+		sortedNodes = append(sortedNodes, node)
+	}
+	sort.Strings(sortedNodes)
+	allReady := true
+	for _, node := range sortedNodes {
+		fmt.Printf("%s\t%s\n", node, results[node])
+		allReady = allReady && results[node] == "ready"
+	}
+	if !allReady {
+		os.Exit(1)
+	}
+}
+
+// installed returns true if the node's reality has the manifest with the given SHA.
+func (r RCtl) installed(node, podID, sha string) bool {
+	reality, _, err := r.kps.Pod(kp.RealityPath(node, podID))
+	if err != nil {
+		return false
+	}
+	realitySHA, err := reality.SHA()
+	return err == nil && realitySHA == sha
+}
@@ -0,0 +1,108 @@
+// Package archive extracts launchable artifacts in any of the supported archive
+// formats. Every format is extracted through pkg/gzip's hardened tar extraction, so all
+// of them get the same containment checks and limits.
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// Format is a kind of archive that an artifact can be stored as.
+type Format struct {
+	// The name of the format, such as "tar.gz".
+	Name string
+	// The file name extensions of artifacts in this format. The first one is the
+	// preferred extension.
+	Extensions []string
+	// Magic is the sequence of bytes at MagicOffset that identifies the format. Formats
+	// without one can only be selected by their extension.
+	Magic       []byte
+	MagicOffset int64
+	// Extract extracts the artifact into dest. If owner is not empty, every file is
+	// owned by that user.
+	Extract func(owner string, artifact *os.File, dest string) error
+}
+
+// Formats are the supported formats, in the order that Detect checks them.
+var Formats []Format
+
+// Register adds a format to the supported formats.
+func Register(format Format) {
+	Formats = append(Formats, format)
+}
+
+// ForName returns the format with the given name.
+func ForName(name string) (Format, bool) {
+	for _, format := range Formats {
+		if format.Name == name {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
+// ForLocation returns the format with the longest extension that the location ends with.
+func ForLocation(location string) (Format, bool) {
+	var found Format
+	longest := 0
+	for _, format := range Formats {
+		for _, ext := range format.Extensions {
+			if len(ext) > longest && strings.HasSuffix(location, ext) {
+				found, longest = format, len(ext)
+			}
+		}
+	}
+	return found, longest > 0
+}
+
+// Detect returns the format whose magic bytes the artifact starts with.
+func Detect(artifact io.ReaderAt) (Format, bool) {
+	for _, format := range Formats {
+		if len(format.Magic) == 0 {
+			continue
+		}
+		header := make([]byte, len(format.Magic))
+		_, err := artifact.ReadAt(header, format.MagicOffset)
+		if err == nil && bytes.Equal(header, format.Magic) {
+			return format, true
+		}
+	}
+	return Format{}, false
+}
+
+// TrimExtension removes the extension of a supported format from the name. Names that
+// do not end with one are returned unchanged.
+func TrimExtension(name string) string {
+	var longest string
+	for _, format := range Formats {
+		for _, ext := range format.Extensions {
+			if len(ext) > len(longest) && strings.HasSuffix(name, ext) && len(name) > len(ext) {
+				longest = ext
+			}
+		}
+	}
+	return name[:len(name)-len(longest)]
+}
+
+// Extract extracts the artifact fetched from location into dest. The format is sniffed
+// from the artifact's contents, falling back to the location's extension for formats
+// that cannot be recognized that way.
+func Extract(owner string, artifact *os.File, location string, dest string) error {
+	format, ok := Detect(artifact)
+	if !ok {
+		format, ok = ForLocation(location)
+	}
+	if !ok {
+		return util.Errorf("%s is not in a supported archive format", location)
+	}
+	_, err := artifact.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	return format.Extract(owner, artifact, dest)
+}
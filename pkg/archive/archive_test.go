@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestTrimExtension(t *testing.T) {
+	for name, expected := range map[string]string{
+		"hello_abc123.tar.gz":  "hello_abc123",
+		"hello_abc123.tgz":     "hello_abc123",
+		"hello_abc123.tar.zst": "hello_abc123",
+		"hello_abc123.tar.xz":  "hello_abc123",
+		"hello_abc123.tar":     "hello_abc123",
+		"hello_abc123.zip":     "hello_abc123",
+		"hello_abc123":         "hello_abc123",
+		".tar.gz":              ".tar.gz",
+		"gz":                   "gz",
+	} {
+		Assert(t).AreEqual(TrimExtension(name), expected, "wrong version for "+name)
+	}
+}
+
+func TestForLocation(t *testing.T) {
+	format, ok := ForLocation("http://localhost/hello_abc123.tar.zst")
+	Assert(t).IsTrue(ok, "should have found a format")
+	Assert(t).AreEqual(format.Name, "tar.zst", "wrong format")
+
+	format, ok = ForLocation("http://localhost/hello_abc123.tar")
+	Assert(t).IsTrue(ok, "should have found a format")
+	Assert(t).AreEqual(format.Name, "tar", "wrong format")
+
+	_, ok = ForLocation("http://localhost/hello_abc123.rar")
+	Assert(t).IsFalse(ok, "should not have found a format")
+}
+
+func testTar(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	contents := []byte("#!/bin/sh\necho hello\n")
+	err := tw.WriteHeader(&tar.Header{Name: "bin/launch", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(contents))})
+	Assert(t).IsNil(err, "test setup: could not write tar header")
+	_, err = tw.Write(contents)
+	Assert(t).IsNil(err, "test setup: could not write tar contents")
+	Assert(t).IsNil(tw.Close(), "test setup: could not close tar")
+	return buf.Bytes()
+}
+
+func testZip(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	header := &zip.FileHeader{Name: "bin/launch", Method: zip.Deflate}
+	header.SetMode(0755)
+	w, err := zw.CreateHeader(header)
+	Assert(t).IsNil(err, "test setup: could not write zip header")
+	_, err = w.Write([]byte("#!/bin/sh\necho hello\n"))
+	Assert(t).IsNil(err, "test setup: could not write zip contents")
+	Assert(t).IsNil(zw.Close(), "test setup: could not close zip")
+	return buf.Bytes()
+}
+
+// compress returns the data compressed with the command, or nil if the command is not
+// installed.
+func compress(t *testing.T, data []byte, command string) []byte {
+	if _, err := exec.LookPath(command); err != nil {
+		t.Logf("%s is not installed, skipping it", command)
+		return nil
+	}
+	cmd := exec.Command(command, "-c", "-q")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	Assert(t).IsNil(err, "test setup: could not compress with "+command)
+	return out
+}
+
+func TestExtractDetectsFormat(t *testing.T) {
+	tarData := testTar(t)
+	gzData := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzData)
+	gz.Write(tarData)
+	gz.Close()
+
+	artifacts := map[string]func() []byte{
+		"tar":     func() []byte { return tarData },
+		"tar.gz":  func() []byte { return gzData.Bytes() },
+		"zip":     func() []byte { return testZip(t) },
+		"tar.xz":  func() []byte { return compress(t, tarData, "xz") },
+		"tar.zst": func() []byte { return compress(t, tarData, "zstd") },
+	}
+	for name, data := range artifacts {
+		if data := data(); data != nil {
+			checkExtract(t, name, data)
+		}
+	}
+}
+
+// checkExtract extracts the artifact from a location with no extension, so its format
+// must be detected.
+func checkExtract(t *testing.T, name string, data []byte) {
+	dir, err := ioutil.TempDir("", "archive")
+	Assert(t).IsNil(err, "test setup: could not create temp dir")
+	defer os.RemoveAll(dir)
+
+	artifact, err := os.Create(filepath.Join(dir, "artifact"))
+	Assert(t).IsNil(err, "test setup: could not create artifact")
+	defer artifact.Close()
+	_, err = artifact.Write(data)
+	Assert(t).IsNil(err, "test setup: could not write artifact")
+
+	dest := filepath.Join(dir, "install")
+	err = Extract("", artifact, "http://localhost/hello_abc123", dest)
+	Assert(t).IsNil(err, "should have extracted "+name)
+	contents, err := ioutil.ReadFile(filepath.Join(dest, "bin", "launch"))
+	Assert(t).IsNil(err, name+": should have extracted the launch script")
+	Assert(t).AreEqual(string(contents), "#!/bin/sh\necho hello\n", name+": wrong contents")
+}
+
+func TestExtractUnknownFormat(t *testing.T) {
+	artifact, err := ioutil.TempFile("", "artifact")
+	Assert(t).IsNil(err, "test setup: could not create artifact")
+	defer os.Remove(artifact.Name())
+	defer artifact.Close()
+	artifact.Write([]byte("not an archive"))
+
+	err = Extract("", artifact, "http://localhost/hello_abc123.rar", filepath.Join(os.TempDir(), "never-created"))
+	Assert(t).IsNotNil(err, "should not have extracted an unknown format")
+}
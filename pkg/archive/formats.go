@@ -0,0 +1,163 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/square/p2/pkg/gzip"
+	"github.com/square/p2/pkg/util"
+)
+
+func init() {
+	Register(Format{
+		Name:       "tar.gz",
+		Extensions: []string{".tar.gz", ".tgz"},
+		Magic:      []byte{0x1f, 0x8b},
+		Extract: func(owner string, artifact *os.File, dest string) error {
+			return gzip.ExtractTarGz(owner, artifact, dest)
+		},
+	})
+	Register(Format{
+		Name:       "tar.zst",
+		Extensions: []string{".tar.zst", ".tzst"},
+		Magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		Extract:    extractDecompressed("zstd", "-d", "-c", "-q"),
+	})
+	Register(Format{
+		Name:       "tar.xz",
+		Extensions: []string{".tar.xz", ".txz"},
+		Magic:      []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		Extract:    extractDecompressed("xz", "-d", "-c", "-q"),
+	})
+	Register(Format{
+		Name:       "zip",
+		Extensions: []string{".zip"},
+		Magic:      []byte{'P', 'K', 0x03, 0x04},
+		Extract:    extractZip,
+	})
+	// The magic of a tar is in the header of its first entry, and it is missing from
+	// archives written by very old versions of tar, so it is checked last.
+	Register(Format{
+		Name:        "tar",
+		Extensions:  []string{".tar"},
+		Magic:       []byte("ustar"),
+		MagicOffset: 257,
+		Extract: func(owner string, artifact *os.File, dest string) error {
+			return gzip.ExtractTar(owner, artifact, dest, gzip.DefaultLimits)
+		},
+	})
+}
+
+// maxTrailingBytes is how much a decompressor may write after the end of the tar
+// stream, which is normally only the padding of the last tar record.
+const maxTrailingBytes = 1 << 20
+
+// extractDecompressed returns an extractor for tars that are compressed in a format
+// without a Go implementation, which is decompressed by running the given command.
+func extractDecompressed(command string, args ...string) func(string, *os.File, string) error {
+	return func(owner string, artifact *os.File, dest string) error {
+		cmd := exec.Command(command, args...)
+		cmd.Stdin = artifact
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return util.Errorf("Could not run %s to decompress the artifact: %s", command, err)
+		}
+
+		err = gzip.ExtractTar(owner, stdout, dest, gzip.DefaultLimits)
+		if err == nil {
+			var trailing int64
+			trailing, err = io.Copy(ioutil.Discard, io.LimitReader(stdout, maxTrailingBytes+1))
+			if err == nil && trailing > maxTrailingBytes {
+				err = util.Errorf("%s wrote more than %d bytes after the end of the tar", command, maxTrailingBytes)
+			}
+		}
+		if err != nil {
+			// the decompressor may be blocked writing output that will never be read
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			return err
+		}
+		err = cmd.Wait()
+		if err != nil {
+			return util.Errorf("%s failed: %s: %s", command, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	}
+}
+
+// extractZip extracts a zip by converting it to a tar stream, so that its entries get
+// the same checks as the entries of a tar.
+func extractZip(owner string, artifact *os.File, dest string) error {
+	info, err := artifact.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(artifact, info.Size())
+	if err != nil {
+		return util.Errorf("error reading zip data: %s", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(zipToTar(zr, pw))
+	}()
+	err = gzip.ExtractTar(owner, pr, dest, gzip.DefaultLimits)
+	// unblock the writer if extraction stopped early
+	pr.Close()
+	return err
+}
+
+func zipToTar(zr *zip.Reader, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, f := range zr.File {
+		err := func() error {
+			rc, err := f.Open()
+			if err != nil {
+				return util.Errorf("error reading %s from zip: %s", f.Name, err)
+			}
+			defer rc.Close()
+
+			info := f.FileInfo()
+			var link string
+			if info.Mode()&os.ModeSymlink != 0 {
+				// zips store the target of a symlink as its contents
+				target, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+				if err != nil {
+					return util.Errorf("error reading link %s from zip: %s", f.Name, err)
+				}
+				link = string(target)
+			}
+			hdr, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return util.Errorf("unsupported zip entry %s: %s", f.Name, err)
+			}
+			hdr.Name = f.Name
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				// the size in the zip's directory is not trusted, the tar writer
+				// fails if the contents do not match it
+				_, err = io.Copy(tw, rc)
+			}
+			return err
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,297 @@
+// Package artifactcache implements a cache of launchable artifacts that is shared by
+// every pod on a host. Artifacts are stored by their SHA256, so pods that use the same
+// artifact share one copy of it, and reinstalling a launchable does not download its
+// artifact again. Only artifacts whose SHA256 is known in advance are cached.
+package artifactcache
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/digest"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/uri"
+	"github.com/square/p2/pkg/util"
+	"github.com/square/p2/pkg/util/size"
+)
+
+// DefaultMaxSize is the size budget of a cache that does not configure one.
+const DefaultMaxSize = 20 * size.Gibibyte
+
+// Config configures the artifact cache of the preparer.
+type Config struct {
+	// The directory that holds the cache.
+	Dir string `yaml:"dir"`
+	// The most space that cached artifacts may use. When the cache grows past it, the
+	// least recently used artifacts are removed.
+	MaxSize size.ByteCount `yaml:"max_size,omitempty"`
+}
+
+// Cache is a uri.DigestFetcher that keeps the artifacts it fetches in a directory, keyed
+// by their SHA256. Data that is opened without an expected SHA256, such as digests and
+// their signatures, is fetched every time, since the data at its location may change.
+type Cache struct {
+	dir     string
+	maxSize int64
+	fetcher uri.Fetcher
+	logger  logging.Logger
+
+	// guards inflight and eviction
+	lock     sync.Mutex
+	inflight map[string]*download
+}
+
+// download is a fetch of an artifact that is in progress. Concurrent requests for the
+// same artifact wait for it instead of fetching the artifact again, even if they name
+// another location for it.
+type download struct {
+	location string
+	done     chan struct{}
+	err      error
+}
+
+// How many times an artifact is fetched when it is evicted by another download before
+// it can be opened.
+const fetchAttempts = 3
+
+var _ uri.DigestFetcher = &Cache{}
+
+// New returns a cache in the configured directory, which fetches artifacts that are not
+// cached with the given fetcher.
+func New(config Config, fetcher uri.Fetcher, logger logging.Logger) (*Cache, error) {
+	if config.Dir == "" {
+		return nil, util.Errorf("The artifact cache needs a directory")
+	}
+	maxSize := config.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxSize < 0 {
+		return nil, util.Errorf("Invalid artifact cache size %s", maxSize)
+	}
+	cache := &Cache{
+		dir:      config.Dir,
+		maxSize:  int64(maxSize),
+		fetcher:  fetcher,
+		logger:   logger,
+		inflight: make(map[string]*download),
+	}
+	for _, dir := range []string{cache.blobsDir(), cache.tempDir()} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, util.Errorf("Could not create artifact cache directory %s: %s", dir, err)
+		}
+	}
+	return cache, nil
+}
+
+// RemovePartialDownloads removes the downloads left behind by a process that stopped
+// while fetching. It must only be called when no other process is fetching into the
+// cache, such as when the preparer starts.
+func (c *Cache) RemovePartialDownloads() error {
+	err := removeContents(c.tempDir())
+	if err != nil {
+		return util.Errorf("Could not clean artifact cache directory %s: %s", c.tempDir(), err)
+	}
+	return nil
+}
+
+func (c *Cache) blobsDir() string {
+	return filepath.Join(c.dir, "sha256")
+}
+
+func (c *Cache) tempDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c *Cache) blobPath(sha string) string {
+	return filepath.Join(c.blobsDir(), sha)
+}
+
+// Open returns the data at the location. Without an expected SHA256 the data is not
+// cached, so it is always fetched.
+func (c *Cache) Open(location string) (io.ReadCloser, error) {
+	return c.fetcher.Open(location)
+}
+
+// OpenDigest returns the artifact with the given SHA256 if it is cached, even if it was
+// fetched from another location. Otherwise the artifact is fetched from the location
+// into the cache.
+func (c *Cache) OpenDigest(location string, expectedSHA256 string) (io.ReadCloser, error) {
+	if expectedSHA256 == "" {
+		return c.Open(location)
+	}
+	sha := strings.ToLower(expectedSHA256)
+	if !digest.IsSHA256(sha) {
+		return nil, util.Errorf("%q is not a valid SHA256", expectedSHA256)
+	}
+
+	f, err := c.openBlob(sha)
+	for attempt := 0; err != nil && attempt < fetchAttempts; attempt++ {
+		err = c.fetch(location, sha)
+		if err != nil {
+			return nil, err
+		}
+		// another download may have evicted the artifact before it could be opened
+		f, err = c.openBlob(sha)
+	}
+	if err != nil {
+		return nil, util.Errorf("Could not open %s in the artifact cache: %s", location, err)
+	}
+	return f, nil
+}
+
+// CopyLocal copies the data at the location to a local file. Like Open, it does not
+// use the cache.
+func (c *Cache) CopyLocal(srcUri, dstPath string) error {
+	return c.fetcher.CopyLocal(srcUri, dstPath)
+}
+
+// openBlob opens a cached artifact and marks it as recently used.
+func (c *Cache) openBlob(sha string) (*os.File, error) {
+	path := c.blobPath(sha)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// the modification time orders artifacts for eviction
+	_ = os.Chtimes(path, now, now)
+	return f, nil
+}
+
+// fetch downloads the artifact with the given SHA256 from the location into the cache.
+// If the artifact is already being downloaded, from any location, fetch waits for that
+// download instead. If that download fails from another location, the artifact is
+// fetched from this location, since that location may still work.
+func (c *Cache) fetch(location string, sha string) error {
+	c.lock.Lock()
+	if pending, ok := c.inflight[sha]; ok {
+		c.lock.Unlock()
+		<-pending.done
+		if pending.err != nil && pending.location != location {
+			return c.fetch(location, sha)
+		}
+		return pending.err
+	}
+	pending := &download{location: location, done: make(chan struct{})}
+	c.inflight[sha] = pending
+	c.lock.Unlock()
+
+	pending.err = c.download(location, sha)
+
+	c.lock.Lock()
+	delete(c.inflight, sha)
+	c.lock.Unlock()
+	close(pending.done)
+	return pending.err
+}
+
+func (c *Cache) download(location string, sha string) error {
+	src, err := c.fetcher.Open(location)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	temp, err := ioutil.TempFile(c.tempDir(), "download")
+	if err != nil {
+		return util.Errorf("Could not create a file in the artifact cache: %s", err)
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+	_, err = digest.CopyArtifact(temp, src, sha)
+	if err != nil {
+		return util.Errorf("Could not fetch %s into the artifact cache: %s", location, err)
+	}
+	err = temp.Close()
+	if err != nil {
+		return util.Errorf("Could not fetch %s into the artifact cache: %s", location, err)
+	}
+	err = os.Chmod(temp.Name(), 0444)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err = os.Rename(temp.Name(), c.blobPath(sha))
+	if err != nil {
+		return util.Errorf("Could not add %s to the artifact cache: %s", location, err)
+	}
+	c.logger.WithFields(logrus.Fields{
+		"location": location,
+		"sha256":   sha,
+	}).Infoln("Added artifact to the cache")
+
+	c.evict(sha)
+	return nil
+}
+
+// evict removes the least recently used artifacts until the cache is within its size
+// budget. The artifact with the SHA256 keep is never removed, so the artifact that was
+// just fetched can be used even if it is bigger than the whole budget. The caller must
+// hold the lock.
+func (c *Cache) evict(keep string) {
+	entries, err := ioutil.ReadDir(c.blobsDir())
+	if err != nil {
+		c.logger.WithError(err).Errorln("Could not list the artifact cache")
+		return
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size()
+	}
+	if total <= c.maxSize {
+		return
+	}
+
+	sort.Sort(byModTime(entries))
+	for _, entry := range entries {
+		if total <= c.maxSize {
+			break
+		}
+		if entry.Name() == keep {
+			continue
+		}
+		// artifacts that are open keep their data until they are closed
+		err = os.Remove(filepath.Join(c.blobsDir(), entry.Name()))
+		if err != nil {
+			c.logger.WithErrorAndFields(err, logrus.Fields{"sha256": entry.Name()}).Errorln("Could not evict artifact from the cache")
+			continue
+		}
+		total -= entry.Size()
+		c.logger.WithFields(logrus.Fields{
+			"sha256": entry.Name(),
+			"size":   entry.Size(),
+		}).Infoln("Evicted artifact from the cache")
+	}
+}
+
+type byModTime []os.FileInfo
+
+func (b byModTime) Len() int           { return len(b) }
+func (b byModTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byModTime) Less(i, j int) bool { return b[i].ModTime().Before(b[j].ModTime()) }
+
+// removeContents removes everything in dir, but not dir itself.
+func removeContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package artifactcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/util"
+	"github.com/square/p2/pkg/util/size"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+// fakeFetcher serves fixed contents and counts how often each location is opened.
+type fakeFetcher struct {
+	contents map[string]string
+	// if not nil, opens wait until it is closed
+	block chan struct{}
+
+	lock  sync.Mutex
+	opens map[string]int
+}
+
+func (f *fakeFetcher) Open(location string) (io.ReadCloser, error) {
+	if f.block != nil {
+		<-f.block
+	}
+	f.lock.Lock()
+	f.opens[location]++
+	f.lock.Unlock()
+	data, ok := f.contents[location]
+	if !ok {
+		return nil, util.Errorf("%s not found", location)
+	}
+	return ioutil.NopCloser(bytes.NewBufferString(data)), nil
+}
+
+func (f *fakeFetcher) CopyLocal(srcUri, dstPath string) error {
+	return util.Errorf("not implemented")
+}
+
+func (f *fakeFetcher) count(location string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.opens[location]
+}
+
+func newTestCache(t *testing.T, maxSize int64, contents map[string]string) (*Cache, *fakeFetcher, func()) {
+	dir, err := ioutil.TempDir("", "artifactcache")
+	Assert(t).IsNil(err, "test setup: could not create temp dir")
+	fetcher := &fakeFetcher{contents: contents, opens: make(map[string]int)}
+	cache, err := New(Config{Dir: dir, MaxSize: size.ByteCount(maxSize)}, fetcher, logging.TestLogger())
+	Assert(t).IsNil(err, "test setup: could not create cache")
+	return cache, fetcher, func() { os.RemoveAll(dir) }
+}
+
+func readAll(t *testing.T, r io.ReadCloser, err error) string {
+	Assert(t).IsNil(err, "should have opened the artifact")
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	Assert(t).IsNil(err, "should have read the artifact")
+	return string(data)
+}
+
+func sha(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCacheServesRepeatFetches(t *testing.T) {
+	cache, fetcher, cleanup := newTestCache(t, 1024, map[string]string{
+		"http://a/hello_1.tar.gz": "hello",
+		"http://b/hello_1.tar.gz": "hello",
+	})
+	defer cleanup()
+
+	r, err := cache.OpenDigest("http://a/hello_1.tar.gz", sha("hello"))
+	Assert(t).AreEqual(readAll(t, r, err), "hello", "wrong artifact contents")
+	r, err = cache.OpenDigest("http://a/hello_1.tar.gz", sha("hello"))
+	Assert(t).AreEqual(readAll(t, r, err), "hello", "wrong artifact contents")
+	Assert(t).AreEqual(fetcher.count("http://a/hello_1.tar.gz"), 1, "a cached artifact should not be fetched again")
+
+	r, err = cache.OpenDigest("http://b/hello_1.tar.gz", sha("hello"))
+	Assert(t).AreEqual(readAll(t, r, err), "hello", "wrong artifact contents")
+	Assert(t).AreEqual(fetcher.count("http://b/hello_1.tar.gz"), 0, "an artifact with a cached digest should not be fetched")
+
+	_, err = cache.OpenDigest("http://a/missing.tar.gz", sha("missing"))
+	Assert(t).IsNotNil(err, "fetch errors should be returned")
+}
+
+func TestCacheDoesNotCacheUnpinnedData(t *testing.T) {
+	cache, fetcher, cleanup := newTestCache(t, 1024, map[string]string{"http://a/hello_1.tar.gz.sha256": "old digest"})
+	defer cleanup()
+
+	r, err := cache.Open("http://a/hello_1.tar.gz.sha256")
+	Assert(t).AreEqual(readAll(t, r, err), "old digest", "wrong contents")
+	// the digest is re-signed at the same location
+	fetcher.contents["http://a/hello_1.tar.gz.sha256"] = "new digest"
+	r, err = cache.Open("http://a/hello_1.tar.gz.sha256")
+	Assert(t).AreEqual(readAll(t, r, err), "new digest", "data without a SHA256 should be fetched again")
+	Assert(t).AreEqual(fetcher.count("http://a/hello_1.tar.gz.sha256"), 2, "data without a SHA256 should not be cached")
+
+	entries, err := ioutil.ReadDir(cache.blobsDir())
+	Assert(t).IsNil(err, "should have listed the cache")
+	Assert(t).AreEqual(len(entries), 0, "data without a SHA256 should not be stored")
+}
+
+func TestCacheRejectsMismatchedArtifacts(t *testing.T) {
+	cache, _, cleanup := newTestCache(t, 1024, map[string]string{"http://a/hello_1.tar.gz": "tampered"})
+	defer cleanup()
+
+	_, err := cache.OpenDigest("http://a/hello_1.tar.gz", sha("hello"))
+	Assert(t).IsNotNil(err, "an artifact with the wrong SHA256 should not be returned")
+	_, err = os.Stat(cache.blobPath(sha("hello")))
+	Assert(t).IsTrue(os.IsNotExist(err), "an artifact with the wrong SHA256 should not be cached")
+
+	_, err = cache.OpenDigest("http://a/hello_1.tar.gz", "../../etc/passwd")
+	Assert(t).IsNotNil(err, "an invalid SHA256 should be rejected")
+}
+
+func TestCacheDeduplicatesConcurrentFetches(t *testing.T) {
+	cache, fetcher, cleanup := newTestCache(t, 1024, map[string]string{
+		"http://a/hello_1.tar.gz": "hello",
+		"http://b/hello_1.tar.gz": "hello",
+	})
+	defer cleanup()
+	fetcher.block = make(chan struct{})
+
+	var wg sync.WaitGroup
+	results := make([]string, 6)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// the same artifact from two locations
+			location := "http://a/hello_1.tar.gz"
+			if i%2 == 1 {
+				location = "http://b/hello_1.tar.gz"
+			}
+			r, err := cache.OpenDigest(location, sha("hello"))
+			results[i] = readAll(t, r, err)
+		}(i)
+	}
+	// give every goroutine a chance to start waiting for the fetch
+	time.Sleep(50 * time.Millisecond)
+	close(fetcher.block)
+	wg.Wait()
+
+	fetches := fetcher.count("http://a/hello_1.tar.gz") + fetcher.count("http://b/hello_1.tar.gz")
+	Assert(t).AreEqual(fetches, 1, "concurrent opens of one artifact should share one fetch")
+	for _, result := range results {
+		Assert(t).AreEqual(result, "hello", "wrong artifact contents")
+	}
+}
+
+func TestCacheRetriesOwnLocationWhenSharedFetchFails(t *testing.T) {
+	cache, fetcher, cleanup := newTestCache(t, 1024, map[string]string{
+		// the first location serves the wrong data, the second one works
+		"http://a/hello_1.tar.gz": "tampered",
+		"http://b/hello_1.tar.gz": "hello",
+	})
+	defer cleanup()
+	fetcher.block = make(chan struct{})
+
+	first := make(chan error)
+	go func() {
+		_, err := cache.OpenDigest("http://a/hello_1.tar.gz", sha("hello"))
+		first <- err
+	}()
+	// let the first fetch start before the second one joins it
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan string)
+	go func() {
+		r, err := cache.OpenDigest("http://b/hello_1.tar.gz", sha("hello"))
+		second <- readAll(t, r, err)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(fetcher.block)
+
+	Assert(t).IsNotNil(<-first, "the bad location should fail")
+	Assert(t).AreEqual(<-second, "hello", "a working location should not fail with another location's error")
+	Assert(t).AreEqual(fetcher.count("http://b/hello_1.tar.gz"), 1, "the working location should have been fetched")
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, fetcher, cleanup := newTestCache(t, 10, map[string]string{
+		"http://a/old_1.tar.gz": "123456",
+		"http://a/new_1.tar.gz": "abcdef",
+	})
+	defer cleanup()
+
+	r, err := cache.OpenDigest("http://a/old_1.tar.gz", sha("123456"))
+	readAll(t, r, err)
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(cache.blobPath(sha("123456")), past, past)
+	Assert(t).IsNil(err, "test setup: could not age artifact")
+
+	r, err = cache.OpenDigest("http://a/new_1.tar.gz", sha("abcdef"))
+	readAll(t, r, err)
+	_, err = os.Stat(cache.blobPath(sha("123456")))
+	Assert(t).IsTrue(os.IsNotExist(err), "the least recently used artifact should have been evicted")
+	_, err = os.Stat(cache.blobPath(sha("abcdef")))
+	Assert(t).IsNil(err, "the new artifact should be cached")
+
+	r, err = cache.OpenDigest("http://a/old_1.tar.gz", sha("123456"))
+	Assert(t).AreEqual(readAll(t, r, err), "123456", "wrong artifact contents")
+	Assert(t).AreEqual(fetcher.count("http://a/old_1.tar.gz"), 2, "an evicted artifact should be fetched again")
+}
+
+func TestPartialDownloadsOnlyRemovedOnRequest(t *testing.T) {
+	cache, _, cleanup := newTestCache(t, 1024, nil)
+	defer cleanup()
+	partial := filepath.Join(cache.tempDir(), "partial")
+	err := ioutil.WriteFile(partial, []byte("hel"), 0644)
+	Assert(t).IsNil(err, "test setup: could not write a partial download")
+
+	_, err = New(Config{Dir: cache.dir}, cache.fetcher, logging.TestLogger())
+	Assert(t).IsNil(err, "should have opened the cache again")
+	_, err = os.Stat(partial)
+	Assert(t).IsNil(err, "opening the cache should not remove downloads that may be in progress")
+
+	err = cache.RemovePartialDownloads()
+	Assert(t).IsNil(err, "should have removed partial downloads")
+	_, err = os.Stat(partial)
+	Assert(t).IsTrue(os.IsNotExist(err), "partial download should have been removed")
+}
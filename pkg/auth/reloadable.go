@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"sync"
+
+	"github.com/square/p2/pkg/logging"
+)
+
+// ReloadablePolicy delegates to another Policy that can be replaced while the
+// ReloadablePolicy is in use. Calls that are in progress during a replacement finish
+// with the old policy before it is closed.
+type ReloadablePolicy struct {
+	lock   sync.RWMutex
+	policy Policy
+}
+
+func NewReloadablePolicy(policy Policy) *ReloadablePolicy {
+	return &ReloadablePolicy{policy: policy}
+}
+
+// Swap replaces the current policy with the given one and closes the old policy.
+func (p *ReloadablePolicy) Swap(policy Policy) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.policy.Close()
+	p.policy = policy
+}
+
+func (p *ReloadablePolicy) AuthorizeApp(manifest Manifest, logger logging.Logger) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.policy.AuthorizeApp(manifest, logger)
+}
+
+func (p *ReloadablePolicy) AuthorizeHook(manifest Manifest, logger logging.Logger) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.policy.AuthorizeHook(manifest, logger)
+}
+
+func (p *ReloadablePolicy) CheckDigest(digest Digest) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.policy.CheckDigest(digest)
+}
+
+func (p *ReloadablePolicy) Close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.policy.Close()
+}
+
+// Assert that ReloadablePolicy is a Policy
+var _ Policy = &ReloadablePolicy{}
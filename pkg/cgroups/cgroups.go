@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/square/p2/pkg/util"
 )
@@ -180,6 +181,46 @@ func (subsys Subsystems) AddPID(name string, pid int) error {
 	return appendIntToFile(filepath.Join(subsys.CPU, name, "cgroup.procs"), pid)
 }
 
+// Remove deletes the named cgroup and the cgroups nested under it from every
+// subsystem. The cgroups must not contain any processes. Removing a cgroup that does
+// not exist is not an error.
+func (subsys Subsystems) Remove(name string) error {
+	for _, root := range []string{subsys.CPU, subsys.Memory} {
+		if root == "" {
+			continue
+		}
+		err := removeCgroupDir(filepath.Join(root, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeCgroupDir removes a cgroup directory after its children. The control files in
+// a cgroup directory cannot be deleted, the kernel removes them along with it.
+func removeCgroupDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			err = removeCgroupDir(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = syscall.Rmdir(dir)
+	if err != nil && err != syscall.ENOENT {
+		return &os.PathError{Op: "rmdir", Path: dir, Err: err}
+	}
+	return nil
+}
+
 func appendIntToFile(filename string, data int) error {
 	fd, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
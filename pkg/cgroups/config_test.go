@@ -1,6 +1,9 @@
 package cgroups
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/square/p2/pkg/util/size"
@@ -24,3 +27,27 @@ func TestMarshalStringByteCount(t *testing.T) {
 	Assert(t).IsNil(err, "Should not have erred unmarshaling")
 	Assert(t).AreEqual(config.Memory, 500*size.Gibibyte, "Should have unmarshaled the integer representation of bytes")
 }
+
+func TestRemoveNestedCgroups(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroups")
+	Assert(t).IsNil(err, "could not create a fake cgroupfs")
+	defer os.RemoveAll(root)
+	subsys := Subsystems{
+		CPU:    filepath.Join(root, "cpu"),
+		Memory: filepath.Join(root, "memory"),
+	}
+	for _, dir := range []string{subsys.CPU, subsys.Memory} {
+		err = os.MkdirAll(filepath.Join(dir, "pod", "pod__app"), 0755)
+		Assert(t).IsNil(err, "could not create a fake cgroup")
+	}
+
+	err = subsys.Remove("pod")
+	Assert(t).IsNil(err, "should have removed the cgroups")
+	_, err = os.Stat(filepath.Join(subsys.CPU, "pod"))
+	Assert(t).IsTrue(os.IsNotExist(err), "cpu cgroup should have been removed")
+	_, err = os.Stat(filepath.Join(subsys.Memory, "pod"))
+	Assert(t).IsTrue(os.IsNotExist(err), "memory cgroup should have been removed")
+
+	err = subsys.Remove("pod")
+	Assert(t).IsNil(err, "removing a missing cgroup should succeed")
+}
@@ -0,0 +1,85 @@
+package digest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/square/p2/pkg/uri"
+	"github.com/square/p2/pkg/util"
+)
+
+// CopyArtifact copies a downloaded artifact to dst, computing its SHA256 as it is
+// streamed. Returns the hex encoded SHA256 of the artifact. If expectedSHA256 is not
+// empty and does not match, an error is returned and the caller must discard what was
+// written to dst.
+func CopyArtifact(dst io.Writer, src io.Reader, expectedSHA256 string) (string, error) {
+	hasher := sha256.New()
+	_, err := io.Copy(io.MultiWriter(dst, hasher), src)
+	if err != nil {
+		return "", err
+	}
+	receivedSHA := hex.EncodeToString(hasher.Sum(nil))
+	if expectedSHA256 != "" && !strings.EqualFold(receivedSHA, expectedSHA256) {
+		return receivedSHA, util.Errorf("Received artifact SHA256 %s (expected %s)", receivedSHA, expectedSHA256)
+	}
+	return receivedSHA, nil
+}
+
+// FetchArtifact downloads an artifact into dst with CopyArtifact, and returns the
+// location it was downloaded from. If the artifact cannot be downloaded from location,
+// or does not match, the mirrors are tried in order. Mirrors are only used when
+// expectedSHA256 is set, because nothing else stops a mirror from serving a different
+// artifact.
+func FetchArtifact(dst *os.File, fetcher uri.Fetcher, location string, mirrors []string, expectedSHA256 string) (string, error) {
+	locations := []string{location}
+	if expectedSHA256 != "" {
+		locations = append(locations, mirrors...)
+	}
+
+	var failures []string
+	for _, loc := range locations {
+		err := fetchArtifact(dst, fetcher, loc, expectedSHA256)
+		if err == nil {
+			return loc, nil
+		}
+		failures = append(failures, err.Error())
+	}
+	if len(failures) == 1 {
+		return "", util.Errorf("%s", failures[0])
+	}
+	return "", util.Errorf("%q and its mirrors could not be fetched: %s", location, strings.Join(failures, "; "))
+}
+
+func fetchArtifact(dst *os.File, fetcher uri.Fetcher, location string, expectedSHA256 string) error {
+	// discard what an earlier location wrote
+	err := dst.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	data, err := uri.OpenDigest(fetcher, location, expectedSHA256)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	_, err = CopyArtifact(dst, data, expectedSHA256)
+	if err != nil {
+		return util.Errorf("fetching %s: %s", location, err)
+	}
+	return nil
+}
+
+// IsSHA256 returns true if the string is a hex encoded SHA256 hash.
+func IsSHA256(s string) bool {
+	if len(s) != hashLength {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,83 @@
+package digest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// An artifact can carry its own digest, and optionally the detached signature of that
+// digest, at these paths relative to its root. They are used to verify a launchable
+// whose manifest does not name a digest_location.
+const (
+	EmbeddedDigestPath    = ".p2/digest"
+	EmbeddedSignaturePath = ".p2/digest.sig"
+)
+
+var embeddedFiles = map[string]bool{
+	EmbeddedDigestPath:    true,
+	EmbeddedSignaturePath: true,
+}
+
+// Generate returns a digest of every file under root, in the sha256sum format that
+// Parse reads. The files of an embedded digest are left out, so the digest can be
+// embedded in the tree that it describes.
+func Generate(root string) ([]byte, error) {
+	hashes := make(map[string]string)
+	err := walkFiles(root, func(relPath string, path string) error {
+		if embeddedFiles[relPath] {
+			return nil
+		}
+		sha, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		hashes[relPath] = sha
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(hashes))
+	for path := range hashes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	buf := &bytes.Buffer{}
+	for _, path := range paths {
+		fmt.Fprintf(buf, "%s  %s\n", hashes[path], path)
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseEmbedded parses the digest embedded in the tree at root, and its signature if
+// there is one. Returns false if the tree does not embed a digest.
+func ParseEmbedded(root string) (Digest, bool, error) {
+	digestFile, err := os.Open(filepath.Join(root, EmbeddedDigestPath))
+	if os.IsNotExist(err) {
+		return Digest{}, false, nil
+	} else if err != nil {
+		return Digest{}, false, err
+	}
+	defer digestFile.Close()
+
+	var signature io.Reader
+	signatureFile, err := os.Open(filepath.Join(root, EmbeddedSignaturePath))
+	if err == nil {
+		defer signatureFile.Close()
+		signature = signatureFile
+	} else if !os.IsNotExist(err) {
+		return Digest{}, false, err
+	}
+
+	digest, err := Parse(digestFile, signature)
+	if err != nil {
+		return Digest{}, false, err
+	}
+	digest.skip = embeddedFiles
+	return digest, true, nil
+}
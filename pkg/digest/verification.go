@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
@@ -20,6 +21,8 @@ type Digest struct {
 	FileHashes map[string]string
 	plaintext  []byte
 	signature  []byte
+	// files under the root that the digest does not cover
+	skip map[string]bool
 }
 
 func (digest Digest) SignatureData() (plaintext, signature []byte) {
@@ -29,8 +32,11 @@ func (digest Digest) SignatureData() (plaintext, signature []byte) {
 	return digest.plaintext, digest.signature
 }
 
+// VerifyDir checks the files under root against the digest, like the VerifyDir
+// function. If the digest is embedded in the tree, its own files are not checked,
+// since a digest cannot contain itself.
 func (digest Digest) VerifyDir(root string) error {
-	return VerifyDir(root, digest.FileHashes)
+	return verifyDir(root, digest.FileHashes, digest.skip)
 }
 
 // Walks an entire file tree and takes the sha256sum of every file, comparing it
@@ -38,8 +44,47 @@ func (digest Digest) VerifyDir(root string) error {
 // not match, or if there are files missing (from the digest or the tree),
 // an error is returned.
 func VerifyDir(root string, digest map[string]string) error {
+	return verifyDir(root, digest, nil)
+}
+
+func verifyDir(root string, digest map[string]string, skip map[string]bool) error {
 	foundFiles := map[string]bool{}
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	err := walkFiles(root, func(relPath string, path string) error {
+		if skip[relPath] {
+			return nil
+		}
+		expectedSHA, ok := digest[relPath]
+		if !ok {
+			return util.Errorf("File %s (full path %s) was not in digest", relPath, path)
+		}
+		// `foundFiles` is always a subset of `digest`
+		foundFiles[relPath] = true
+
+		receivedSHA, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if receivedSHA != expectedSHA {
+			return util.Errorf("Received SHA %s (expected %s) for file %s", receivedSHA, expectedSHA, path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	// By construction `foundFiles` is a subset of `digest`, so this
+	// is a faster check for equivalence.
+	if len(digest) != len(foundFiles) {
+		return util.Errorf("Not all files in the digest were found")
+	}
+	return nil
+}
+
+// walkFiles calls fn with the path relative to root and the full path of every file
+// in the tree that a digest covers.
+func walkFiles(root string, fn func(relPath string, path string) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if info.IsDir() {
 			return nil
 		}
@@ -71,41 +116,24 @@ func VerifyDir(root string, digest map[string]string) error {
 		if err != nil {
 			return err
 		}
-		expectedSHA, ok := digest[relPath]
-		if !ok {
-			return util.Errorf("File %s (full path %s) was not in digest", relPath, path)
-		}
-		// `foundFiles` is always a subset of `digest`
-		foundFiles[relPath] = true
-
-		fd, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer fd.Close()
-
-		hasher := sha256.New()
-		_, err = io.Copy(hasher, fd)
-		if err != nil {
-			return err
-		}
-		receivedSHA := hex.EncodeToString(hasher.Sum(nil))
-
-		if receivedSHA != expectedSHA {
-			return util.Errorf("Received SHA %s (expected %s) for file %s", receivedSHA, expectedSHA, path)
-		}
-		return nil
+		return fn(relPath, path)
 	})
+}
 
+// hashFile returns the hex encoded SHA256 of a file's contents.
+func hashFile(path string) (string, error) {
+	fd, err := os.Open(path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	// By construction `foundFiles` is a subset of `digest`, so this
-	// is a faster check for equivalence.
-	if len(digest) != len(foundFiles) {
-		return util.Errorf("Not all files in the digest were found")
+	defer fd.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, fd)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
 // Parses a sha256sum digest at the given digest URI, with a detached
@@ -116,11 +144,12 @@ func ParseUris(
 	digestUri string,
 	signatureUri string,
 ) (Digest, error) {
-	digest, err := fetcher.Open(digestUri)
+	// The digest is closed before the signature is opened, since a fetcher
+	// may limit how many downloads from one host are open at once.
+	digest, err := readUri(fetcher, digestUri)
 	if err != nil {
 		return Digest{}, err
 	}
-	defer digest.Close()
 	var signature io.ReadCloser
 	if signatureUri != "" {
 		signature, err = fetcher.Open(signatureUri)
@@ -129,7 +158,16 @@ func ParseUris(
 		}
 		defer signature.Close()
 	}
-	return Parse(digest, signature)
+	return Parse(bytes.NewReader(digest), signature)
+}
+
+func readUri(fetcher uri.Fetcher, location string) ([]byte, error) {
+	data, err := fetcher.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	return ioutil.ReadAll(data)
 }
 
 // Parses a sha256sum digest. Each line is a 64-character sha256 hash
@@ -175,5 +213,5 @@ func Parse(digestReader, signatureReader io.Reader) (Digest, error) {
 		}
 		ret[cleanname] = line[:hashLength]
 	}
-	return Digest{ret, digest, signature}, nil
+	return Digest{FileHashes: ret, plaintext: digest, signature: signature}, nil
 }
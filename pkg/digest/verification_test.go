@@ -2,11 +2,16 @@ package digest
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/square/p2/pkg/uri"
 
 	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
 )
@@ -90,3 +95,90 @@ func TestSimpleDigestParsing(t *testing.T) {
 		"c/d": "18ac3e7343f016890c510e93f935261169d9e3f565436429830faf0934f4f8e4",
 	}), "manifests should have matched")
 }
+
+func TestParseUrisWithOneConnectionPerHost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a.sha256":
+			w.Write([]byte("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb  ./a\n"))
+		case "/a.sig":
+			w.Write([]byte("signature"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	fetcher, err := uri.NewFetcher(uri.FetcherConfig{MaxConnsPerHost: 1})
+	Assert(t).IsNil(err, "test setup: could not create fetcher")
+
+	done := make(chan error)
+	go func() {
+		_, err := ParseUris(fetcher, ts.URL+"/a.sha256", ts.URL+"/a.sig")
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		Assert(t).IsNil(err, "digest should have parsed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the digest and its signature should not wait for each other")
+	}
+}
+
+func TestGenerateAndVerifyEmbeddedDigest(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "verification")
+	Assert(t).IsNil(err, "temp dir error should be nil")
+	defer os.RemoveAll(workdir)
+
+	_, embedded, err := ParseEmbedded(workdir)
+	Assert(t).IsNil(err, "a missing embedded digest should not be an error")
+	Assert(t).IsFalse(embedded, "there should be no embedded digest yet")
+
+	err = os.Mkdir(filepath.Join(workdir, "c"), 0755)
+	Assert(t).IsNil(err, "temp dir error should be nil")
+	err = ioutil.WriteFile(filepath.Join(workdir, "c", "d"), []byte("d"), 0644)
+	Assert(t).IsNil(err, "temp file error should be nil")
+	err = ioutil.WriteFile(filepath.Join(workdir, "a"), []byte("a"), 0644)
+	Assert(t).IsNil(err, "temp file error should be nil")
+
+	generated, err := Generate(workdir)
+	Assert(t).IsNil(err, "digest generation should have succeeded")
+	Assert(t).AreEqual(string(generated), "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb  a\n"+
+		"18ac3e7343f016890c510e93f935261169d9e3f565436429830faf0934f4f8e4  c/d\n", "wrong generated digest")
+
+	err = os.Mkdir(filepath.Join(workdir, ".p2"), 0755)
+	Assert(t).IsNil(err, "temp dir error should be nil")
+	err = ioutil.WriteFile(filepath.Join(workdir, EmbeddedDigestPath), generated, 0644)
+	Assert(t).IsNil(err, "temp file error should be nil")
+	regenerated, err := Generate(workdir)
+	Assert(t).IsNil(err, "digest generation should have succeeded")
+	Assert(t).AreEqual(string(regenerated), string(generated), "the embedded digest should not be part of the digest")
+
+	digest, embedded, err := ParseEmbedded(workdir)
+	Assert(t).IsNil(err, "embedded digest should have been parsed")
+	Assert(t).IsTrue(embedded, "the embedded digest should have been found")
+	plaintext, signature := digest.SignatureData()
+	Assert(t).IsTrue(plaintext == nil && signature == nil, "an unsigned digest should have no signature data")
+	Assert(t).IsNil(digest.VerifyDir(workdir), "the tree should match its embedded digest")
+
+	err = ioutil.WriteFile(filepath.Join(workdir, "a"), []byte("changed"), 0644)
+	Assert(t).IsNil(err, "temp file error should be nil")
+	Assert(t).IsNotNil(digest.VerifyDir(workdir), "a changed file should not match the embedded digest")
+}
+
+func TestExternalDigestCoversEmbeddedPaths(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "verification")
+	Assert(t).IsNil(err, "temp dir error should be nil")
+	defer os.RemoveAll(workdir)
+
+	err = ioutil.WriteFile(filepath.Join(workdir, "a"), []byte("a"), 0644)
+	Assert(t).IsNil(err, "temp file error should be nil")
+	external, err := Parse(strings.NewReader("ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb  a\n"), nil)
+	Assert(t).IsNil(err, "digest should have parsed")
+	Assert(t).IsNil(external.VerifyDir(workdir), "the tree should match the digest")
+
+	err = os.Mkdir(filepath.Join(workdir, ".p2"), 0755)
+	Assert(t).IsNil(err, "temp dir error should be nil")
+	err = ioutil.WriteFile(filepath.Join(workdir, EmbeddedSignaturePath), []byte("unverified"), 0644)
+	Assert(t).IsNil(err, "temp file error should be nil")
+	Assert(t).IsNotNil(external.VerifyDir(workdir), "an external digest should not skip files at the embedded digest paths")
+}
@@ -3,79 +3,205 @@ package gzip
 import (
 	"archive/tar"
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/square/p2/pkg/user"
 	"github.com/square/p2/pkg/util"
 )
 
+// Limits bounds how much a single archive may extract, so that a broken or malicious
+// artifact cannot fill the disk.
+type Limits struct {
+	// The total size in bytes of the regular files in the archive.
+	MaxBytes int64
+	// The number of entries in the archive, of any type.
+	MaxEntries int64
+}
+
+// DefaultLimits are the limits used by ExtractTarGz.
+var DefaultLimits = Limits{
+	MaxBytes:   20 << 30,
+	MaxEntries: 1000000,
+}
+
+// UnsafePathError is returned for an entry that would be written outside of the
+// destination directory, or through a symlink.
+type UnsafePathError struct {
+	Name string
+}
+
+func (e UnsafePathError) Error() string {
+	return fmt.Sprintf("entry %q would be written outside of the destination", e.Name)
+}
+
+// UnsafeLinkError is returned for a link whose target is outside of the destination
+// directory.
+type UnsafeLinkError struct {
+	Name   string
+	Target string
+}
+
+func (e UnsafeLinkError) Error() string {
+	return fmt.Sprintf("link %q -> %q points outside of the destination", e.Name, e.Target)
+}
+
+// ForbiddenEntryError is returned for entries that are never extracted, such as device
+// nodes and setuid or setgid files.
+type ForbiddenEntryError struct {
+	Name   string
+	Reason string
+}
+
+func (e ForbiddenEntryError) Error() string {
+	return fmt.Sprintf("entry %q is not allowed: %s", e.Name, e.Reason)
+}
+
+// LimitError is returned when an archive exceeds one of its Limits.
+type LimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("archive exceeds the limit of %d %s", e.Max, e.Limit)
+}
+
+// ExtractError is returned for any other failure to read the archive or to write its
+// contents.
+type ExtractError struct{ Inner error }
+
+func (e ExtractError) Error() string { return e.Inner.Error() }
+
+func extractErrorf(format string, args ...interface{}) error {
+	return ExtractError{util.Errorf(format, args...)}
+}
+
 // ExtractTarGz reads a gzipped tar stream and extracts all files to the destination
 // directory. If an owner name is specified, all files will be created to be owned by that
-// user; otherwise, the tar specifies ownership.
-func ExtractTarGz(owner string, fp io.Reader, dest string) (err error) {
+// user; otherwise, the tar specifies ownership. The archive is extracted with
+// DefaultLimits.
+func ExtractTarGz(owner string, fp io.Reader, dest string) error {
+	return ExtractTarGzWithLimits(owner, fp, dest, DefaultLimits)
+}
+
+// ExtractTarGzWithLimits is ExtractTarGz with the given limits.
+func ExtractTarGzWithLimits(owner string, fp io.Reader, dest string, limits Limits) error {
 	fz, err := gzip.NewReader(fp)
 	if err != nil {
-		return util.Errorf("error reading gzip data: %s", err)
+		return extractErrorf("error reading gzip data: %s", err)
 	}
 	defer fz.Close()
-	tr := tar.NewReader(fz)
+	return ExtractTar(owner, fz, dest, limits)
+}
+
+// ExtractTar extracts an uncompressed tar stream to the destination directory, like
+// ExtractTarGz. Every entry, and the target of every link, must stay within the
+// destination directory, and nothing is ever written through a symlink. Device nodes,
+// FIFOs and setuid or setgid files are rejected. All errors are one of the error types
+// of this package; the destination may be partially extracted when an error is
+// returned.
+func ExtractTar(owner string, fp io.Reader, dest string, limits Limits) (err error) {
+	tr := tar.NewReader(fp)
 
 	var ownerUID, ownerGID int
 	if owner != "" {
 		ownerUID, ownerGID, err = user.IDs(owner)
 		if err != nil {
-			return err
+			return ExtractError{err}
 		}
 	}
 
+	dest = filepath.Clean(dest)
 	err = util.MkdirChownAll(dest, ownerUID, ownerGID, 0755)
 	if err != nil {
-		return util.Errorf("error creating root directory %s: %s", dest, err)
+		return extractErrorf("error creating root directory %s: %s", dest, err)
 	}
 	err = os.Chown(dest, ownerUID, ownerGID)
 	if err != nil {
-		return util.Errorf("error setting ownership of root directory %s: %s", dest, err)
+		return extractErrorf("error setting ownership of root directory %s: %s", dest, err)
 	}
 
+	var entries, extracted int64
+	var symlinks []string
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return util.Errorf("read error: %s", err)
+			return extractErrorf("read error: %s", err)
+		}
+		entries++
+		if entries > limits.MaxEntries {
+			return LimitError{Limit: "entries", Max: limits.MaxEntries}
 		}
+
 		fpath := filepath.Join(dest, hdr.Name)
+		if !within(dest, fpath) || fpath == dest && hdr.Typeflag != tar.TypeDir {
+			return UnsafePathError{Name: hdr.Name}
+		}
+		// setgid directories only make new files inherit their group, which is harmless
+		forbiddenBits := os.ModeSetuid | os.ModeSetgid
+		if hdr.Typeflag == tar.TypeDir {
+			forbiddenBits = os.ModeSetuid
+		}
+		if hdr.FileInfo().Mode()&forbiddenBits != 0 {
+			return ForbiddenEntryError{Name: hdr.Name, Reason: "setuid and setgid files are not allowed"}
+		}
+		// nothing may be written through a symlink created by an earlier entry
+		err = checkNoSymlinks(dest, fpath)
+		if err != nil {
+			return err
+		}
 		var uid, gid int
 		if owner == "" {
 			uid, gid = hdr.Uid, hdr.Gid
 		} else {
 			uid, gid = ownerUID, ownerGID
 		}
+		mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSticky)
+		// archives such as zips do not always have entries for parent directories
+		if fpath != dest {
+			err = util.MkdirChownAll(filepath.Dir(fpath), uid, gid, 0755)
+			if err != nil {
+				return extractErrorf("error creating parent directory of %s: %s", fpath, err)
+			}
+		}
 
 		switch hdr.Typeflag {
 		case tar.TypeSymlink:
-			err = os.Symlink(hdr.Linkname, fpath)
+			target := hdr.Linkname
+			if filepath.IsAbs(target) || !within(dest, filepath.Join(filepath.Dir(fpath), target)) {
+				return UnsafeLinkError{Name: hdr.Name, Target: hdr.Linkname}
+			}
+			err = os.Symlink(target, fpath)
 			if err != nil {
-				return util.Errorf(
+				return extractErrorf(
 					"error creating symlink %s -> %s: %s",
 					fpath,
-					hdr.Linkname,
+					target,
 					err,
 				)
 			}
 			err = os.Lchown(fpath, uid, gid)
 			if err != nil {
-				return util.Errorf("error setting owner of %s: %s", fpath, err)
+				return extractErrorf("error setting owner of %s: %s", fpath, err)
 			}
+			symlinks = append(symlinks, fpath)
 		case tar.TypeLink:
+			if !within(dest, filepath.Join(dest, hdr.Linkname)) {
+				return UnsafeLinkError{Name: hdr.Name, Target: hdr.Linkname}
+			}
 			// hardlink paths are encoded relative to the tarball root, rather than
 			// the path of the link itself, so we need to resolve that path
-			linkTarget, err := filepath.Rel(filepath.Dir(hdr.Name), hdr.Linkname)
+			linkTarget, err := filepath.Rel(filepath.Dir(fpath), filepath.Join(dest, hdr.Linkname))
 			if err != nil {
-				return util.Errorf(
+				return extractErrorf(
 					"error resolving link: %s -> %s: %s",
 					fpath,
 					hdr.Linkname,
@@ -86,57 +212,115 @@ func ExtractTarGz(owner string, fp io.Reader, dest string) (err error) {
 			// exist, so we'll just make a symlink instead
 			err = os.Symlink(linkTarget, fpath)
 			if err != nil {
-				return util.Errorf(
+				return extractErrorf(
 					"error creating symlink %s -> %s (originally hardlink): %s",
 					fpath,
 					linkTarget,
 					err,
 				)
 			}
+			symlinks = append(symlinks, fpath)
 		case tar.TypeDir:
-			err = os.Mkdir(fpath, hdr.FileInfo().Mode())
+			err = os.Mkdir(fpath, mode)
 			if err != nil && !os.IsExist(err) {
-				return util.Errorf("error creating directory %s: %s", fpath, err)
+				return extractErrorf("error creating directory %s: %s", fpath, err)
 			}
 
 			err = os.Chown(fpath, uid, gid)
 			if err != nil {
-				return util.Errorf("error setting ownership of %s: %s", fpath, err)
+				return extractErrorf("error setting ownership of %s: %s", fpath, err)
 			}
 		case tar.TypeReg, tar.TypeRegA:
 			// Extract the file inside a closure to limit the scope of its open FD
 			err = func() (innerErr error) {
 				f, err := os.OpenFile(
 					fpath,
-					os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
-					hdr.FileInfo().Mode(),
+					os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW,
+					mode,
 				)
 				if err != nil {
-					return util.Errorf("error creating %s: %s", fpath, err)
+					return extractErrorf("error creating %s: %s", fpath, err)
 				}
 				// Released at end of "case" statement
 				defer func() {
-					if closeErr := f.Close(); innerErr == nil {
-						innerErr = closeErr
+					if closeErr := f.Close(); innerErr == nil && closeErr != nil {
+						innerErr = ExtractError{closeErr}
 					}
 				}()
 
 				err = f.Chown(uid, gid)
 				if err != nil {
-					return util.Errorf("error setting file ownership of %s: %s", fpath, err)
+					return extractErrorf("error setting file ownership of %s: %s", fpath, err)
 				}
 
-				_, err = io.Copy(f, tr)
+				// read one byte more than the remaining budget to detect going over it
+				written, err := io.Copy(f, io.LimitReader(tr, limits.MaxBytes-extracted+1))
+				extracted += written
 				if err != nil {
-					return util.Errorf("error extracting to %s: %s", fpath, err)
+					return extractErrorf("error extracting to %s: %s", fpath, err)
+				}
+				if extracted > limits.MaxBytes {
+					return LimitError{Limit: "bytes", Max: limits.MaxBytes}
 				}
 				return nil
 			}()
 			if err != nil {
 				return err
 			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			return ForbiddenEntryError{Name: hdr.Name, Reason: "device nodes and FIFOs are not allowed"}
 		default:
-			return util.Errorf("unhandled type flag %q (header %v)", hdr.Typeflag, hdr)
+			return ForbiddenEntryError{Name: hdr.Name, Reason: fmt.Sprintf("unhandled type flag %q", hdr.Typeflag)}
+		}
+	}
+
+	// Each link target was checked on its own, but a chain of links can still resolve
+	// outside of the destination, so check where the links actually lead.
+	realDest, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return extractErrorf("error resolving %s: %s", dest, err)
+	}
+	for _, link := range symlinks {
+		resolved, err := filepath.EvalSymlinks(link)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return extractErrorf("error resolving link %s: %s", link, err)
+		}
+		if !within(realDest, resolved) {
+			target, _ := os.Readlink(link)
+			name, _ := filepath.Rel(dest, link)
+			return UnsafeLinkError{Name: name, Target: target}
+		}
+	}
+	return nil
+}
+
+// within returns true if path is dest or is inside of it. Both paths must be clean.
+func within(dest, path string) bool {
+	rel, err := filepath.Rel(dest, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkNoSymlinks returns an UnsafePathError if path, or any directory between dest and
+// path, is a symlink.
+func checkNoSymlinks(dest, path string) error {
+	rel, err := filepath.Rel(dest, path)
+	if err != nil || rel == "." {
+		return nil
+	}
+	current := dest
+	for _, component := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return extractErrorf("error checking %s: %s", current, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			name, _ := filepath.Rel(dest, path)
+			return UnsafePathError{Name: name}
 		}
 	}
 	return nil
@@ -0,0 +1,159 @@
+package gzip
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+// entry is a tar header, and the contents of regular files.
+type entry struct {
+	hdr      *tar.Header
+	contents string
+}
+
+func tarGz(t *testing.T, entries ...entry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		e.hdr.Size = int64(len(e.contents))
+		if e.hdr.Mode == 0 {
+			e.hdr.Mode = 0644
+		}
+		err := tw.WriteHeader(e.hdr)
+		Assert(t).IsNil(err, "test setup: could not write tar header")
+		_, err = tw.Write([]byte(e.contents))
+		Assert(t).IsNil(err, "test setup: could not write tar contents")
+	}
+	Assert(t).IsNil(tw.Close(), "test setup: could not close tar")
+	Assert(t).IsNil(gz.Close(), "test setup: could not close gzip")
+	return buf
+}
+
+func file(name, contents string) entry {
+	return entry{&tar.Header{Name: name, Typeflag: tar.TypeReg}, contents}
+}
+
+func symlink(name, target string) entry {
+	return entry{&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}, ""}
+}
+
+func header(hdr *tar.Header) entry {
+	return entry{hdr, ""}
+}
+
+func extract(t *testing.T, limits Limits, entries ...entry) (string, error) {
+	dest, err := ioutil.TempDir("", "extract")
+	Assert(t).IsNil(err, "test setup: could not create temp dir")
+	return dest, ExtractTarGzWithLimits("", tarGz(t, entries...), filepath.Join(dest, "root"), limits)
+}
+
+func TestExtractTarGz(t *testing.T) {
+	dest, err := extract(t, DefaultLimits,
+		header(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}),
+		header(&tar.Header{Name: "shared/", Typeflag: tar.TypeDir, Mode: 02775}),
+		file("bin/launch", "#!/bin/sh"),
+		symlink("bin/start", "launch"),
+		header(&tar.Header{Name: "bin/run", Typeflag: tar.TypeLink, Linkname: "bin/launch"}),
+	)
+	defer os.RemoveAll(dest)
+	Assert(t).IsNil(err, "should have extracted the archive")
+
+	for _, name := range []string{"launch", "start", "run"} {
+		contents, err := ioutil.ReadFile(filepath.Join(dest, "root", "bin", name))
+		Assert(t).IsNil(err, "should have extracted "+name)
+		Assert(t).AreEqual(string(contents), "#!/bin/sh", "wrong contents for "+name)
+	}
+}
+
+func TestExtractTarGzRejectsUnsafeEntries(t *testing.T) {
+	cases := []struct {
+		desc    string
+		entries []entry
+		check   func(error) bool
+	}{
+		{
+			desc:    "path traversal",
+			entries: []entry{file("../escaped", "x")},
+			check:   func(err error) bool { _, ok := err.(UnsafePathError); return ok },
+		},
+		{
+			desc:    "absolute symlink",
+			entries: []entry{symlink("etc", "/etc")},
+			check:   func(err error) bool { _, ok := err.(UnsafeLinkError); return ok },
+		},
+		{
+			desc:    "relative symlink out of the destination",
+			entries: []entry{symlink("up", "../..")},
+			check:   func(err error) bool { _, ok := err.(UnsafeLinkError); return ok },
+		},
+		{
+			desc:    "symlink chain out of the destination",
+			entries: []entry{symlink("up", "here/.."), symlink("here", ".")},
+			check:   func(err error) bool { _, ok := err.(UnsafeLinkError); return ok },
+		},
+		{
+			desc:    "write through a symlink",
+			entries: []entry{symlink("dir", "."), file("dir/escaped", "x")},
+			check:   func(err error) bool { _, ok := err.(UnsafePathError); return ok },
+		},
+		{
+			desc:    "hardlink out of the destination",
+			entries: []entry{header(&tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"})},
+			check:   func(err error) bool { _, ok := err.(UnsafeLinkError); return ok },
+		},
+		{
+			desc:    "setuid file",
+			entries: []entry{header(&tar.Header{Name: "su", Typeflag: tar.TypeReg, Mode: 04755})},
+			check:   func(err error) bool { _, ok := err.(ForbiddenEntryError); return ok },
+		},
+		{
+			desc:    "setgid file",
+			entries: []entry{header(&tar.Header{Name: "wall", Typeflag: tar.TypeReg, Mode: 02755})},
+			check:   func(err error) bool { _, ok := err.(ForbiddenEntryError); return ok },
+		},
+		{
+			desc:    "setuid directory",
+			entries: []entry{header(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 04755})},
+			check:   func(err error) bool { _, ok := err.(ForbiddenEntryError); return ok },
+		},
+		{
+			desc:    "device node",
+			entries: []entry{header(&tar.Header{Name: "sda", Typeflag: tar.TypeBlock, Devmajor: 8})},
+			check:   func(err error) bool { _, ok := err.(ForbiddenEntryError); return ok },
+		},
+	}
+
+	for _, c := range cases {
+		dest, err := extract(t, DefaultLimits, c.entries...)
+		Assert(t).IsTrue(c.check(err), c.desc+": wrong error")
+		_, statErr := os.Lstat(filepath.Join(dest, "escaped"))
+		Assert(t).IsTrue(os.IsNotExist(statErr), c.desc+": should not have written outside of the destination")
+		os.RemoveAll(dest)
+	}
+}
+
+func TestExtractTarGzLimits(t *testing.T) {
+	dest, err := extract(t, Limits{MaxBytes: 10, MaxEntries: 10}, file("a", "123456"), file("b", "123456"))
+	defer os.RemoveAll(dest)
+	limitErr, ok := err.(LimitError)
+	Assert(t).IsTrue(ok, "should have exceeded the size limit")
+	Assert(t).AreEqual(limitErr.Limit, "bytes", "wrong limit exceeded")
+
+	dest, err = extract(t, Limits{MaxBytes: 10, MaxEntries: 1}, file("a", "1"), file("b", "1"))
+	defer os.RemoveAll(dest)
+	limitErr, ok = err.(LimitError)
+	Assert(t).IsTrue(ok, "should have exceeded the entry limit")
+	Assert(t).AreEqual(limitErr.Limit, "entries", "wrong limit exceeded")
+
+	dest, err = extract(t, Limits{MaxBytes: 12, MaxEntries: 2}, file("a", "123456"), file("b", "123456"))
+	defer os.RemoveAll(dest)
+	Assert(t).IsNil(err, "archive at exactly the limits should be extracted")
+}
@@ -3,17 +3,18 @@ package hoist
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/square/p2/pkg/archive"
 	"github.com/square/p2/pkg/artifact"
 	"github.com/square/p2/pkg/cgroups"
-	"github.com/square/p2/pkg/gzip"
+	"github.com/square/p2/pkg/digest"
 	"github.com/square/p2/pkg/launch"
 	"github.com/square/p2/pkg/p2exec"
 	"github.com/square/p2/pkg/runit"
@@ -36,6 +37,13 @@ type Launchable struct {
 	CgroupConfigName string              // The string in PLATFORM_CONFIG to pass to p2-exec
 	RestartTimeout   time.Duration       // How long to wait when restarting the services in this launchable.
 	RestartPolicy    runit.RestartPolicy // Dictates whether the launchable should be automatically restarted upon exit.
+	StopSignal       string              // The signal that stops the launchable's services. TERM if empty.
+	GracefulTimeout  time.Duration       // How long the services may take to exit when stopped before they are killed. RestartTimeout if zero.
+	PreStop          []string            // A command to run before the services are stopped, such as one that drains connections.
+	PreStopTimeout   time.Duration       // How long PreStop may run before it is killed.
+	ArtifactSHA256   string              // If set, the artifact is verified against this hash before it is extracted.
+	Mirrors          []string            // Locations to download the artifact from if Location fails, in order. Only used if ArtifactSHA256 is set.
+	ContentAddressed bool                // If set, the version is the artifact's SHA256 rather than its file name.
 }
 
 // LaunchAdapter adapts a hoist.Launchable to the launch.Launchable interface.
@@ -59,6 +67,10 @@ func (hl *Launchable) If() launch.Launchable {
 }
 
 func (hl *Launchable) Halt(serviceBuilder *runit.ServiceBuilder, sv runit.SV) error {
+	// a failed pre-stop command must not keep the launchable running, so it is
+	// only reported once the launchable has stopped
+	preStopErr := hl.preStop()
+
 	// the error return from os/exec.Run is almost always meaningless
 	// ("exit status 1")
 	// since the output is more useful to the user, that's what we'll preserve
@@ -78,9 +90,59 @@ func (hl *Launchable) Halt(serviceBuilder *runit.ServiceBuilder, sv runit.SV) er
 		return err
 	}
 
+	if preStopErr != nil {
+		return launch.PreStopError{preStopErr}
+	}
 	return nil
 }
 
+// preStop runs the launchable's pre-stop command, if it has one, from the install dir.
+func (hl *Launchable) preStop() error {
+	if len(hl.PreStop) == 0 {
+		return nil
+	}
+	timeout := hl.PreStopTimeout
+	if timeout <= 0 {
+		timeout = launch.DefaultPreStopTimeout
+	}
+	cgroupName := hl.cgroupName()
+	if hl.CgroupConfigName == "" {
+		cgroupName = ""
+	}
+	p2ExecArgs := p2exec.P2ExecArgs{
+		Command:          hl.PreStop,
+		User:             hl.RunAs,
+		EnvDirs:          []string{hl.PodEnvDir, hl.EnvDir()},
+		NoLimits:         hl.ExecNoLimit,
+		CgroupConfigName: hl.CgroupConfigName,
+		CgroupName:       cgroupName,
+		WorkDir:          hl.InstallDir(),
+	}
+	cmd := exec.Command(hl.P2Exec, p2ExecArgs.CommandLine()...)
+	out, err := launch.RunWithTimeout(cmd, timeout)
+	if err != nil {
+		return util.Errorf("Pre-stop command of %s failed: %s, output: %s", hl.Id, err, out)
+	}
+	return nil
+}
+
+// cgroupName is the name of the cgroup that the launchable's processes run in. It is
+// nested under the pod's cgroup if the pod has one.
+func (hl *Launchable) cgroupName() string {
+	if hl.CgroupConfig.Name != "" {
+		return hl.CgroupConfig.Name
+	}
+	return hl.Id
+}
+
+// stopTimeout is how long the launchable's services may take to exit when stopped.
+func (hl *Launchable) stopTimeout() time.Duration {
+	if hl.GracefulTimeout > 0 {
+		return hl.GracefulTimeout
+	}
+	return hl.RestartTimeout
+}
+
 func (hl *Launchable) Launch(serviceBuilder *runit.ServiceBuilder, sv runit.SV) error {
 	err := hl.start(serviceBuilder, sv)
 	if err != nil {
@@ -136,7 +198,7 @@ func (hl *Launchable) InvokeBinScript(script string) (string, error) {
 		return "", err
 	}
 
-	cgroupName := hl.Id
+	cgroupName := hl.cgroupName()
 	if hl.CgroupConfigName == "" {
 		cgroupName = ""
 	}
@@ -167,7 +229,7 @@ func (hl *Launchable) stop(serviceBuilder *runit.ServiceBuilder, sv runit.SV) er
 	}
 
 	for _, executable := range executables {
-		_, err := sv.Stop(&executable.Service, hl.RestartTimeout)
+		_, err := sv.Stop(&executable.Service, hl.stopTimeout())
 		if err != nil {
 			// TODO: FAILURE SCENARIO (what should we do here?)
 			// 1) does `sv stop` ever exit nonzero?
@@ -237,7 +299,7 @@ func (hl *Launchable) Executables(
 			EnvDirs:          []string{hl.PodEnvDir, hl.EnvDir()},
 			NoLimits:         hl.ExecNoLimit,
 			CgroupConfigName: hl.CgroupConfigName,
-			CgroupName:       hl.Id,
+			CgroupName:       hl.cgroupName(),
 		}
 		execCmd := append([]string{hl.P2Exec}, p2ExecArgs.CommandLine()...)
 
@@ -246,7 +308,8 @@ func (hl *Launchable) Executables(
 				Path: filepath.Join(serviceBuilder.RunitRoot, serviceName),
 				Name: serviceName,
 			},
-			Exec: execCmd,
+			Exec:       execCmd,
+			StopSignal: hl.StopSignal,
 		})
 	}
 	return executables, nil
@@ -271,12 +334,8 @@ func (hl *Launchable) Install() error {
 	}
 	defer os.Remove(artifactFile.Name())
 	defer artifactFile.Close()
-	remoteData, err := hl.Fetcher.Open(hl.Location)
-	if err != nil {
-		return err
-	}
-	defer remoteData.Close()
-	_, err = io.Copy(artifactFile, remoteData)
+	// verify the artifact before anything is extracted into the install dir
+	_, err = digest.FetchArtifact(artifactFile, hl.Fetcher, hl.Location, hl.Mirrors, hl.ArtifactSHA256)
 	if err != nil {
 		return err
 	}
@@ -285,7 +344,7 @@ func (hl *Launchable) Install() error {
 		return err
 	}
 
-	err = gzip.ExtractTarGz(hl.RunAs, artifactFile, hl.InstallDir())
+	err = archive.Extract(hl.RunAs, artifactFile, hl.Location, hl.InstallDir())
 	if err != nil {
 		os.RemoveAll(hl.InstallDir())
 		return util.Errorf("extracting %s: %s", hl.Version(), err)
@@ -293,11 +352,15 @@ func (hl *Launchable) Install() error {
 	return err
 }
 
-// The version of the artifact is currently derived from the location, using
-// the naming scheme <the-app>_<unique-version-string>.tar.gz
+// The version of a content-addressed artifact is its SHA256. Otherwise the version
+// is derived from the location, using the naming scheme
+// <the-app>_<unique-version-string>.<archive extension>, such as
+// <the-app>_<unique-version-string>.tar.gz
 func (hl *Launchable) Version() string {
-	fileName := filepath.Base(hl.Location)
-	return fileName[:len(fileName)-len(".tar.gz")]
+	if hl.ContentAddressed {
+		return "sha256-" + strings.ToLower(hl.ArtifactSHA256)
+	}
+	return archive.TrimExtension(filepath.Base(hl.Location))
 }
 
 func (*Launchable) Type() string {
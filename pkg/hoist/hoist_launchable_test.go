@@ -1,12 +1,16 @@
 package hoist
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
 	"github.com/square/p2/pkg/launch"
@@ -56,6 +60,64 @@ func TestInstall(t *testing.T) {
 	}
 }
 
+func TestInstallRejectsArtifactSHAMismatch(t *testing.T) {
+	testContext := util.From(runtime.Caller(0))
+	currentUser, err := user.Current()
+	Assert(t).IsNil(err, "test setup: couldn't get current user")
+
+	launchableHome, err := ioutil.TempDir("", "launchable_home")
+	defer os.RemoveAll(launchableHome)
+
+	launchable := &Launchable{
+		Location:       testContext.ExpandPath("hoisted-hello_def456.tar.gz"),
+		Id:             "hello",
+		RunAs:          currentUser.Username,
+		PodEnvDir:      launchableHome,
+		Fetcher:        uri.NewLoggedFetcher(nil),
+		RootDir:        launchableHome,
+		ArtifactSHA256: strings.Repeat("0", 64),
+	}
+
+	err = launchable.Install()
+	Assert(t).IsNotNil(err, "install should have failed when the artifact SHA did not match")
+	_, err = os.Stat(launchable.InstallDir())
+	Assert(t).IsTrue(os.IsNotExist(err), "a mismatched artifact should not have been extracted")
+}
+
+func TestInstallFallsBackToMirrors(t *testing.T) {
+	testContext := util.From(runtime.Caller(0))
+	currentUser, err := user.Current()
+	Assert(t).IsNil(err, "test setup: couldn't get current user")
+
+	launchableHome, err := ioutil.TempDir("", "launchable_home")
+	defer os.RemoveAll(launchableHome)
+	artifact, err := ioutil.ReadFile(testContext.ExpandPath("hoisted-hello_def456.tar.gz"))
+	Assert(t).IsNil(err, "test setup: couldn't read artifact")
+	sum := sha256.Sum256(artifact)
+
+	launchable := &Launchable{
+		Location: testContext.ExpandPath("missing/hoisted-hello_def456.tar.gz"),
+		Mirrors: []string{
+			// serves a different artifact, so it must be skipped
+			testContext.ExpandPath("hoist_launchable_test.go"),
+			testContext.ExpandPath("hoisted-hello_def456.tar.gz"),
+		},
+		Id:        "hello",
+		RunAs:     currentUser.Username,
+		PodEnvDir: launchableHome,
+		Fetcher:   uri.NewLoggedFetcher(nil),
+		RootDir:   launchableHome,
+	}
+
+	err = launchable.Install()
+	Assert(t).IsNotNil(err, "mirrors should not be used without an artifact SHA")
+
+	launchable.ArtifactSHA256 = hex.EncodeToString(sum[:])
+	err = launchable.Install()
+	Assert(t).IsNil(err, "install should have fallen back to the matching mirror")
+	Assert(t).IsTrue(launchable.Installed(), "the artifact should have been extracted")
+}
+
 func TestInstallDir(t *testing.T) {
 	tempDir := os.TempDir()
 	testLocation := "http://someserver/test_launchable_abc123.tar.gz"
@@ -283,6 +345,26 @@ func TestHaltWithPassingDisable(t *testing.T) {
 	Assert(t).IsNil(os.Remove(hl.LastDir()), "expected halt to create last symlink")
 }
 
+func TestHaltRunsPreStop(t *testing.T) {
+	hl, sb := FakeHoistLaunchableForDir("successful_scripts_test_hoist_launchable")
+	defer CleanupFakeLaunchable(hl, sb)
+	defer os.Remove(hl.LastDir())
+
+	drained := path.Join(hl.PodEnvDir, "drained")
+	hl.PreStop = []string{"touch", drained}
+	err := hl.Halt(sb, runit.FakeSV())
+	Assert(t).IsNil(err, "Expected halt to succeed")
+	_, err = os.Stat(drained)
+	Assert(t).IsNil(err, "Expected the pre-stop command to have run")
+
+	hl.PreStop = []string{"sleep", "5"}
+	hl.PreStopTimeout = 100 * time.Millisecond
+	err = hl.Halt(sb, runit.FakeSV())
+	Assert(t).IsNotNil(err, "Expected a pre-stop timeout to be reported")
+	_, ok := err.(launch.PreStopError)
+	Assert(t).IsTrue(ok, "Expected pre-stop error to be returned")
+}
+
 func TestLaunchWithFailingEnable(t *testing.T) {
 	hl, sb := FakeHoistLaunchableForDir("failing_scripts_test_hoist_launchable")
 	defer CleanupFakeLaunchable(hl, sb)
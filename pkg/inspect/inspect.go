@@ -53,7 +53,7 @@ func AddKVPToMap(result kp.ManifestResult, source int, filterNode, filterPod str
 		}
 		old.IntentManifestSHA = manifestSHA
 		for _, launchable := range result.Manifest.GetLaunchableStanzas() {
-			old.IntentLocations = append(old.IntentLocations, launchable.Location)
+			old.IntentLocations = append(old.IntentLocations, launchable.ArtifactName())
 		}
 		sort.Strings(old.IntentLocations)
 	case REALITY_SOURCE:
@@ -62,7 +62,7 @@ func AddKVPToMap(result kp.ManifestResult, source int, filterNode, filterPod str
 		}
 		old.RealityManifestSHA = manifestSHA
 		for _, launchable := range result.Manifest.GetLaunchableStanzas() {
-			old.RealityLocations = append(old.RealityLocations, launchable.Location)
+			old.RealityLocations = append(old.RealityLocations, launchable.ArtifactName())
 		}
 		sort.Strings(old.RealityLocations)
 	}
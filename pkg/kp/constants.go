@@ -5,12 +5,20 @@ import (
 )
 
 const (
-	INTENT_TREE  string = "intent"
-	REALITY_TREE string = "reality"
-	HOOK_TREE    string = "hooks"
-	LOCK_TREE    string = "lock"
-	RC_TREE      string = "replication_controllers"
-	ROLL_TREE    string = "rolls"
+	INTENT_TREE    string = "intent"
+	REALITY_TREE   string = "reality"
+	HOOK_TREE      string = "hooks"
+	LOCK_TREE      string = "lock"
+	RC_TREE        string = "replication_controllers"
+	ROLL_TREE      string = "rolls"
+	EVENT_TREE     string = "events"
+	OVERRIDE_TREE  string = "intent_override"
+	BLOCKLIST_TREE string = "manifest_blocklist"
+	// Manifests under prestage/<node>/<pod> are fetched and verified by the node's
+	// preparer without being launched. It reports the outcome under
+	// prestage_status/<node>/<pod>.
+	PRESTAGE_TREE        string = "prestage"
+	PRESTAGE_STATUS_TREE string = "prestage_status"
 )
 
 func IntentPath(args ...string) string {
@@ -36,3 +44,23 @@ func RCPath(args ...string) string {
 func RollPath(args ...string) string {
 	return strings.Join(append([]string{ROLL_TREE}, args...), "/")
 }
+
+func EventPath(args ...string) string {
+	return strings.Join(append([]string{EVENT_TREE}, args...), "/")
+}
+
+func OverridePath(args ...string) string {
+	return strings.Join(append([]string{OVERRIDE_TREE}, args...), "/")
+}
+
+func BlocklistPath(args ...string) string {
+	return strings.Join(append([]string{BLOCKLIST_TREE}, args...), "/")
+}
+
+func PrestagePath(args ...string) string {
+	return strings.Join(append([]string{PRESTAGE_TREE}, args...), "/")
+}
+
+func PrestageStatusPath(args ...string) string {
+	return strings.Join(append([]string{PRESTAGE_STATUS_TREE}, args...), "/")
+}
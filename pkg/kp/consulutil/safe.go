@@ -29,7 +29,7 @@ type KVError struct {
 // Error implements the error and "pkg/util".CallsiteError interfaces.
 func (err KVError) Error() string {
 	cerr := ""
-	if *showConsulErrors {
+	if param.GetBool(showConsulErrors) {
 		cerr = fmt.Sprintf(": %s", err.UnsafeError)
 	}
 	return fmt.Sprintf("%s failed for path %s%s", err.Op, err.Key, cerr)
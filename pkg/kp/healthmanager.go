@@ -68,7 +68,7 @@ func (c consulStore) newSessionHealthManager(
 			Name:      fmt.Sprintf("health:%s:%d:%s", node, os.Getpid(), timeStr),
 			LockDelay: 1 * time.Nanosecond,
 			Behavior:  api.SessionBehaviorDelete,
-			TTL:       fmt.Sprintf("%ds", *SessionTTLSec),
+			TTL:       fmt.Sprintf("%ds", param.GetInt(SessionTTLSec)),
 		},
 		c.client,
 		sessionChan,
@@ -187,10 +187,10 @@ func processHealthUpdater(
 	var throttle <-chan time.Time // If set, writes are throttled
 
 	// Track and limit all writes to avoid crushing Consul
-	bucketRefreshRate := time.Minute / time.Duration(*HealthWritesPerMinute)
+	bucketRefreshRate := time.Minute / time.Duration(param.GetInt(HealthWritesPerMinute))
 	rateLimiter, err := limit.NewTokenBucket(
-		*HealthMaxBucketSize,
-		*HealthMaxBucketSize,
+		param.GetInt64(HealthMaxBucketSize),
+		param.GetInt64(HealthMaxBucketSize),
 		bucketRefreshRate,
 	)
 	if err != nil {
@@ -229,7 +229,7 @@ func processHealthUpdater(
 			if result.OK {
 				remoteHealth = result.Health
 				if result.Throttle && throttle == nil {
-					throttle = time.After(time.Duration(*HealthResumeLimit) * bucketRefreshRate)
+					throttle = time.After(time.Duration(param.GetInt64(HealthResumeLimit)) * bucketRefreshRate)
 					logger.NoFields().Warning("health is flapping; throttling updates")
 				}
 			}
@@ -354,7 +354,7 @@ func sendHealthUpdate(
 	if err := sender(); err != nil {
 		logger.WithError(err).Error("error writing health")
 		// Try not to overwhelm Consul
-		time.Sleep(time.Duration(*HealthRetryTimeSec) * time.Second)
+		time.Sleep(time.Duration(param.GetInt(HealthRetryTimeSec)) * time.Second)
 		w <- writeResult{nil, false, doThrottle}
 	} else {
 		w <- writeResult{health, true, doThrottle}
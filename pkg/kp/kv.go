@@ -40,6 +40,12 @@ type Store interface {
 	NewLock(name string, renewalCh <-chan time.Time) (Lock, chan error, error)
 	NewUnmanagedLock(session, name string) Lock
 	NewHealthManager(node string, logger logging.Logger) HealthManager
+	PutEvent(event Event) (time.Duration, error)
+	IntentOverridden(node string) (bool, error)
+	ManifestBlocked(sha string) (bool, string, error)
+	SetPrestageStatus(node, podID string, status PrestageStatus) error
+	PrestageStatus(node, podID string) (PrestageStatus, bool, error)
+	DeletePrestageStatus(node, podID string) error
 }
 
 // HealthManager manages a collection of health checks that share configuration and
@@ -93,6 +99,15 @@ func (r WatchResult) IsStale() bool {
 	return time.Now().After(expires)
 }
 
+// An Event describes a notable change made to a pod by the preparer.
+type Event struct {
+	Node    string    `json:"node"`
+	PodID   string    `json:"pod_id"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
 type consulStore struct {
 	client *api.Client
 }
@@ -306,6 +321,34 @@ func (c consulStore) WatchPods(keyPrefix string, quitChan <-chan struct{}, errCh
 	}
 }
 
+// PutEvent records something notable that happened to a pod on a node, such as
+// an automatic rollback. Events are stored under events/<node>/<pod>/ and are
+// never overwritten.
+func (c consulStore) PutEvent(event Event) (time.Duration, error) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	key := EventPath(event.Node, event.PodID, fmt.Sprintf("%d", event.Time.UnixNano()))
+	keyPair := &api.KVPair{
+		Key:   key,
+		Value: data,
+	}
+
+	writeMeta, err := c.client.KV().Put(keyPair, nil)
+	var retDur time.Duration
+	if writeMeta != nil {
+		retDur = writeMeta.RequestTime
+	}
+	if err != nil {
+		return retDur, consulutil.NewKVError("put", key, err)
+	}
+	return retDur, nil
+}
+
 // Ping confirms that the store's Consul agent can be reached and it has a
 // leader. If the return is nil, then the store should be ready to accept
 // requests.
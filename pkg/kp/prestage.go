@@ -0,0 +1,68 @@
+package kp
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/hashicorp/consul/api"
+	"github.com/square/p2/pkg/kp/consulutil"
+)
+
+// PrestageStatus is the outcome of pre-staging a manifest on a node, as reported by
+// the node's preparer.
+type PrestageStatus struct {
+	// The SHA of the manifest that was pre-staged.
+	SHA string `json:"sha"`
+	// True if the manifest's launchables were fetched and verified.
+	Ready bool `json:"ready"`
+	// Why the manifest could not be pre-staged, if it was not.
+	Error string `json:"error,omitempty"`
+	// When the node reported the outcome, by the node's clock.
+	Time time.Time `json:"time"`
+}
+
+// SetPrestageStatus records the outcome of pre-staging a pod on a node.
+func (c consulStore) SetPrestageStatus(node, podID string, status PrestageStatus) error {
+	if status.Time.IsZero() {
+		status.Time = time.Now()
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	key := PrestageStatusPath(node, podID)
+	_, err = c.client.KV().Put(&api.KVPair{Key: key, Value: data}, nil)
+	if err != nil {
+		return consulutil.NewKVError("put", key, err)
+	}
+	return nil
+}
+
+// PrestageStatus returns the outcome of pre-staging a pod on a node. The boolean is
+// false if the node has not reported one.
+func (c consulStore) PrestageStatus(node, podID string) (PrestageStatus, bool, error) {
+	key := PrestageStatusPath(node, podID)
+	kvPair, _, err := c.client.KV().Get(key, nil)
+	if err != nil {
+		return PrestageStatus{}, false, consulutil.NewKVError("get", key, err)
+	}
+	if kvPair == nil {
+		return PrestageStatus{}, false, nil
+	}
+	var status PrestageStatus
+	err = json.Unmarshal(kvPair.Value, &status)
+	if err != nil {
+		return PrestageStatus{}, false, err
+	}
+	return status, true, nil
+}
+
+// DeletePrestageStatus removes the outcome of pre-staging a pod on a node.
+func (c consulStore) DeletePrestageStatus(node, podID string) error {
+	key := PrestageStatusPath(node, podID)
+	_, err := c.client.KV().Delete(key, nil)
+	if err != nil {
+		return consulutil.NewKVError("delete", key, err)
+	}
+	return nil
+}
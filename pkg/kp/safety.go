@@ -0,0 +1,31 @@
+package kp
+
+import (
+	"github.com/square/p2/pkg/kp/consulutil"
+)
+
+// IntentOverridden returns true if an operator has set the override key for the
+// given node, allowing the preparer to act on intent changes that exceed its
+// safety limits.
+func (c consulStore) IntentOverridden(node string) (bool, error) {
+	key := OverridePath(node)
+	kvPair, _, err := c.client.KV().Get(key, nil)
+	if err != nil {
+		return false, consulutil.NewKVError("get", key, err)
+	}
+	return kvPair != nil, nil
+}
+
+// ManifestBlocked returns true if the manifest with the given SHA has been added to
+// the blocklist. The value of the blocklist key, if any, is returned as the reason.
+func (c consulStore) ManifestBlocked(sha string) (bool, string, error) {
+	key := BlocklistPath(sha)
+	kvPair, _, err := c.client.KV().Get(key, nil)
+	if err != nil {
+		return false, "", consulutil.NewKVError("get", key, err)
+	}
+	if kvPair == nil {
+		return false, "", nil
+	}
+	return true, string(kvPair.Value), nil
+}
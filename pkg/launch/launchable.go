@@ -28,6 +28,12 @@ type StopError struct{ Inner error }
 
 func (e StopError) Error() string { return e.Inner.Error() }
 
+// PreStopError is returned by Halt when the launchable's pre-stop command failed. The
+// launchable is still stopped.
+type PreStopError struct{ Inner error }
+
+func (e PreStopError) Error() string { return e.Inner.Error() }
+
 // Launchable describes a type of app that can be downloaded and launched.
 type Launchable interface {
 	// Type returns a text description of the type of launchable.
@@ -69,6 +75,7 @@ type Executable struct {
 	Service       runit.Service
 	Exec          []string
 	RestartPolicy runit.RestartPolicy
+	StopSignal    string // The signal that stops the service, TERM if empty
 }
 
 func (e Executable) WriteExecutor(writer io.Writer) error {
@@ -0,0 +1,38 @@
+package launch
+
+import (
+	"bytes"
+	"os/exec"
+	"time"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// DefaultPreStopTimeout is how long a pre-stop command may run if its launchable does
+// not set a timeout.
+const DefaultPreStopTimeout = 30 * time.Second
+
+// RunWithTimeout runs the command and returns its combined output. If the command has
+// not exited after the timeout it is killed and an error is returned.
+func RunWithTimeout(cmd *exec.Cmd, timeout time.Duration) (string, error) {
+	buffer := bytes.Buffer{}
+	cmd.Stdout = &buffer
+	cmd.Stderr = &buffer
+	err := cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+		return buffer.String(), err
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		<-done
+		return buffer.String(), util.Errorf("%s did not exit within %s", cmd.Args[0], timeout)
+	}
+}
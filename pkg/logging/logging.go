@@ -42,16 +42,22 @@ func (l *Logger) SetLogOut(out io.Writer) {
 }
 
 func (l *Logger) AddHook(outType OutType, dest string) error {
-	if outType == OUT_SOCKET {
-		socketHook := SocketHook{socketPath: dest}
-		l.Logger.Hooks.Add(socketHook)
-	} else {
-		return util.Errorf("Unsupported log output type: %s", outType)
+	hook, err := NewHook(outType, dest)
+	if err != nil {
+		return err
 	}
-
+	l.Logger.Hooks.Add(hook)
 	return nil
 }
 
+// NewHook creates a hook that sends log entries to the given destination.
+func NewHook(outType OutType, dest string) (logrus.Hook, error) {
+	if outType == OUT_SOCKET {
+		return SocketHook{socketPath: dest}, nil
+	}
+	return nil, util.Errorf("Unsupported log output type: %s", outType)
+}
+
 func (l *Logger) SubLogger(fields logrus.Fields) Logger {
 	return Logger{l.Logger, Merge(l.baseFields, fields)}
 }
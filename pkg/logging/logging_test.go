@@ -1,10 +1,12 @@
 package logging
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -155,3 +157,39 @@ func TestAddUnrecognizedHook(t *testing.T) {
 	err := logger.AddHook("unrecognized_type", "some_destination")
 	Assert(t).IsNotNil(err, "Expected an error for adding an unrecognized hook output type")
 }
+
+type countingHook struct {
+	fired *int
+}
+
+func (countingHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.InfoLevel, logrus.DebugLevel}
+}
+
+func (h countingHook) Fire(*logrus.Entry) error {
+	*h.fired++
+	return nil
+}
+
+func TestReloadableChangesLevelAndHooks(t *testing.T) {
+	logger := NewLogger(logrus.Fields{})
+	out := &bytes.Buffer{}
+	logger.SetLogOut(out)
+	oldFired, newFired := 0, 0
+	logger.Logger.Hooks.Add(countingHook{&oldFired})
+
+	reloadable := MakeReloadable(logger.Logger)
+	Assert(t).AreEqual(MakeReloadable(logger.Logger), reloadable, "a logger should only be made reloadable once")
+	logger.NoFields().Debugln("hidden")
+	logger.NoFields().Infoln("shown")
+	Assert(t).AreEqual(strings.Count(out.String(), "\n"), 1, "only the info entry should have been written")
+	Assert(t).AreEqual(oldFired, 1, "hooks should only fire for entries at the logger's level")
+
+	hooks := make(logrus.LevelHooks)
+	hooks.Add(countingHook{&newFired})
+	reloadable.Reload(logrus.DebugLevel, hooks)
+	logger.NoFields().Debugln("shown")
+	Assert(t).AreEqual(strings.Count(out.String(), "\n"), 2, "debug entries should be written after reloading")
+	Assert(t).AreEqual(oldFired, 1, "the old hooks should not fire after reloading")
+	Assert(t).AreEqual(newFired, 1, "the new hooks should fire after reloading")
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"sync"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+)
+
+// Reloadable lets the level and hooks of a logrus logger change while the logger is in
+// use. logrus reads a logger's Level and Hooks without locking, so they must not be
+// assigned once the logger is shared. Instead, a Reloadable is installed as the
+// logger's formatter and only hook, and drops entries and fires hooks according to the
+// level and hooks it was last given.
+type Reloadable struct {
+	formatter logrus.Formatter
+
+	mu    sync.RWMutex
+	level logrus.Level
+	hooks logrus.LevelHooks
+}
+
+// MakeReloadable installs a Reloadable in the logger, starting with the logger's
+// current level and hooks, and returns it. It must be called before the logger is
+// shared. If the logger is already reloadable, its Reloadable is returned.
+func MakeReloadable(logger *logrus.Logger) *Reloadable {
+	if r, ok := logger.Formatter.(*Reloadable); ok {
+		return r
+	}
+	r := &Reloadable{
+		formatter: logger.Formatter,
+		level:     logger.Level,
+		hooks:     logger.Hooks,
+	}
+	logger.Formatter = r
+	logger.Level = logrus.DebugLevel
+	logger.Hooks = make(logrus.LevelHooks)
+	logger.Hooks.Add(r)
+	return r
+}
+
+// Reload replaces the level and hooks of the logger.
+func (r *Reloadable) Reload(level logrus.Level, hooks logrus.LevelHooks) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.level = level
+	r.hooks = hooks
+}
+
+func (r *Reloadable) current() (logrus.Level, logrus.LevelHooks) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.level, r.hooks
+}
+
+func (r *Reloadable) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+		logrus.DebugLevel,
+	}
+}
+
+// Fire passes the entry on to the current hooks, unless it is below the current level.
+// The lock is not held while the hooks run, since they format the entry.
+func (r *Reloadable) Fire(entry *logrus.Entry) error {
+	level, hooks := r.current()
+	if entry.Level > level {
+		return nil
+	}
+	return hooks.Fire(entry.Level, entry)
+}
+
+// Format formats the entry with the logger's original formatter, or drops it if it is
+// below the current level.
+func (r *Reloadable) Format(entry *logrus.Entry) ([]byte, error) {
+	level, _ := r.current()
+	if entry.Level > level {
+		return nil, nil
+	}
+	return r.formatter.Format(entry)
+}
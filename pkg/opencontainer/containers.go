@@ -12,10 +12,12 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/square/p2/pkg/archive"
 	"github.com/square/p2/pkg/cgroups"
-	"github.com/square/p2/pkg/gzip"
+	"github.com/square/p2/pkg/digest"
 	"github.com/square/p2/pkg/launch"
 	"github.com/square/p2/pkg/p2exec"
 	"github.com/square/p2/pkg/runit"
@@ -37,14 +39,25 @@ var RuncPath = param.String("runc_path", "/usr/local/bin/runc")
 
 // Launchable represents an installation of a container.
 type Launchable struct {
-	Location       string              // A URL where we can download the artifact from.
-	ID_            string              // A unique identifier for this launchable, used when creating runit services
-	RunAs          string              // The user to assume when launching the executable
-	RootDir        string              // The root directory of the launchable, containing N:N>=1 installs.
-	P2Exec         string              // The path to p2-exec
-	RestartTimeout time.Duration       // How long to wait when restarting the services in this launchable.
-	RestartPolicy  runit.RestartPolicy // Dictates whether the container should be automatically restarted upon exit.
-	CgroupConfig   cgroups.Config      // Cgroup parameters to use with p2-exec
+	Location        string              // A URL where we can download the artifact from.
+	ID_             string              // A unique identifier for this launchable, used when creating runit services
+	RunAs           string              // The user to assume when launching the executable
+	RootDir         string              // The root directory of the launchable, containing N:N>=1 installs.
+	P2Exec          string              // The path to p2-exec
+	RestartTimeout  time.Duration       // How long to wait when restarting the services in this launchable.
+	RestartPolicy   runit.RestartPolicy // Dictates whether the container should be automatically restarted upon exit.
+	CgroupConfig    cgroups.Config      // Cgroup parameters, and the cgroup the container runs in
+	Volumes         map[string]string   // Host directories to bind mount, keyed by the name of the container's mount point
+	StopSignal      string              // The signal that stops the container. TERM if empty.
+	GracefulTimeout time.Duration       // How long the container may take to exit when stopped before it is killed. RestartTimeout if zero.
+	PreStop         []string            // A command to run on the host before the container is stopped.
+	PreStopTimeout  time.Duration       // How long PreStop may run before it is killed.
+	ArtifactSHA256  string              // If set, the artifact is verified against this hash before it is extracted.
+	ArtifactFetcher uri.Fetcher         // Downloads the artifact, uri.DefaultFetcher if nil.
+	Mirrors         []string            // Locations to download the artifact from if Location fails, in order. Only used if ArtifactSHA256 is set.
+
+	// If set, the version is the artifact's SHA256 rather than its file name.
+	ContentAddressed bool
 
 	spec *LinuxSpec // The container's "config.json"
 }
@@ -73,11 +86,15 @@ func (l *Launchable) ID() string {
 	return l.ID_
 }
 
-// The version of the artifact is currently derived from the location, using
-// the naming scheme <the-app>_<unique-version-string>.tar.gz
+// The version of a content-addressed artifact is its SHA256. Otherwise the version
+// is derived from the location, using the naming scheme
+// <the-app>_<unique-version-string>.<archive extension>, such as
+// <the-app>_<unique-version-string>.tar.gz
 func (hl *Launchable) Version() string {
-	fileName := filepath.Base(hl.Location)
-	return fileName[:len(fileName)-len(".tar.gz")]
+	if hl.ContentAddressed {
+		return "sha256-" + strings.ToLower(hl.ArtifactSHA256)
+	}
+	return archive.TrimExtension(filepath.Base(hl.Location))
 }
 
 func (*Launchable) Type() string {
@@ -86,6 +103,9 @@ func (*Launchable) Type() string {
 
 // Fetcher returns a uri.Fetcher that is capable of fetching the launcahble's files.
 func (l *Launchable) Fetcher() uri.Fetcher {
+	if l.ArtifactFetcher != nil {
+		return l.ArtifactFetcher
+	}
 	return uri.DefaultFetcher
 }
 
@@ -145,9 +165,10 @@ func (l *Launchable) Executables(serviceBuilder *runit.ServiceBuilder) ([]launch
 			p2exec.P2ExecArgs{
 				NoLimits: true,
 				WorkDir:  l.InstallDir(),
-				Command:  []string{*RuncPath, "start"},
+				Command:  []string{param.GetString(RuncPath), "start"},
 			}.CommandLine()...,
 		),
+		StopSignal: l.StopSignal,
 	}}, nil
 }
 
@@ -161,36 +182,84 @@ func (l *Launchable) Installed() bool {
 // Install ...
 func (l *Launchable) Install() (returnedError error) {
 	if l.Installed() {
-		return nil
+		// the volumes may have changed since the container was installed
+		return l.writeRuntimeSpec()
 	}
 
-	data, err := uri.DefaultFetcher.Open(l.Location)
+	// download to a temporary file, so that the artifact is verified before
+	// anything is extracted into the install dir
+	artifactFile, err := ioutil.TempFile("", filepath.Base(l.Location))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(artifactFile.Name())
+	defer artifactFile.Close()
+	_, err = digest.FetchArtifact(artifactFile, l.Fetcher(), l.Location, l.Mirrors, l.ArtifactSHA256)
+	if err != nil {
+		return err
+	}
+	_, err = artifactFile.Seek(0, os.SEEK_SET)
 	if err != nil {
 		return err
 	}
-	defer data.Close()
+
 	defer func() {
 		if returnedError != nil {
 			os.RemoveAll(l.InstallDir())
 		}
 	}()
-	err = gzip.ExtractTarGz("", data, l.InstallDir())
+	err = archive.Extract("", artifactFile, l.Location, l.InstallDir())
 	if err != nil {
 		return util.Errorf("extracting %s: %s", l.Version(), err)
 	}
 	if _, err = l.getSpec(); err != nil {
 		return err
 	}
+	return l.writeRuntimeSpec()
+}
 
-	// Construct the host-specific configuration... This is probably the wrong place for this
-	// code because the container cgroup settings depend on the manifest.
-	runSpecPath := filepath.Join(l.InstallDir(), RuntimeSpecFilename)
+// writeRuntimeSpec constructs the host-specific configuration... This is probably the
+// wrong place for this code because the container cgroup settings depend on the manifest.
+// Each volume is bind mounted to the mount point of the same name in the container's spec.
+// The container runs in the launchable's cgroup, which may be nested under its pod's.
+func (l *Launchable) writeRuntimeSpec() error {
 	runSpec := DefaultRuntimeSpec
+	if l.CgroupConfig.Name != "" {
+		runSpec.Linux.CgroupsPath = "/" + l.CgroupConfig.Name
+	}
+	runSpec.Mounts = make(map[string]Mount, len(DefaultRuntimeSpec.Mounts)+len(l.Volumes))
+	for name, mount := range DefaultRuntimeSpec.Mounts {
+		runSpec.Mounts[name] = mount
+	}
+	for name, dir := range l.Volumes {
+		if _, ok := runSpec.Mounts[name]; ok {
+			return util.Errorf("%s: volume %s conflicts with a mount that is always provided to containers", l.ID_, name)
+		}
+		runSpec.Mounts[name] = Mount{
+			Type:    "bind",
+			Source:  dir,
+			Options: []string{"rbind", "rw"},
+		}
+	}
 	runSpecData, err := json.Marshal(runSpec)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(runSpecPath, runSpecData, 0444)
+
+	// the spec is read-only, so replace it rather than rewriting it
+	tempFile, err := ioutil.TempFile(l.InstallDir(), RuntimeSpecFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+	if _, err = tempFile.Write(runSpecData); err != nil {
+		return err
+	}
+	if err = tempFile.Chmod(0444); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filepath.Join(l.InstallDir(), RuntimeSpecFilename))
 }
 
 // PostActive runs a Hoist-specific "post-activate" script in the launchable.
@@ -271,13 +340,17 @@ func (l *Launchable) stop(serviceBuilder *runit.ServiceBuilder, sv runit.SV) err
 	}
 
 	for _, executable := range executables {
-		_, err := sv.Stop(&executable.Service, l.RestartTimeout)
+		timeout := l.GracefulTimeout
+		if timeout <= 0 {
+			timeout = l.RestartTimeout
+		}
+		_, err := sv.Stop(&executable.Service, timeout)
 		if err != nil {
 			cmd := exec.Command(
 				l.P2Exec,
 				p2exec.P2ExecArgs{
 					WorkDir: l.InstallDir(),
-					Command: []string{*RuncPath, "kill", "SIGKILL"},
+					Command: []string{param.GetString(RuncPath), "kill", "SIGKILL"},
 				}.CommandLine()...,
 			)
 			err = cmd.Run()
@@ -291,6 +364,8 @@ func (l *Launchable) stop(serviceBuilder *runit.ServiceBuilder, sv runit.SV) err
 
 // Halt causes the launchable to halt execution if it is running.
 func (l *Launchable) Halt(serviceBuilder *runit.ServiceBuilder, sv runit.SV) error {
+	preStopErr := l.preStop()
+
 	// "disable" script not supported for containers
 	err := l.stop(serviceBuilder, sv)
 	if err != nil {
@@ -301,6 +376,35 @@ func (l *Launchable) Halt(serviceBuilder *runit.ServiceBuilder, sv runit.SV) err
 	if err != nil {
 		return err
 	}
+	if preStopErr != nil {
+		return launch.PreStopError{preStopErr}
+	}
+	return nil
+}
+
+// preStop runs the container's pre-stop command, if it has one. The command runs on the
+// host as the container's user, from the container's install dir.
+func (l *Launchable) preStop() error {
+	if len(l.PreStop) == 0 {
+		return nil
+	}
+	timeout := l.PreStopTimeout
+	if timeout <= 0 {
+		timeout = launch.DefaultPreStopTimeout
+	}
+	cmd := exec.Command(
+		l.P2Exec,
+		p2exec.P2ExecArgs{
+			User:     l.RunAs,
+			NoLimits: true,
+			WorkDir:  l.InstallDir(),
+			Command:  l.PreStop,
+		}.CommandLine()...,
+	)
+	out, err := launch.RunWithTimeout(cmd, timeout)
+	if err != nil {
+		return util.Errorf("%s: pre-stop command failed: %s, output: %s", l.ID_, err, out)
+	}
 	return nil
 }
 
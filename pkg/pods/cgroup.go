@@ -0,0 +1,60 @@
+package pods
+
+import (
+	"path"
+
+	"github.com/square/p2/pkg/cgroups"
+	"github.com/square/p2/pkg/util"
+)
+
+// findCgroups locates the cgroup subsystems of the host. A variable so that tests can
+// use a fake cgroupfs.
+var findCgroups = cgroups.Find
+
+// CgroupName is the name of the pod-level cgroup that the cgroups of the pod's
+// launchables are nested under, if the manifest sets pod-level limits.
+func (pod *Pod) CgroupName() string {
+	return pod.Id
+}
+
+// launchableCgroupName is the name of a launchable's cgroup, which is nested under the
+// pod's cgroup if the pod has one.
+func (pod *Pod) launchableCgroupName(manifest Manifest, launchableID string) string {
+	if !hasPodCgroup(manifest) {
+		return launchableID
+	}
+	return path.Join(pod.CgroupName(), launchableID)
+}
+
+// setupCgroup creates the pod's cgroup with the manifest's pod-level limits, so that it
+// exists before any launchable enters a cgroup nested under it. p2-exec also creates it
+// from the platform config, in case the cgroup hierarchy has been reset since.
+func (pod *Pod) setupCgroup(manifest Manifest) error {
+	if !hasPodCgroup(manifest) {
+		return nil
+	}
+	subsystems, err := findCgroups()
+	if err != nil {
+		return util.Errorf("Could not find cgroupfs mount point: %s", err)
+	}
+	config := manifest.GetCgroupConfig()
+	config.Name = pod.CgroupName()
+	err = subsystems.Write(config)
+	if _, ok := err.(cgroups.UnsupportedError); ok {
+		pod.logger.WithError(err).Warnln("Unsupported cgroup subsystem, the pod's limits are not enforced")
+		return nil
+	} else if err != nil {
+		return util.Errorf("Could not set cgroup parameters for pod %s: %s", manifest.ID(), err)
+	}
+	return nil
+}
+
+// removeCgroup removes the pod's cgroup and the launchable cgroups nested under it. The
+// pod's launchables must have been halted.
+func (pod *Pod) removeCgroup() error {
+	subsystems, err := findCgroups()
+	if err != nil {
+		return util.Errorf("Could not find cgroupfs mount point: %s", err)
+	}
+	return subsystems.Remove(pod.CgroupName())
+}
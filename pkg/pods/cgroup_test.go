@@ -0,0 +1,72 @@
+package pods
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/cgroups"
+	"github.com/square/p2/pkg/hoist"
+	"github.com/square/p2/pkg/opencontainer"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestPodCgroup(t *testing.T) {
+	cgroupRoot, err := ioutil.TempDir("", "cgroups")
+	Assert(t).IsNil(err, "could not create a fake cgroupfs")
+	defer os.RemoveAll(cgroupRoot)
+	findCgroups = func() (cgroups.Subsystems, error) {
+		return cgroups.Subsystems{CPU: cgroupRoot}, nil
+	}
+	defer func() { findCgroups = cgroups.Find }()
+
+	manifest, err := ManifestFromBytes([]byte(testPod() + "cgroup:\n  cpus: 8\n"))
+	Assert(t).IsNil(err, "should have read the manifest")
+	pod := NewPod(manifest.ID(), PodPath("/data/pods", manifest.ID()))
+
+	launchables, err := pod.Launchables(manifest)
+	Assert(t).IsNil(err, "should have gotten launchables")
+	launchable := launchables[0].(hoist.LaunchAdapter)
+	Assert(t).AreEqual(launchable.CgroupConfig.Name, "thepod/thepod__web", "launchable cgroup should be nested under the pod's")
+
+	var buf bytes.Buffer
+	err = manifest.WritePlatformConfig(&buf)
+	Assert(t).IsNil(err, "should have written the platform config")
+	platConf := make(map[string]map[string]cgroups.Config)
+	err = yaml.Unmarshal(buf.Bytes(), platConf)
+	Assert(t).IsNil(err, "platform config should be readable by p2-exec")
+	Assert(t).AreEqual(platConf["web"]["pod_cgroup"].CPUs, 8, "platform config should describe the pod cgroup")
+	Assert(t).AreEqual(platConf["web"]["cgroup"].CPUs, 4, "platform config should still describe the launchable cgroup")
+
+	err = pod.setupCgroup(manifest)
+	Assert(t).IsNil(err, "should have created the pod cgroup")
+	quota, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "thepod", "cpu.cfs_quota_us"))
+	Assert(t).IsNil(err, "should have set the pod's cpu limit")
+	Assert(t).AreEqual(strings.TrimSpace(string(quota)), "8000000", "wrong cpu quota")
+
+	unlimited, err := ManifestFromBytes([]byte(testPod()))
+	Assert(t).IsNil(err, "should have read the manifest")
+	launchables, err = pod.Launchables(unlimited)
+	Assert(t).IsNil(err, "should have gotten launchables")
+	launchable = launchables[0].(hoist.LaunchAdapter)
+	Assert(t).AreEqual(launchable.CgroupConfig.Name, "thepod__web", "launchable cgroup should not be nested without a pod cgroup")
+}
+
+func TestPodCgroupOpencontainer(t *testing.T) {
+	*ExperimentalOpencontainer = true
+	defer func() { *ExperimentalOpencontainer = false }()
+
+	manifest, err := ManifestFromBytes([]byte(strings.Replace(testPod(), "launchable_type: hoist", "launchable_type: opencontainer", 1) + "cgroup:\n  cpus: 8\n"))
+	Assert(t).IsNil(err, "should have read the manifest")
+	pod := NewPod(manifest.ID(), PodPath("/data/pods", manifest.ID()))
+
+	launchables, err := pod.Launchables(manifest)
+	Assert(t).IsNil(err, "should have gotten launchables")
+	launchable := launchables[0].(*opencontainer.Launchable)
+	Assert(t).AreEqual(launchable.CgroupConfig.Name, "thepod/thepod__web", "container cgroup should be nested under the pod's")
+}
@@ -0,0 +1,100 @@
+package pods
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+)
+
+// A ManifestChange is a single difference between two manifests. Path locates the
+// changed field in the manifest's YAML, such as "launchables.app.location" or
+// "config.db.host". Old is nil if the field was added and New is nil if it was
+// removed. When a whole launchable or mapping is added or removed, it is reported as
+// one change rather than a change to each of its fields.
+type ManifestChange struct {
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+func (c ManifestChange) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("+ %s: %s", c.Path, diffValue(c.New))
+	case c.New == nil:
+		return fmt.Sprintf("- %s: %s", c.Path, diffValue(c.Old))
+	default:
+		return fmt.Sprintf("~ %s: %s -> %s", c.Path, diffValue(c.Old), diffValue(c.New))
+	}
+}
+
+// DiffManifests compares two manifests semantically, by the fields they set rather
+// than by their text, so that formatting, key order and signatures are ignored.
+// Changes are returned in order of their paths.
+func DiffManifests(old, new Manifest) ([]ManifestChange, error) {
+	oldTree, err := manifestTree(old)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := manifestTree(new)
+	if err != nil {
+		return nil, err
+	}
+	var changes []ManifestChange
+	diffNodes("", oldTree, newTree, &changes)
+	return changes, nil
+}
+
+// manifestTree decodes the canonical form of a manifest generically.
+func manifestTree(m Manifest) (interface{}, error) {
+	canonical, err := m.GetBuilder().GetManifest().Marshal()
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	err = yaml.Unmarshal(canonical, &tree)
+	return tree, err
+}
+
+func diffNodes(path string, old, new interface{}, changes *[]ManifestChange) {
+	oldMap, oldIsMap := old.(map[interface{}]interface{})
+	newMap, newIsMap := new.(map[interface{}]interface{})
+	if !oldIsMap || !newIsMap {
+		if !reflect.DeepEqual(old, new) {
+			*changes = append(*changes, ManifestChange{path, old, new})
+		}
+		return
+	}
+
+	keys := make(map[string]interface{})
+	for key := range oldMap {
+		keys[fmt.Sprint(key)] = key
+	}
+	for key := range newMap {
+		keys[fmt.Sprint(key)] = key
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		childPath := name
+		if path != "" {
+			childPath = path + "." + name
+		}
+		key := keys[name]
+		diffNodes(childPath, oldMap[key], newMap[key], changes)
+	}
+}
+
+// diffValue renders a value from a manifest change on one line.
+func diffValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,43 @@
+package pods
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestDiffManifests(t *testing.T) {
+	old, err := ManifestFromBytes([]byte(testPod()))
+	Assert(t).IsNil(err, "should have parsed old manifest")
+
+	builder := old.GetBuilder()
+	stanzas := map[string]LaunchableStanza{}
+	for key, stanza := range old.GetLaunchableStanzas() {
+		stanza.CgroupConfig.CPUs = 8
+		stanzas[key] = stanza
+	}
+	stanzas["worker"] = LaunchableStanza{
+		LaunchableType: "hoist",
+		LaunchableId:   "worker",
+		Location:       "https://localhost/worker.tar.gz",
+	}
+	builder.SetLaunchables(stanzas)
+	builder.SetConfig(map[interface{}]interface{}{"ENVIRONMENT": "production", "DEBUG": true})
+	new := builder.GetManifest()
+
+	changes, err := DiffManifests(old, new)
+	Assert(t).IsNil(err, "should have diffed manifests")
+	Assert(t).AreEqual(len(changes), 4, "wrong number of changes")
+	Assert(t).AreEqual(changes[0].String(), "+ config.DEBUG: true", "wrong config addition")
+	Assert(t).AreEqual(changes[1].String(), `~ config.ENVIRONMENT: "staging" -> "production"`, "wrong config change")
+	Assert(t).AreEqual(changes[2].String(), "~ launchables.my-app.cgroup.cpus: 4 -> 8", "wrong cgroup change")
+	Assert(t).AreEqual(changes[3].Path, "launchables.worker", "added launchable should be one change")
+	Assert(t).IsTrue(changes[3].Old == nil, "added launchable should have no old value")
+
+	reformatted, err := ManifestFromBytes([]byte("# reordered\nstatus_port: 8000\n" + strings.Replace(testPod(), "status_port: 8000\n", "", 1)))
+	Assert(t).IsNil(err, "should have parsed reformatted manifest")
+	changes, err = DiffManifests(old, reformatted)
+	Assert(t).IsNil(err, "should have diffed manifests")
+	Assert(t).AreEqual(len(changes), 0, "formatting should not be a change")
+}
@@ -0,0 +1,132 @@
+package pods
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/util"
+)
+
+// Manifests can also be written as JSON objects with the same fields as the YAML form.
+// A JSON manifest is converted to YAML before it is decoded, so both forms of the same
+// manifest have the same SHA.
+
+// MarshalJSON returns the manifest as a JSON object. Parsing the result with
+// ManifestFromBytes gives a manifest with the same SHA. The signature of a signed
+// manifest is not included, use Marshal() to preserve it.
+func (manifest *manifest) MarshalJSON() ([]byte, error) {
+	canonical, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	err = yaml.Unmarshal(canonical, &tree)
+	if err != nil {
+		return nil, err
+	}
+	tree, err = jsonValue("", tree)
+	if err != nil {
+		return nil, util.Errorf("Could not convert manifest %s to JSON: %s", manifest.ID(), err)
+	}
+	return json.Marshal(tree)
+}
+
+var _ json.Marshaler = &manifest{}
+
+// looksLikeJSON returns true if the data holds a JSON object. YAML flow mappings also
+// start with "{", so the data must also parse as JSON.
+func looksLikeJSON(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return false
+	}
+	// nothing may follow the object
+	return decoder.Decode(&value) == io.EOF
+}
+
+// jsonToYAML converts a JSON manifest to the equivalent YAML.
+func jsonToYAML(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// keep integers exact, rather than decoding every number as a float64
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(yamlValue(tree))
+}
+
+// yamlValue converts a value decoded from JSON to the value yaml.v2 would have decoded.
+func yamlValue(node interface{}) interface{} {
+	switch value := node.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			converted[k] = yamlValue(v)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, v := range value {
+			converted[i] = yamlValue(v)
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+// jsonValue converts a value decoded from YAML to one that encoding/json can marshal.
+// Mappings with keys that are not strings cannot be represented in JSON without
+// changing the manifest's SHA, so they are rejected.
+func jsonValue(path string, node interface{}) (interface{}, error) {
+	switch value := node.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: key %v is not a string", yamlPath(path, fmt.Sprint(k)), k)
+			}
+			child, err := jsonValue(yamlPath(path, key), v)
+			if err != nil {
+				return nil, err
+			}
+			converted[key] = child
+		}
+		return converted, nil
+	case []interface{}:
+		converted := make([]interface{}, len(value))
+		for i, v := range value {
+			child, err := jsonValue(fmt.Sprintf("%s[%d]", path, i), v)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = child
+		}
+		return converted, nil
+	default:
+		return value, nil
+	}
+}
+
+func yamlPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
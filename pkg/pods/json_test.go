@@ -0,0 +1,56 @@
+package pods
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestJSONManifestHasSameSHA(t *testing.T) {
+	yamlManifest, err := ManifestFromBytes([]byte(testPod()))
+	Assert(t).IsNil(err, "should have read the YAML manifest")
+	jsonManifest, err := ManifestFromBytes([]byte(`{
+	"id": "thepod",
+	"status_port": 8000,
+	"config": {"ENVIRONMENT": "staging"},
+	"launchables": {
+		"my-app": {
+			"launchable_type": "hoist",
+			"launchable_id": "web",
+			"location": "https://localhost:4444/foo/bar/baz.tar.gz",
+			"cgroup": {"cpus": 4, "memory": 1073741824}
+		}
+	}
+}`))
+	Assert(t).IsNil(err, "should have read the JSON manifest")
+
+	yamlSHA, _ := yamlManifest.SHA()
+	jsonSHA, _ := jsonManifest.SHA()
+	Assert(t).AreEqual(jsonSHA, yamlSHA, "JSON and YAML forms of a manifest should have the same SHA")
+}
+
+func TestMarshalJSONRoundTrips(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(testPod() + `env:
+  COLOR: blue
+`))
+	Assert(t).IsNil(err, "should have read the manifest")
+	data, err := json.Marshal(manifest)
+	Assert(t).IsNil(err, "should have marshaled the manifest to JSON")
+
+	var object map[string]interface{}
+	err = json.Unmarshal(data, &object)
+	Assert(t).IsNil(err, "should have produced a JSON object")
+	Assert(t).AreEqual(object["id"], "thepod", "JSON object should contain the manifest's fields")
+
+	parsed, err := ManifestFromBytes(data)
+	Assert(t).IsNil(err, "should have read the JSON manifest back")
+	expected, _ := manifest.SHA()
+	actual, _ := parsed.SHA()
+	Assert(t).AreEqual(actual, expected, "SHA should survive a round trip through JSON")
+
+	builder := manifest.GetBuilder()
+	builder.SetConfig(map[interface{}]interface{}{1: "one"})
+	_, err = builder.GetManifest().MarshalJSON()
+	Assert(t).IsNotNil(err, "config with non-string keys cannot be represented in JSON")
+}
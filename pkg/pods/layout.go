@@ -0,0 +1,109 @@
+package pods
+
+import (
+	"path/filepath"
+	"strconv"
+)
+
+// Layout describes where the files of a pod are placed on disk when its manifest is
+// installed and launched.
+type Layout struct {
+	Home               string
+	CurrentManifest    string
+	ConfigPath         string
+	PlatformConfigPath string
+	EnvDir             string
+	// The variables written to EnvDir, including the ones p2 sets itself.
+	Env map[string]string
+	// The tmpfs directory the pod's secrets are written to, if it has any.
+	SecretsDir string
+	// The directories of the pod's volumes, keyed by volume name.
+	Volumes map[string]string
+	// The pod-level cgroup that the launchables' cgroups are nested under, if the
+	// pod has one.
+	Cgroup string
+	// The launchables of the pod, in launch order.
+	Launchables []LaunchableLayout
+}
+
+// LaunchableLayout describes where the files of one launchable are placed on disk.
+type LaunchableLayout struct {
+	Key        string
+	ID         string
+	Type       string
+	InstallDir string
+	EnvDir     string
+	// The variables written to EnvDir, including the ones p2 sets itself.
+	Env map[string]string
+	// The launchables that must be running before this one is started.
+	DependsOn []string
+}
+
+// Layout returns where the pod's files would be placed for the given manifest. The
+// file system is not touched.
+func (pod *Pod) Layout(manifest Manifest) (Layout, error) {
+	configFileName, err := manifest.ConfigFileName()
+	if err != nil {
+		return Layout{}, err
+	}
+	platConfigFileName, err := manifest.PlatformConfigFileName()
+	if err != nil {
+		return Layout{}, err
+	}
+	layout := Layout{
+		Home:               pod.Path(),
+		CurrentManifest:    pod.currentPodManifestPath(),
+		ConfigPath:         filepath.Join(pod.ConfigDir(), configFileName),
+		PlatformConfigPath: filepath.Join(pod.ConfigDir(), platConfigFileName),
+		EnvDir:             pod.EnvDir(),
+		Env:                map[string]string{},
+	}
+	for name, value := range manifest.GetEnv() {
+		layout.Env[name] = value
+	}
+	layout.Env["CONFIG_PATH"] = layout.ConfigPath
+	layout.Env["PLATFORM_CONFIG_PATH"] = layout.PlatformConfigPath
+	layout.Env["POD_HOME"] = pod.Path()
+	if len(manifest.GetSecrets()) > 0 {
+		layout.SecretsDir = pod.SecretsDir()
+		layout.Env["SECRETS_DIR"] = layout.SecretsDir
+	}
+	layout.Volumes = pod.volumeDirs(manifest)
+	if hasPodCgroup(manifest) {
+		layout.Cgroup = pod.CgroupName()
+	}
+	for name, volume := range manifest.GetVolumes() {
+		layout.Env[VolumeEnvVar(name)] = pod.VolumeDir(name)
+		if volume.Quota > 0 {
+			layout.Env[VolumeQuotaEnvVar(name)] = strconv.FormatUint(uint64(volume.Quota), 10)
+		}
+	}
+
+	stanzas := manifest.GetLaunchableStanzas()
+	order, err := launchableOrder(stanzas)
+	if err != nil {
+		return Layout{}, err
+	}
+	for _, key := range order {
+		stanza := stanzas[key]
+		launchable, err := pod.getLaunchable(stanza, manifest.RunAsUser(), manifest.GetRestartPolicy())
+		if err != nil {
+			return Layout{}, err
+		}
+		env := map[string]string{}
+		for name, value := range stanza.Env {
+			env[name] = value
+		}
+		env["LAUNCHABLE_ROOT"] = launchable.InstallDir()
+		layout.Launchables = append(layout.Launchables, LaunchableLayout{
+			Key:        key,
+			ID:         launchable.ID(),
+			Type:       launchable.Type(),
+			InstallDir: launchable.InstallDir(),
+			EnvDir:     launchable.EnvDir(),
+			Env:        env,
+			DependsOn:  stanza.DependsOn,
+		})
+	}
+	return layout, nil
+}
@@ -7,10 +7,12 @@ package pods
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/square/p2/Godeps/_workspace/src/golang.org/x/crypto/openpgp/clearsign"
 	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
@@ -18,16 +20,168 @@ import (
 	"github.com/square/p2/pkg/runit"
 	"github.com/square/p2/pkg/uri"
 	"github.com/square/p2/pkg/util"
+	"github.com/square/p2/pkg/util/size"
 )
 
 type LaunchableStanza struct {
-	LaunchableType          string         `yaml:"launchable_type"`
-	LaunchableId            string         `yaml:"launchable_id"`
-	Location                string         `yaml:"location"`
-	DigestLocation          string         `yaml:"digest_location,omitempty"`
-	DigestSignatureLocation string         `yaml:"digest_signature_location,omitempty"`
-	RestartTimeout          string         `yaml:"restart_timeout,omitempty"`
-	CgroupConfig            cgroups.Config `yaml:"cgroup,omitempty"`
+	LaunchableType          string            `yaml:"launchable_type"`
+	LaunchableId            string            `yaml:"launchable_id"`
+	Location                string            `yaml:"location,omitempty"`
+	DigestLocation          string            `yaml:"digest_location,omitempty"`
+	DigestSignatureLocation string            `yaml:"digest_signature_location,omitempty"`
+	RestartTimeout          string            `yaml:"restart_timeout,omitempty"`
+	CgroupConfig            cgroups.Config    `yaml:"cgroup,omitempty"`
+	Env                     map[string]string `yaml:"env,omitempty"`
+	// The keys of other launchables in the same pod that must be running before
+	// this one is started. This launchable is halted before them.
+	DependsOn []string `yaml:"depends_on,omitempty"`
+	// The signal that stops the launchable's processes, such as "INT" or "SIGQUIT".
+	// Defaults to TERM.
+	StopSignal string `yaml:"stop_signal,omitempty"`
+	// How long the launchable's processes may take to exit after the stop signal before
+	// they are killed, parseable by time.ParseDuration(). Defaults to the restart_timeout.
+	GracefulTimeout string `yaml:"graceful_timeout,omitempty"`
+	// A command that is run before the launchable is stopped.
+	PreStop PreStopCommand `yaml:"pre_stop,omitempty"`
+	// The hex encoded SHA256 of the artifact at Location. The artifact is checked as it
+	// is downloaded, and is not extracted if it does not match. Because it is part of the
+	// manifest, it is covered by the manifest's signature.
+	ArtifactSHA256 string `yaml:"artifact_sha256,omitempty"`
+	// Locations that the artifact is downloaded from, in order, if it cannot be
+	// downloaded from Location. Requires ArtifactSHA256, so that a mirror cannot serve a
+	// different artifact.
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	// Identifies the artifact by its digest, as "sha256:<hex encoded SHA256>", instead
+	// of by Location. The artifact is fetched from the preparer's artifact registry, and
+	// its install directory is named after the digest.
+	Artifact string `yaml:"artifact,omitempty"`
+}
+
+// ArtifactDigestPrefix starts the Artifact of a content-addressed launchable.
+const ArtifactDigestPrefix = "sha256:"
+
+// ArtifactDigest returns the hex encoded SHA256 that identifies a content-addressed
+// artifact, or "" if the artifact is identified by its Location.
+func (l LaunchableStanza) ArtifactDigest() string {
+	return strings.ToLower(strings.TrimPrefix(l.Artifact, ArtifactDigestPrefix))
+}
+
+// ArtifactLocation returns where the artifact is fetched from: Location, or the
+// artifact's path in the registry if it is content-addressed.
+func (l LaunchableStanza) ArtifactLocation(registry string) (string, error) {
+	if l.Artifact == "" {
+		return l.Location, nil
+	}
+	if registry == "" {
+		return "", util.Errorf("%s cannot be fetched because no artifact registry is configured", l.Artifact)
+	}
+	return uri.RegistryLocation(registry, l.ArtifactDigest()), nil
+}
+
+// ArtifactName returns the location or digest that identifies the artifact.
+func (l LaunchableStanza) ArtifactName() string {
+	if l.Artifact != "" {
+		return l.Artifact
+	}
+	return l.Location
+}
+
+// GetGracefulTimeout returns the parsed graceful timeout, or zero if there is none.
+func (l LaunchableStanza) GetGracefulTimeout() (time.Duration, error) {
+	if l.GracefulTimeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(l.GracefulTimeout)
+}
+
+// PreStopCommand is run before a launchable is stopped, for example to drain its
+// connections. It runs as the pod's user, from the launchable's install dir. The
+// launchable is stopped even if the command fails or times out.
+type PreStopCommand struct {
+	Command []string `yaml:"command,omitempty"`
+	// How long the command may run before it is killed, parseable by
+	// time.ParseDuration(). Defaults to 30s.
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// GetTimeout returns the parsed timeout, or zero if there is none.
+func (p PreStopCommand) GetTimeout() (time.Duration, error) {
+	if p.Timeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(p.Timeout)
+}
+
+// SecretRef refers to a secret value held by a secret provider configured on the host.
+// Only the reference is part of the manifest, so the value does not affect its SHA.
+type SecretRef struct {
+	// The name of the provider in the preparer's secret_providers configuration.
+	Provider string `yaml:"provider"`
+	// The key of the secret in the provider.
+	Key string `yaml:"key"`
+}
+
+// VolumeRetention is what happens to a volume when its pod is uninstalled.
+type VolumeRetention string
+
+const (
+	// The volume is left in place, so the pod finds its data again when it is
+	// reinstalled on the same host.
+	VolumeRetentionKeep VolumeRetention = "keep"
+	// The volume is removed along with the rest of the pod.
+	VolumeRetentionDelete VolumeRetention = "delete"
+)
+
+// Volume is a persistent data directory of a pod. Volumes are not replaced when the
+// pod is updated, and by default are kept when it is uninstalled.
+type Volume struct {
+	// The user that owns the directory. Defaults to the pod's run_as user.
+	Owner string `yaml:"owner,omitempty"`
+	// The permissions of the directory in octal, such as "0750". Defaults to 0750.
+	Mode string `yaml:"mode,omitempty"`
+	// How large the volume is expected to grow. This is a hint that is passed to the
+	// pod, it is not enforced.
+	Quota size.ByteCount `yaml:"quota,omitempty"`
+	// Either "keep" (the default) or "delete".
+	Retention VolumeRetention `yaml:"retention,omitempty"`
+}
+
+// GetMode returns the permissions of the volume's directory.
+func (v Volume) GetMode() (os.FileMode, error) {
+	if v.Mode == "" {
+		return 0750, nil
+	}
+	mode, err := strconv.ParseUint(v.Mode, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, util.Errorf("'%s' is not a valid octal file mode", v.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// GetRetention returns what happens to the volume when its pod is uninstalled.
+func (v Volume) GetRetention() VolumeRetention {
+	if v.Retention == "" {
+		return VolumeRetentionKeep
+	}
+	return v.Retention
+}
+
+// RollbackPolicy controls when the preparer gives up on a new version of a pod and
+// relaunches the version it replaced. A zero value disables automatic rollback.
+type RollbackPolicy struct {
+	// The number of consecutive failed launches after which the pod is rolled back.
+	MaxLaunchFailures int `yaml:"max_launch_failures,omitempty"`
+	// How long the pod may take to report a passing health check after launch,
+	// parseable by time.ParseDuration(). Requires a status_port.
+	HealthTimeout string `yaml:"health_timeout,omitempty"`
+}
+
+// GetHealthTimeout returns the parsed health timeout, or zero if there is none.
+func (r RollbackPolicy) GetHealthTimeout() (time.Duration, error) {
+	if r.HealthTimeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(r.HealthTimeout)
 }
 
 type ManifestBuilder interface {
@@ -38,6 +192,12 @@ type ManifestBuilder interface {
 	SetStatusPort(port int)
 	SetStatusHTTP(statusHTTP bool)
 	SetLaunchables(launchableStanzas map[string]LaunchableStanza)
+	SetRollbackPolicy(policy RollbackPolicy)
+	SetEnv(env map[string]string)
+	SetSchemaVersion(version int)
+	SetSecrets(secrets map[string]SecretRef)
+	SetVolumes(volumes map[string]Volume)
+	SetCgroupConfig(config cgroups.Config)
 }
 
 var _ ManifestBuilder = manifestBuilder{}
@@ -72,6 +232,13 @@ type Manifest interface {
 	Marshal() ([]byte, error)
 	SignatureData() (plaintext, signature []byte)
 	GetRestartPolicy() runit.RestartPolicy
+	GetRollbackPolicy() RollbackPolicy
+	GetEnv() map[string]string
+	GetSchemaVersion() int
+	GetSecrets() map[string]SecretRef
+	GetVolumes() map[string]Volume
+	GetCgroupConfig() cgroups.Config
+	MarshalJSON() ([]byte, error)
 
 	GetBuilder() ManifestBuilder
 }
@@ -80,6 +247,7 @@ type Manifest interface {
 var _ Manifest = &manifest{}
 
 type manifest struct {
+	SchemaVersion     int                         `yaml:"schema_version,omitempty"`
 	Id                string                      `yaml:"id"` // public for yaml marshaling access. Use ID() instead.
 	RunAs             string                      `yaml:"run_as,omitempty"`
 	LaunchableStanzas map[string]LaunchableStanza `yaml:"launchables"`
@@ -87,6 +255,11 @@ type manifest struct {
 	StatusPort        int                         `yaml:"status_port,omitempty"`
 	StatusHTTP        bool                        `yaml:"status_http,omitempty"`
 	RestartPolicy     runit.RestartPolicy         `yaml:"restart_policy,omitempty"`
+	Rollback          RollbackPolicy              `yaml:"rollback,omitempty"`
+	Env               map[string]string           `yaml:"env,omitempty"`
+	Secrets           map[string]SecretRef        `yaml:"secrets,omitempty"`
+	Volumes           map[string]Volume           `yaml:"volumes,omitempty"`
+	Cgroup            cgroups.Config              `yaml:"cgroup,omitempty"`
 
 	// Used to track the original bytes so that we don't reorder them when
 	// doing a yaml.Unmarshal and a yaml.Marshal in succession
@@ -218,10 +391,22 @@ func ManifestFromBytes(bytes []byte) (Manifest, error) {
 		// parse YAML from the message's plaintext instead
 		bytes = signed.Plaintext
 	}
+	if looksLikeJSON(bytes) {
+		converted, err := jsonToYAML(bytes)
+		if err != nil {
+			return nil, util.Errorf("Could not read JSON pod manifest: %s", err)
+		}
+		bytes = converted
+	}
 
 	if err := yaml.Unmarshal(bytes, manifest); err != nil {
 		return nil, util.Errorf("Could not read pod manifest: %s", err)
 	}
+	if manifest.SchemaVersion > 0 {
+		if problems := checkFields(bytes); len(problems) > 0 {
+			return nil, util.Errorf("invalid manifest: %s", problems)
+		}
+	}
 	if err := ValidManifest(manifest); err != nil {
 		return nil, util.Errorf("invalid manifest: %s", err)
 	}
@@ -270,9 +455,14 @@ func (manifest *manifest) WriteConfig(out io.Writer) error {
 func (manifest *manifest) WritePlatformConfig(out io.Writer) error {
 	platConf := make(map[string]interface{})
 	for _, stanza := range manifest.LaunchableStanzas {
-		platConf[stanza.LaunchableId] = map[string]interface{}{
+		launchableConf := map[string]interface{}{
 			"cgroup": stanza.CgroupConfig,
 		}
+		if hasPodCgroup(manifest) {
+			// the parent of the launchable's cgroup, shared with the other launchables
+			launchableConf["pod_cgroup"] = manifest.Cgroup
+		}
+		platConf[stanza.LaunchableId] = launchableConf
 	}
 
 	bytes, err := yaml.Marshal(platConf)
@@ -335,21 +525,61 @@ func (m manifest) GetRestartPolicy() runit.RestartPolicy {
 	return m.RestartPolicy
 }
 
-// ValidManifest checks the internal consistency of a manifest. Returns an error if the
-// data is inconsistent or "nil" otherwise.
-func ValidManifest(m Manifest) error {
-	if m.ID() == "" {
-		return fmt.Errorf("manifest must contain an 'id'")
-	}
-	for key, stanza := range m.GetLaunchableStanzas() {
-		switch {
-		case stanza.LaunchableType == "":
-			return fmt.Errorf("'%s': launchable must contain a 'launchable_type'", key)
-		case stanza.LaunchableId == "":
-			return fmt.Errorf("'%s': launchable must contain a 'launchable_id'", key)
-		case stanza.Location == "":
-			return fmt.Errorf("'%s': launchable must contain a 'location'", key)
-		}
-	}
-	return nil
+func (m manifest) GetRollbackPolicy() RollbackPolicy {
+	return m.Rollback
+}
+
+func (mb manifestBuilder) SetRollbackPolicy(policy RollbackPolicy) {
+	mb.manifest.Rollback = policy
+}
+
+func (m manifest) GetEnv() map[string]string {
+	return m.Env
+}
+
+func (mb manifestBuilder) SetEnv(env map[string]string) {
+	mb.manifest.Env = env
+}
+
+func (m manifest) GetSchemaVersion() int {
+	return m.SchemaVersion
+}
+
+func (mb manifestBuilder) SetSchemaVersion(version int) {
+	mb.manifest.SchemaVersion = version
+}
+
+// GetSecrets returns the secrets of the pod, keyed by the name of the file each is
+// written to.
+func (m manifest) GetSecrets() map[string]SecretRef {
+	return m.Secrets
+}
+
+func (mb manifestBuilder) SetSecrets(secrets map[string]SecretRef) {
+	mb.manifest.Secrets = secrets
+}
+
+// GetVolumes returns the persistent data directories of the pod, keyed by name.
+func (m manifest) GetVolumes() map[string]Volume {
+	return m.Volumes
+}
+
+func (mb manifestBuilder) SetVolumes(volumes map[string]Volume) {
+	mb.manifest.Volumes = volumes
+}
+
+// GetCgroupConfig returns the limits that the pod's launchables share. Each
+// launchable's own cgroup is nested under the pod's cgroup.
+func (m manifest) GetCgroupConfig() cgroups.Config {
+	return m.Cgroup
+}
+
+func (mb manifestBuilder) SetCgroupConfig(config cgroups.Config) {
+	mb.manifest.Cgroup = config
+}
+
+// hasPodCgroup returns true if the pod's launchables share a pod-level cgroup.
+func hasPodCgroup(m Manifest) bool {
+	config := m.GetCgroupConfig()
+	return config.CPUs != 0 || config.Memory != 0
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/square/p2/pkg/cgroups"
 	"github.com/square/p2/pkg/util/size"
@@ -223,3 +225,88 @@ config:
 	builtManifest := builder.GetManifest()
 	Assert(t).AreEqual(builtManifest.ID(), "thepod", "Expected manifest ID to be preserved when converted to ManifestBuilder and back")
 }
+
+func TestRollbackPolicy(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(testPod() + `rollback:
+  max_launch_failures: 3
+  health_timeout: 2m
+`))
+	Assert(t).IsNil(err, "should have parsed manifest with rollback policy")
+	policy := manifest.GetRollbackPolicy()
+	Assert(t).AreEqual(policy.MaxLaunchFailures, 3, "wrong max launch failures")
+	timeout, err := policy.GetHealthTimeout()
+	Assert(t).IsNil(err, "health timeout should parse")
+	Assert(t).AreEqual(timeout, 2*time.Minute, "wrong health timeout")
+
+	_, err = ManifestFromBytes([]byte(testPod() + "rollback:\n  health_timeout: soon\n"))
+	Assert(t).IsNotNil(err, "invalid health timeout should be rejected")
+
+	builder := NewManifestBuilder()
+	builder.SetID("thepod")
+	builder.SetRollbackPolicy(RollbackPolicy{HealthTimeout: "1m"})
+	err = ValidManifest(builder.GetManifest())
+	Assert(t).IsNotNil(err, "health timeout without a status port should be rejected")
+}
+
+func TestEnvValidation(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(testPod() + "env:\n  FOO: bar\n"))
+	Assert(t).IsNil(err, "valid env should be accepted")
+	Assert(t).AreEqual(manifest.GetEnv()["FOO"], "bar", "env should have been read")
+
+	withoutEnv, _ := ManifestFromBytes([]byte(testPod()))
+	withSHA, _ := manifest.SHA()
+	withoutSHA, _ := withoutEnv.SHA()
+	Assert(t).AreNotEqual(withSHA, withoutSHA, "env should count toward the manifest SHA")
+
+	_, err = ManifestFromBytes([]byte(testPod() + "env:\n  POD_HOME: /tmp\n"))
+	Assert(t).IsNotNil(err, "reserved pod env var should be rejected")
+	_, err = ManifestFromBytes([]byte(testPod() + "env:\n  not-valid: x\n"))
+	Assert(t).IsNotNil(err, "invalid env var name should be rejected")
+
+	builder := NewManifestBuilder()
+	builder.SetID("thepod")
+	builder.SetLaunchables(map[string]LaunchableStanza{
+		"app": {
+			LaunchableType: "hoist",
+			LaunchableId:   "app",
+			Location:       "https://localhost/app.tar.gz",
+			Env:            map[string]string{"LAUNCHABLE_ROOT": "/"},
+		},
+	})
+	Assert(t).IsNotNil(ValidManifest(builder.GetManifest()), "reserved launchable env var should be rejected")
+}
+
+func TestLaunchableDependencies(t *testing.T) {
+	stanza := func(deps ...string) LaunchableStanza {
+		return LaunchableStanza{
+			LaunchableType: "hoist",
+			LaunchableId:   "app",
+			Location:       "https://localhost/app.tar.gz",
+			DependsOn:      deps,
+		}
+	}
+
+	order, err := launchableOrder(map[string]LaunchableStanza{
+		"web":   stanza("db", "cache"),
+		"cache": stanza("db"),
+		"db":    stanza(),
+		"admin": stanza(),
+	})
+	Assert(t).IsNil(err, "acyclic dependencies should be ordered")
+	Assert(t).AreEqual(strings.Join(order, ","), "admin,db,cache,web", "wrong launch order")
+
+	builder := NewManifestBuilder()
+	builder.SetID("thepod")
+	builder.SetLaunchables(map[string]LaunchableStanza{
+		"a": stanza("b"),
+		"b": stanza("c"),
+		"c": stanza("a"),
+	})
+	Assert(t).IsNotNil(ValidManifest(builder.GetManifest()), "dependency cycle should be rejected")
+
+	builder.SetLaunchables(map[string]LaunchableStanza{"a": stanza("a")})
+	Assert(t).IsNotNil(ValidManifest(builder.GetManifest()), "self dependency should be rejected")
+
+	builder.SetLaunchables(map[string]LaunchableStanza{"a": stanza("missing")})
+	Assert(t).IsNotNil(ValidManifest(builder.GetManifest()), "unknown dependency should be rejected")
+}
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/square/p2/pkg/auth"
@@ -16,6 +18,7 @@ import (
 	"github.com/square/p2/pkg/logging"
 	"github.com/square/p2/pkg/opencontainer"
 	"github.com/square/p2/pkg/runit"
+	"github.com/square/p2/pkg/secrets"
 	"github.com/square/p2/pkg/uri"
 	"github.com/square/p2/pkg/user"
 	"github.com/square/p2/pkg/util"
@@ -37,6 +40,14 @@ const DEFAULT_PATH = "/data/pods"
 
 var DefaultP2Exec = "/usr/local/bin/p2-exec"
 
+// How often a launchable's services are checked while its dependents wait for it to
+// start. Variable so that tests can shorten it.
+var runningPollInterval = 1 * time.Second
+
+// DefaultStartTimeout is how long the dependents of a launchable wait for it to start,
+// unless the launchable sets a restart_timeout.
+const DefaultStartTimeout = 60 * time.Second
+
 func init() {
 	Log = logging.NewLogger(logrus.Fields{})
 }
@@ -53,17 +64,29 @@ type Pod struct {
 	ServiceBuilder *runit.ServiceBuilder
 	P2Exec         string
 	DefaultTimeout time.Duration // this is the default timeout for stopping and restarting services in this pod
+	StartTimeout   time.Duration // how long dependents wait for a launchable without a restart_timeout to start
+	// The providers used to fetch the values of the pod's secrets
+	SecretProviders secrets.Providers
+	// The fetcher used to download the artifacts of the pod's launchables
+	ArtifactFetcher uri.Fetcher
+	// The rewrites that give mirrors of the locations of verified artifacts and digests
+	MirrorRewrites []uri.Rewrite
+	// The base URL that content-addressed artifacts are fetched from
+	ArtifactRegistry string
 }
 
 func NewPod(id string, path string) *Pod {
 	return &Pod{
-		Id:             id,
-		path:           path,
-		logger:         Log.SubLogger(logrus.Fields{"pod": id}),
-		SV:             runit.DefaultSV,
-		ServiceBuilder: runit.DefaultBuilder,
-		P2Exec:         DefaultP2Exec,
-		DefaultTimeout: 60 * time.Second,
+		Id:              id,
+		path:            path,
+		logger:          Log.SubLogger(logrus.Fields{"pod": id}),
+		SV:              runit.DefaultSV,
+		ServiceBuilder:  runit.DefaultBuilder,
+		P2Exec:          DefaultP2Exec,
+		DefaultTimeout:  60 * time.Second,
+		StartTimeout:    DefaultStartTimeout,
+		SecretProviders: secrets.DefaultProviders,
+		ArtifactFetcher: uri.DefaultFetcher,
 	}
 }
 
@@ -103,7 +126,9 @@ func (pod *Pod) Halt(manifest Manifest) (bool, error) {
 	}
 
 	success := true
-	for _, launchable := range launchables {
+	// halt in reverse launch order, so that no launchable outlives its dependencies
+	for i := len(launchables) - 1; i >= 0; i-- {
+		launchable := launchables[i]
 		err = launchable.Halt(runit.DefaultBuilder, runit.DefaultSV) // TODO: make these configurable
 		switch err.(type) {
 		case nil:
@@ -111,6 +136,9 @@ func (pod *Pod) Halt(manifest Manifest) (bool, error) {
 		case launch.DisableError:
 			// do not set success to false on a disable error
 			pod.logLaunchableWarning(launchable.ID(), err, "Could not disable launchable")
+		case launch.PreStopError:
+			// the launchable was still stopped
+			pod.logLaunchableWarning(launchable.ID(), err, "Pre-stop command of launchable failed")
 		default:
 			// this case intentionally includes launch.StopError
 			pod.logLaunchableError(launchable.ID(), err, "Could not halt launchable")
@@ -129,12 +157,28 @@ func (pod *Pod) Halt(manifest Manifest) (bool, error) {
 // during the launch process will be logged, but will not stop attempts to launch other launchables
 // in the same pod. If any services fail to start, the first return bool will be false. If an error
 // occurs when writing the current manifest to the pod directory, an error will be returned.
+//
+// Launchables are started in dependency order. A launchable with dependents must be running
+// before its dependents are started, and if it fails to start its dependents are not started.
+//
+// The pod's secrets are written on every launch rather than on install, since their tmpfs
+// does not survive a reboot.
 func (pod *Pod) Launch(manifest Manifest) (bool, error) {
 	launchables, err := pod.Launchables(manifest)
 	if err != nil {
 		return false, err
 	}
 
+	uid, gid, err := user.IDs(manifest.RunAsUser())
+	if err != nil {
+		return false, util.Errorf("Could not determine pod UID/GID for %s: %s", manifest.RunAsUser(), err)
+	}
+	err = pod.writeSecrets(manifest, uid, gid)
+	if err != nil {
+		pod.logError(err, "Could not write secrets")
+		return false, err
+	}
+
 	oldManifestTemp, err := pod.WriteCurrentManifest(manifest)
 	defer os.RemoveAll(oldManifestTemp)
 
@@ -164,11 +208,28 @@ func (pod *Pod) Launch(manifest Manifest) (bool, error) {
 		}
 	}
 
-	err = pod.buildRunitServices(launchables, manifest.GetRestartPolicy())
+	dependencies := pod.launchableDependencies(manifest)
+	startTimeouts := pod.startTimeouts(manifest)
+	hasDependents := make(map[string]bool)
+	for _, deps := range dependencies {
+		for _, dep := range deps {
+			hasDependents[dep] = true
+		}
+	}
+
+	err = pod.buildRunitServices(launchables, manifest.GetRestartPolicy(), dependencies)
 
 	success := true
+	failed := make(map[string]bool)
 	for i, launchable := range launchables {
 		if !successes[i] {
+			failed[launchable.ID()] = true
+			continue
+		}
+		if dep := firstFailed(dependencies[launchable.ID()], failed); dep != "" {
+			pod.logLaunchableError(launchable.ID(), util.Errorf("dependency %s did not start", dep), "Not launching launchable")
+			failed[launchable.ID()] = true
+			success = false
 			continue
 		}
 		err = launchable.Launch(pod.ServiceBuilder, pod.SV) // TODO: make these configurable
@@ -181,7 +242,17 @@ func (pod *Pod) Launch(manifest Manifest) (bool, error) {
 		default:
 			// this case intentionally includes launch.StartError
 			pod.logLaunchableError(launchable.ID(), err, "Could not launch launchable")
+			failed[launchable.ID()] = true
 			success = false
+			continue
+		}
+		if hasDependents[launchable.ID()] {
+			err = pod.waitForRunning(launchable, startTimeouts[launchable.ID()])
+			if err != nil {
+				pod.logLaunchableError(launchable.ID(), err, "Launchable did not start, its dependents will not be launched")
+				failed[launchable.ID()] = true
+				success = false
+			}
 		}
 	}
 
@@ -229,22 +300,36 @@ func (pod *Pod) Services(manifest Manifest) ([]runit.Service, error) {
 }
 
 // Write servicebuilder *.yaml file and run servicebuilder, which will register runit services for this
-// pod.
-func (pod *Pod) buildRunitServices(launchables []launch.Launchable, restartPolicy runit.RestartPolicy) error {
-	// if the service is new, building the runit services also starts them
-	sbTemplate := make(map[string]runit.ServiceTemplate)
+// pod. The dependencies map the ID of each launchable to the IDs of the launchables it depends on.
+func (pod *Pod) buildRunitServices(launchables []launch.Launchable, restartPolicy runit.RestartPolicy, dependencies map[string][]string) error {
+	executablesByID := make(map[string][]launch.Executable)
 	for _, launchable := range launchables {
 		executables, err := launchable.Executables(pod.ServiceBuilder)
 		if err != nil {
 			pod.logLaunchableError(launchable.ID(), err, "Unable to list executables")
 			continue
 		}
-		for _, executable := range executables {
+		executablesByID[launchable.ID()] = executables
+	}
+
+	// if the service is new, building the runit services also starts them, so
+	// services must check for their dependencies themselves
+	sbTemplate := make(map[string]runit.ServiceTemplate)
+	for _, launchable := range launchables {
+		var requires []string
+		for _, dep := range dependencies[launchable.ID()] {
+			for _, executable := range executablesByID[dep] {
+				requires = append(requires, executable.Service.Path)
+			}
+		}
+		for _, executable := range executablesByID[launchable.ID()] {
 			if _, ok := sbTemplate[executable.Service.Name]; ok {
 				return util.Errorf("Duplicate executable %q for launchable %q", executable.Service.Name, launchable.ID())
 			}
 			sbTemplate[executable.Service.Name] = runit.ServiceTemplate{
-				Run: executable.Exec,
+				Run:        executable.Exec,
+				Requires:   requires,
+				StopSignal: executable.StopSignal,
 			}
 		}
 	}
@@ -358,8 +443,20 @@ func (pod *Pod) Uninstall() error {
 		return err
 	}
 
-	// remove pod home dir
-	return os.RemoveAll(pod.path)
+	// the launchables have exited, so their cgroups can be removed
+	err = pod.removeCgroup()
+	if err != nil {
+		pod.logError(err, "Could not remove pod cgroup")
+	}
+
+	// the secrets tmpfs must be unmounted before the pod home can be removed
+	err = pod.removeSecrets()
+	if err != nil {
+		return err
+	}
+
+	// remove pod home dir, keeping the volumes that outlive the pod
+	return pod.removeHome(currentManifest)
 }
 
 // Install will ensure that executables for all required services are present on the host
@@ -377,6 +474,23 @@ func (pod *Pod) Install(manifest Manifest) error {
 		return util.Errorf("Could not create pod home: %s", err)
 	}
 
+	err = pod.setupVolumes(manifest, uid, gid)
+	if err != nil {
+		pod.logError(err, "Could not set up volumes")
+		return err
+	}
+
+	err = pod.setupCgroup(manifest)
+	if err != nil {
+		pod.logError(err, "Could not set up pod cgroup")
+		return err
+	}
+
+	err = pod.checkArtifactLocations(manifest)
+	if err != nil {
+		pod.logError(err, "Could not locate artifacts")
+		return err
+	}
 	launchables, err := pod.Launchables(manifest)
 	if err != nil {
 		return err
@@ -403,26 +517,90 @@ func (pod *Pod) Install(manifest Manifest) error {
 	return nil
 }
 
-func (pod *Pod) Verify(manifest Manifest, authPolicy auth.Policy) error {
-	for _, stanza := range manifest.GetLaunchableStanzas() {
-		if stanza.DigestLocation == "" {
-			continue
+// Prestage fetches, verifies and extracts the artifacts of the manifest's launchables
+// ahead of time, so that installing the manifest later does not download anything.
+// Nothing else about the pod changes: the installs are not made current, and nothing
+// is launched.
+func (pod *Pod) Prestage(manifest Manifest) error {
+	uid, gid, err := user.IDs(manifest.RunAsUser())
+	if err != nil {
+		return util.Errorf("Could not determine pod UID/GID for %s: %s", manifest.RunAsUser(), err)
+	}
+	err = util.MkdirChownAll(pod.path, uid, gid, 0755)
+	if err != nil {
+		return util.Errorf("Could not create pod home: %s", err)
+	}
+
+	err = pod.checkArtifactLocations(manifest)
+	if err != nil {
+		pod.logError(err, "Could not locate artifacts")
+		return err
+	}
+	launchables, err := pod.Launchables(manifest)
+	if err != nil {
+		return err
+	}
+	for _, launchable := range launchables {
+		err := launchable.Install()
+		if err != nil {
+			pod.logLaunchableError(launchable.ID(), err, "Unable to pre-stage launchable")
+			return err
 		}
-		launchable, err := pod.getLaunchable(stanza, manifest.RunAsUser(), manifest.GetRestartPolicy())
+	}
+	pod.logInfo("Successfully pre-staged")
+	return nil
+}
+
+// checkArtifactLocations returns an error if the artifact of any of the manifest's
+// launchables cannot be located, because it is content-addressed and no artifact
+// registry is configured.
+func (pod *Pod) checkArtifactLocations(manifest Manifest) error {
+	for _, stanza := range manifest.GetLaunchableStanzas() {
+		_, err := stanza.ArtifactLocation(pod.ArtifactRegistry)
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// Retrieve the digest data
-		launchableDigest, err := digest.ParseUris(
-			launchable.Fetcher(),
-			stanza.DigestLocation,
-			stanza.DigestSignatureLocation,
-		)
+// Verify checks the installed files of each launchable against its digest: the one at
+// its digest_location, or else the one embedded in its artifact. Launchables without
+// either are not checked.
+func (pod *Pod) Verify(manifest Manifest, authPolicy auth.Policy) error {
+	for _, stanza := range manifest.GetLaunchableStanzas() {
+		launchable, err := pod.getLaunchable(stanza, manifest.RunAsUser(), manifest.GetRestartPolicy())
 		if err != nil {
 			return err
 		}
 
+		var launchableDigest digest.Digest
+		if stanza.DigestLocation != "" {
+			// Retrieve the digest data. A signed digest can come from a mirror, because
+			// the signature is checked below.
+			fetcher := launchable.Fetcher()
+			if stanza.DigestSignatureLocation != "" {
+				fetcher = uri.MirrorFetcher{Fetcher: fetcher, Rewrites: pod.MirrorRewrites}
+			}
+			launchableDigest, err = digest.ParseUris(
+				fetcher,
+				stanza.DigestLocation,
+				stanza.DigestSignatureLocation,
+			)
+			if err != nil {
+				return err
+			}
+		} else {
+			var embedded bool
+			launchableDigest, embedded, err = digest.ParseEmbedded(launchable.InstallDir())
+			if err != nil {
+				return util.Errorf("Could not read the digest embedded in %s: %s", launchable.ID(), err)
+			}
+			if !embedded {
+				continue
+			}
+		}
+
 		// Check that the digest is certified
 		err = authPolicy.CheckDigest(launchableDigest)
 		if err != nil {
@@ -463,17 +641,17 @@ func (pod *Pod) setupConfig(manifest Manifest, launchables []launch.Launchable)
 		return util.Errorf("Could not determine pod UID/GID: %s", err)
 	}
 
-	err = util.MkdirChownAll(pod.ConfigDir(), uid, gid, 0755)
+	layout, err := pod.Layout(manifest)
 	if err != nil {
-		return util.Errorf("Could not create config directory for pod %s: %s", manifest.ID(), err)
+		return err
 	}
-	configFileName, err := manifest.ConfigFileName()
+
+	err = util.MkdirChownAll(pod.ConfigDir(), uid, gid, 0755)
 	if err != nil {
-		return err
+		return util.Errorf("Could not create config directory for pod %s: %s", manifest.ID(), err)
 	}
-	configPath := filepath.Join(pod.ConfigDir(), configFileName)
 
-	file, err := os.OpenFile(configPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	file, err := os.OpenFile(layout.ConfigPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	defer file.Close()
 	if err != nil {
 		return util.Errorf("Could not open config file for pod %s for writing: %s", manifest.ID(), err)
@@ -487,12 +665,7 @@ func (pod *Pod) setupConfig(manifest Manifest, launchables []launch.Launchable)
 		return err
 	}
 
-	platConfigFileName, err := manifest.PlatformConfigFileName()
-	if err != nil {
-		return err
-	}
-	platConfigPath := filepath.Join(pod.ConfigDir(), platConfigFileName)
-	platFile, err := os.OpenFile(platConfigPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	platFile, err := os.OpenFile(layout.PlatformConfigPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	defer platFile.Close()
 	if err != nil {
 		return util.Errorf("Could not open config file for pod %s for writing: %s", manifest.ID(), err)
@@ -510,25 +683,21 @@ func (pod *Pod) setupConfig(manifest Manifest, launchables []launch.Launchable)
 	if err != nil {
 		return util.Errorf("Could not create the environment dir for pod %s: %s", manifest.ID(), err)
 	}
-	err = writeEnvFile(pod.EnvDir(), "CONFIG_PATH", configPath, uid, gid)
-	if err != nil {
-		return err
-	}
-	err = writeEnvFile(pod.EnvDir(), "PLATFORM_CONFIG_PATH", platConfigPath, uid, gid)
-	if err != nil {
-		return err
-	}
-	err = writeEnvFile(pod.EnvDir(), "POD_HOME", pod.Path(), uid, gid)
+	err = writeEnvDir(pod.EnvDir(), layout.Env, uid, gid)
 	if err != nil {
 		return err
 	}
 
+	launchableEnvs := make(map[string]map[string]string)
+	for _, launchableLayout := range layout.Launchables {
+		launchableEnvs[launchableLayout.ID] = launchableLayout.Env
+	}
 	for _, launchable := range launchables {
 		err = util.MkdirChownAll(launchable.EnvDir(), uid, gid, 0755)
 		if err != nil {
 			return util.Errorf("Could not create the environment dir for pod %s launchable %s: %s", manifest.ID(), launchable.ID(), err)
 		}
-		err = writeEnvFile(launchable.EnvDir(), "LAUNCHABLE_ROOT", launchable.InstallDir(), uid, gid)
+		err = writeEnvDir(launchable.EnvDir(), launchableEnvs[launchable.ID()], uid, gid)
 		if err != nil {
 			return err
 		}
@@ -537,6 +706,73 @@ func (pod *Pod) setupConfig(manifest Manifest, launchables []launch.Launchable)
 	return nil
 }
 
+// The file in an environment directory that lists the variables p2 wrote there. chpst
+// ignores files whose names start with a dot, so it is not exported itself.
+const managedEnvFile = ".p2-managed"
+
+// writeEnvDir writes the given variables to the environment directory. Variables that
+// p2 wrote on a previous install but are no longer set are removed, so that a pod
+// update does not leave stale values behind. Files written by anyone else, such as
+// hooks through HOOKED_ENV_PATH, are left alone.
+func writeEnvDir(envDir string, env map[string]string, uid, gid int) error {
+	for name, value := range env {
+		err := writeEnvFile(envDir, name, value, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	managedPath := filepath.Join(envDir, managedEnvFile)
+	previous, err := ioutil.ReadFile(managedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return util.Errorf("Could not read managed environment list %s: %s", managedPath, err)
+	}
+	for _, name := range strings.Split(string(previous), "\n") {
+		// the list is in a directory that the pod's user owns, so it is not trusted to
+		// name anything outside of it
+		if _, ok := env[name]; ok || name == "" || strings.HasPrefix(name, ".") || filepath.Base(name) != name {
+			continue
+		}
+		err = os.Remove(filepath.Join(envDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return util.Errorf("Could not remove stale environment file %s: %s", name, err)
+		}
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	err = writeManagedEnvList(managedPath, names)
+	if err != nil {
+		return util.Errorf("Could not write managed environment list %s: %s", managedPath, err)
+	}
+	return nil
+}
+
+// writeManagedEnvList atomically replaces the list of managed variables. The temporary
+// file is never written through a symlink that the pod's user left in its place.
+func writeManagedEnvList(path string, names []string) error {
+	tempPath := path + ".tmp"
+	err := os.Remove(tempPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	temp, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = temp.WriteString(strings.Join(names, "\n") + "\n")
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
 // writeEnvFile takes an environment directory (as described in http://smarden.org/runit/chpst.8.html, with the -e option)
 // and writes a new file with the given value.
 func writeEnvFile(envDir, name, value string, uid, gid int) error {
@@ -556,15 +792,28 @@ func writeEnvFile(envDir, name, value string, uid, gid int) error {
 	return nil
 }
 
+// Launchables returns the launchables of the given manifest in the order in which they
+// should be launched, with each launchable after the launchables it depends on.
 func (pod *Pod) Launchables(manifest Manifest) ([]launch.Launchable, error) {
 	launchableStanzas := manifest.GetLaunchableStanzas()
+	order, err := launchableOrder(launchableStanzas)
+	if err != nil {
+		return nil, err
+	}
 	launchables := make([]launch.Launchable, 0, len(launchableStanzas))
 
-	for _, launchableStanza := range launchableStanzas {
-		launchable, err := pod.getLaunchable(launchableStanza, manifest.RunAsUser(), manifest.GetRestartPolicy())
+	for _, key := range order {
+		launchable, err := pod.getLaunchable(launchableStanzas[key], manifest.RunAsUser(), manifest.GetRestartPolicy())
 		if err != nil {
 			return nil, err
 		}
+		switch launchable := launchable.(type) {
+		case hoist.LaunchAdapter:
+			launchable.CgroupConfig.Name = pod.launchableCgroupName(manifest, launchable.ID())
+		case *opencontainer.Launchable:
+			launchable.CgroupConfig.Name = pod.launchableCgroupName(manifest, launchable.ID())
+			launchable.Volumes = pod.volumeDirs(manifest)
+		}
 		launchables = append(launchables, launchable)
 	}
 
@@ -573,7 +822,7 @@ func (pod *Pod) Launchables(manifest Manifest) ([]launch.Launchable, error) {
 
 func (pod *Pod) getLaunchable(launchableStanza LaunchableStanza, runAsUser string, restartPolicy runit.RestartPolicy) (launch.Launchable, error) {
 	launchableRootDir := filepath.Join(pod.path, launchableStanza.LaunchableId)
-	launchableId := strings.Join([]string{pod.Id, "__", launchableStanza.LaunchableId}, "")
+	launchableId := pod.launchableID(launchableStanza)
 
 	restartTimeout := pod.DefaultTimeout
 
@@ -585,14 +834,26 @@ func (pod *Pod) getLaunchable(launchableStanza LaunchableStanza, runAsUser strin
 			restartTimeout = possibleTimeout
 		}
 	}
+	// A content-addressed artifact has no location without a registry. Only installing
+	// needs the location, which checkArtifactLocations ensures, so that the launchable
+	// can still be halted and uninstalled.
+	location, _ := launchableStanza.ArtifactLocation(pod.ArtifactRegistry)
+	// the digest of a content-addressed artifact is checked like an artifact_sha256
+	artifactSHA256 := launchableStanza.ArtifactSHA256
+	if launchableStanza.Artifact != "" {
+		artifactSHA256 = launchableStanza.ArtifactDigest()
+	}
+	// both timeouts are checked by ValidManifest
+	gracefulTimeout, _ := launchableStanza.GetGracefulTimeout()
+	preStopTimeout, _ := launchableStanza.PreStop.GetTimeout()
 
 	if launchableStanza.LaunchableType == "hoist" {
 		ret := &hoist.Launchable{
-			Location:         launchableStanza.Location,
+			Location:         location,
 			Id:               launchableId,
 			RunAs:            runAsUser,
 			PodEnvDir:        pod.EnvDir(),
-			Fetcher:          uri.DefaultFetcher,
+			Fetcher:          pod.ArtifactFetcher,
 			RootDir:          launchableRootDir,
 			P2Exec:           pod.P2Exec,
 			ExecNoLimit:      true,
@@ -600,21 +861,36 @@ func (pod *Pod) getLaunchable(launchableStanza LaunchableStanza, runAsUser strin
 			RestartPolicy:    restartPolicy,
 			CgroupConfig:     launchableStanza.CgroupConfig,
 			CgroupConfigName: launchableStanza.LaunchableId,
+			StopSignal:       launchableStanza.StopSignal,
+			GracefulTimeout:  gracefulTimeout,
+			PreStop:          launchableStanza.PreStop.Command,
+			PreStopTimeout:   preStopTimeout,
+			ArtifactSHA256:   artifactSHA256,
+			Mirrors:          pod.artifactMirrors(location, launchableStanza.Mirrors),
+			ContentAddressed: launchableStanza.Artifact != "",
 		}
 		ret.CgroupConfig.Name = ret.Id
 		return ret.If(), nil
-	} else if *ExperimentalOpencontainer && launchableStanza.LaunchableType == "opencontainer" {
+	} else if param.GetBool(ExperimentalOpencontainer) && launchableStanza.LaunchableType == "opencontainer" {
 		ret := &opencontainer.Launchable{
-			Location:       launchableStanza.Location,
-			ID_:            launchableId,
-			RunAs:          runAsUser,
-			RootDir:        launchableRootDir,
-			P2Exec:         pod.P2Exec,
-			RestartTimeout: restartTimeout,
-			RestartPolicy:  restartPolicy,
-			CgroupConfig:   launchableStanza.CgroupConfig,
+			Location:        location,
+			ID_:             launchableId,
+			RunAs:           runAsUser,
+			RootDir:         launchableRootDir,
+			P2Exec:          pod.P2Exec,
+			RestartTimeout:  restartTimeout,
+			RestartPolicy:   restartPolicy,
+			CgroupConfig:    launchableStanza.CgroupConfig,
+			StopSignal:      launchableStanza.StopSignal,
+			GracefulTimeout: gracefulTimeout,
+			PreStop:         launchableStanza.PreStop.Command,
+			PreStopTimeout:  preStopTimeout,
+			ArtifactSHA256:  artifactSHA256,
+			ArtifactFetcher: pod.ArtifactFetcher,
+			Mirrors:         pod.artifactMirrors(location, launchableStanza.Mirrors),
 		}
 		ret.CgroupConfig.Name = launchableId
+		ret.ContentAddressed = launchableStanza.Artifact != ""
 		return ret, nil
 	} else {
 		err := fmt.Errorf("launchable type '%s' is not supported", launchableStanza.LaunchableType)
@@ -623,6 +899,97 @@ func (pod *Pod) getLaunchable(launchableStanza LaunchableStanza, runAsUser strin
 	}
 }
 
+// artifactMirrors returns the locations to fall back to when a launchable's artifact
+// cannot be downloaded from its location: the mirrors listed in the manifest, then the
+// mirrors that the pod's rewrites give for each of those locations.
+func (pod *Pod) artifactMirrors(location string, manifestMirrors []string) []string {
+	mirrors := append([]string{}, manifestMirrors...)
+	for _, loc := range append([]string{location}, manifestMirrors...) {
+		mirrors = append(mirrors, uri.Mirrors(pod.MirrorRewrites, loc)...)
+	}
+	return mirrors
+}
+
+// launchableID returns the ID of the launchable described by the given stanza, which
+// is unique among all pods on the host.
+func (pod *Pod) launchableID(launchableStanza LaunchableStanza) string {
+	return strings.Join([]string{pod.Id, "__", launchableStanza.LaunchableId}, "")
+}
+
+// launchableDependencies maps the ID of each launchable in the manifest to the IDs of
+// the launchables it depends on.
+func (pod *Pod) launchableDependencies(manifest Manifest) map[string][]string {
+	stanzas := manifest.GetLaunchableStanzas()
+	dependencies := make(map[string][]string)
+	for _, stanza := range stanzas {
+		for _, key := range stanza.DependsOn {
+			dep, ok := stanzas[key]
+			if !ok {
+				continue // rejected by ValidManifest
+			}
+			id := pod.launchableID(stanza)
+			dependencies[id] = append(dependencies[id], pod.launchableID(dep))
+		}
+	}
+	return dependencies
+}
+
+// firstFailed returns the first of the given launchable IDs that is in the failed
+// set, or "" if none are.
+func firstFailed(ids []string, failed map[string]bool) string {
+	for _, id := range ids {
+		if failed[id] {
+			return id
+		}
+	}
+	return ""
+}
+
+// startTimeouts maps the ID of each launchable in the manifest to how long its
+// dependents wait for it to start: its restart_timeout if it has a valid one, or else
+// the pod's start timeout. The pod's default timeout is not used, since it is the
+// timeout for stopping services and is zero for the preparer.
+func (pod *Pod) startTimeouts(manifest Manifest) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, stanza := range manifest.GetLaunchableStanzas() {
+		timeout := pod.StartTimeout
+		if stanza.RestartTimeout != "" {
+			restartTimeout, err := time.ParseDuration(stanza.RestartTimeout)
+			if err == nil && restartTimeout > 0 {
+				timeout = restartTimeout
+			}
+		}
+		timeouts[pod.launchableID(stanza)] = timeout
+	}
+	return timeouts
+}
+
+// waitForRunning waits up to the timeout for every service of the given launchable to
+// be running.
+func (pod *Pod) waitForRunning(launchable launch.Launchable, timeout time.Duration) error {
+	executables, err := launchable.Executables(pod.ServiceBuilder)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for _, executable := range executables {
+		for {
+			stat, err := pod.SV.Stat(&executable.Service)
+			if err == nil && stat != nil && stat.ChildStatus == runit.STATUS_RUN {
+				break
+			}
+			if time.Now().After(deadline) {
+				if err == nil {
+					err = util.Errorf("%s is not running after %s", executable.Service.Name, timeout)
+				}
+				return err
+			}
+			time.Sleep(runningPollInterval)
+		}
+	}
+	return nil
+}
+
 func (p *Pod) logError(err error, message string) {
 	p.logger.WithError(err).
 		Error(message)
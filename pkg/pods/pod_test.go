@@ -11,8 +11,11 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/auth"
+	"github.com/square/p2/pkg/digest"
 	"github.com/square/p2/pkg/hoist"
 	"github.com/square/p2/pkg/launch"
 	"github.com/square/p2/pkg/runit"
@@ -58,6 +61,35 @@ func TestGetLaunchable(t *testing.T) {
 	}
 }
 
+func TestGetContentAddressedLaunchable(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	stanza := LaunchableStanza{
+		LaunchableType: "hoist",
+		LaunchableId:   "hello",
+		Artifact:       "sha256:" + strings.ToUpper(sha),
+	}
+	pod := getTestPod()
+	builder := NewManifestBuilder()
+	builder.SetID("hello")
+	builder.SetLaunchables(map[string]LaunchableStanza{"hello": stanza})
+	err := pod.checkArtifactLocations(builder.GetManifest())
+	Assert(t).IsNotNil(err, "a content-addressed artifact needs an artifact registry to be installed")
+	// without a registry the launchable can still be found, to halt or uninstall it
+	l, err := pod.getLaunchable(stanza, "foouser", runit.RestartPolicyAlways)
+	Assert(t).IsNil(err, "should have created the launchable without a registry")
+	Assert(t).AreEqual(filepath.Base(l.InstallDir()), "sha256-"+sha, "the install dir should not depend on the registry")
+
+	pod.ArtifactRegistry = "https://registry.example.com/artifacts/"
+	Assert(t).IsNil(pod.checkArtifactLocations(builder.GetManifest()), "the artifact should be located in the registry")
+	l, err = pod.getLaunchable(stanza, "foouser", runit.RestartPolicyAlways)
+	Assert(t).IsNil(err, "should have created the launchable")
+	launchable := l.(hoist.LaunchAdapter).Launchable
+	Assert(t).AreEqual(launchable.Location, "https://registry.example.com/artifacts/sha256/"+sha, "the artifact should be fetched from the registry")
+	Assert(t).AreEqual(launchable.ArtifactSHA256, sha, "the artifact should be verified against its digest")
+	Assert(t).AreEqual(launchable.Version(), "sha256-"+sha, "the version should come from the digest")
+	Assert(t).AreEqual(filepath.Base(launchable.InstallDir()), "sha256-"+sha, "the install dir should be named after the digest")
+}
+
 func TestPodCanWriteEnvFile(t *testing.T) {
 	envDir, err := ioutil.TempDir("", "envdir")
 	Assert(t).IsNil(err, "Should not have been an error writing the env dir")
@@ -149,6 +181,62 @@ config:
 	}
 }
 
+func TestPodSetupConfigWritesEnv(t *testing.T) {
+	currUser, err := user.Current()
+	Assert(t).IsNil(err, "Could not get the current user")
+	manifestStr := fmt.Sprintf(`id: thepod
+run_as: %s
+env:
+  COLOR: blue
+  SHAPE: square
+launchables:
+  my-app:
+    launchable_type: hoist
+    launchable_id: web
+    location: https://localhost:4444/foo/bar/baz.tar.gz
+    env:
+      COLOR: red
+`, currUser.Username)
+	manifest, err := ManifestFromBytes([]byte(manifestStr))
+	Assert(t).IsNil(err, "should not have erred reading the manifest")
+
+	podTemp, _ := ioutil.TempDir("", "pod")
+	defer os.RemoveAll(podTemp)
+	pod := NewPod(manifest.ID(), PodPath(podTemp, manifest.ID()))
+	launchables, err := pod.Launchables(manifest)
+	Assert(t).IsNil(err, "There shouldn't have been an error getting launchables")
+	// a hook writes a variable for the pod before it is installed
+	err = os.MkdirAll(pod.EnvDir(), 0755)
+	Assert(t).IsNil(err, "test setup: could not create env dir")
+	err = ioutil.WriteFile(filepath.Join(pod.EnvDir(), "HOOK_VAR"), []byte("hooked"), 0644)
+	Assert(t).IsNil(err, "test setup: could not write hook env var")
+	err = pod.setupConfig(manifest, launchables)
+	Assert(t).IsNil(err, "There shouldn't have been an error setting up config")
+
+	color, err := ioutil.ReadFile(filepath.Join(pod.EnvDir(), "COLOR"))
+	Assert(t).IsNil(err, "should have written pod env var")
+	Assert(t).AreEqual(string(color), "blue", "wrong pod env value")
+	color, err = ioutil.ReadFile(filepath.Join(launchables[0].EnvDir(), "COLOR"))
+	Assert(t).IsNil(err, "should have written launchable env var")
+	Assert(t).AreEqual(string(color), "red", "wrong launchable env value")
+
+	builder := manifest.GetBuilder()
+	builder.SetEnv(map[string]string{"COLOR": "green"})
+	updated := builder.GetManifest()
+	err = pod.setupConfig(updated, launchables)
+	Assert(t).IsNil(err, "There shouldn't have been an error updating config")
+
+	_, err = os.Stat(filepath.Join(pod.EnvDir(), "SHAPE"))
+	Assert(t).IsTrue(os.IsNotExist(err), "stale env var should have been removed")
+	_, err = os.Stat(filepath.Join(pod.EnvDir(), "POD_HOME"))
+	Assert(t).IsNil(err, "reserved env vars should be kept")
+	hooked, err := ioutil.ReadFile(filepath.Join(pod.EnvDir(), "HOOK_VAR"))
+	Assert(t).IsNil(err, "env vars written by hooks should survive an install")
+	Assert(t).AreEqual(string(hooked), "hooked", "env vars written by hooks should not be changed")
+	_, err = os.Stat(filepath.Join(launchables[0].EnvDir(), "LAUNCHABLE_ROOT"))
+	Assert(t).IsNil(err, "reserved launchable env vars should be kept")
+}
+
 func TestLogLaunchableError(t *testing.T) {
 	out := bytes.Buffer{}
 	Log.SetLogOut(&out)
@@ -259,7 +347,7 @@ func TestBuildRunitServices(t *testing.T) {
 
 	Assert(t).IsNil(err, "Got an unexpected error when attempting to start runit services")
 
-	pod.buildRunitServices([]launch.Launchable{hl.If()}, runit.RestartPolicyAlways)
+	pod.buildRunitServices([]launch.Launchable{hl.If()}, runit.RestartPolicyAlways, nil)
 	f, err := os.Open(outFilePath)
 	defer f.Close()
 	bytes, err := ioutil.ReadAll(f)
@@ -330,3 +418,119 @@ func ContainsString(test string) func(interface{}) bool {
 		}
 	}
 }
+
+func TestLaunchablesAreInDependencyOrder(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(`id: thepod
+launchables:
+  web:
+    launchable_type: hoist
+    launchable_id: web
+    location: https://localhost:4444/foo/bar/web.tar.gz
+    depends_on: [db]
+  db:
+    launchable_type: hoist
+    launchable_id: db
+    location: https://localhost:4444/foo/bar/db.tar.gz
+`))
+	Assert(t).IsNil(err, "should not have erred reading the manifest")
+
+	pod := NewPod(manifest.ID(), PodPath("/data/pods", manifest.ID()))
+	launchables, err := pod.Launchables(manifest)
+	Assert(t).IsNil(err, "There shouldn't have been an error getting launchables")
+	Assert(t).AreEqual(len(launchables), 2, "wrong number of launchables")
+	Assert(t).AreEqual(launchables[0].ID(), "thepod__db", "dependency should come first")
+	Assert(t).AreEqual(launchables[1].ID(), "thepod__web", "dependent should come last")
+
+	dependencies := pod.launchableDependencies(manifest)
+	Assert(t).AreEqual(len(dependencies["thepod__web"]), 1, "web should have one dependency")
+	Assert(t).AreEqual(dependencies["thepod__web"][0], "thepod__db", "web should depend on db")
+}
+
+func TestStartTimeouts(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(`id: thepod
+launchables:
+  web:
+    launchable_type: hoist
+    launchable_id: web
+    location: https://localhost:4444/foo/bar/web.tar.gz
+    depends_on: [db, cache]
+  db:
+    launchable_type: hoist
+    launchable_id: db
+    location: https://localhost:4444/foo/bar/db.tar.gz
+    restart_timeout: 2m
+  cache:
+    launchable_type: hoist
+    launchable_id: cache
+    location: https://localhost:4444/foo/bar/cache.tar.gz
+`))
+	Assert(t).IsNil(err, "should not have erred reading the manifest")
+
+	pod := NewPod(manifest.ID(), PodPath("/data/pods", manifest.ID()))
+	// like the preparer's own pod
+	pod.DefaultTimeout = 0
+	timeouts := pod.startTimeouts(manifest)
+	Assert(t).AreEqual(timeouts["thepod__db"], 2*time.Minute, "the restart_timeout should bound the wait")
+	Assert(t).AreEqual(timeouts["thepod__cache"], DefaultStartTimeout, "the start timeout should not depend on the stop timeout")
+}
+
+func TestLayout(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(`id: thepod
+env:
+  COLOR: blue
+launchables:
+  app:
+    launchable_type: hoist
+    launchable_id: web
+    location: https://localhost:4444/foo/bar/web_abc123.tar.gz
+`))
+	Assert(t).IsNil(err, "should not have erred reading the manifest")
+
+	pod := NewPod(manifest.ID(), PodPath("/data/pods", manifest.ID()))
+	layout, err := pod.Layout(manifest)
+	Assert(t).IsNil(err, "should have computed the layout")
+	configFileName, _ := manifest.ConfigFileName()
+	Assert(t).AreEqual(layout.ConfigPath, filepath.Join("/data/pods/thepod/config", configFileName), "wrong config path")
+	Assert(t).AreEqual(layout.Env["COLOR"], "blue", "manifest env should be included")
+	Assert(t).AreEqual(layout.Env["POD_HOME"], "/data/pods/thepod", "reserved env should be included")
+	Assert(t).AreEqual(len(layout.Launchables), 1, "wrong number of launchables")
+	Assert(t).AreEqual(layout.Launchables[0].InstallDir, "/data/pods/thepod/web/installs/web_abc123", "wrong install dir")
+	Assert(t).AreEqual(layout.Launchables[0].Env["LAUNCHABLE_ROOT"], layout.Launchables[0].InstallDir, "wrong launchable root")
+}
+
+func TestVerifyUsesEmbeddedDigest(t *testing.T) {
+	podDir, err := ioutil.TempDir("", "pod")
+	Assert(t).IsNil(err, "test setup: could not create temp dir")
+	defer os.RemoveAll(podDir)
+	pod := NewPod("hello", podDir)
+
+	builder := NewManifestBuilder()
+	builder.SetID("hello")
+	builder.SetLaunchables(map[string]LaunchableStanza{
+		"app": {
+			LaunchableType: "hoist",
+			LaunchableId:   "app",
+			Location:       "https://localhost/app_abc123.tar.gz",
+		},
+	})
+	manifest := builder.GetManifest()
+	launchables, err := pod.Launchables(manifest)
+	Assert(t).IsNil(err, "should have created the launchables")
+	installDir := launchables[0].InstallDir()
+	err = os.MkdirAll(filepath.Join(installDir, ".p2"), 0755)
+	Assert(t).IsNil(err, "test setup: could not create install dir")
+	err = ioutil.WriteFile(filepath.Join(installDir, "launch"), []byte("#!/bin/sh\n"), 0755)
+	Assert(t).IsNil(err, "test setup: could not write launchable")
+
+	Assert(t).IsNil(pod.Verify(manifest, auth.NullPolicy{}), "a launchable without a digest should not be verified")
+
+	embedded, err := digest.Generate(installDir)
+	Assert(t).IsNil(err, "test setup: could not generate digest")
+	err = ioutil.WriteFile(filepath.Join(installDir, digest.EmbeddedDigestPath), embedded, 0644)
+	Assert(t).IsNil(err, "test setup: could not embed digest")
+	Assert(t).IsNil(pod.Verify(manifest, auth.NullPolicy{}), "the launchable should match its embedded digest")
+
+	err = ioutil.WriteFile(filepath.Join(installDir, "extra"), []byte("extra"), 0644)
+	Assert(t).IsNil(err, "test setup: could not write file")
+	Assert(t).IsNotNil(pod.Verify(manifest, auth.NullPolicy{}), "a file that is not in the embedded digest should fail verification")
+}
@@ -0,0 +1,116 @@
+package pods
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// The size limit of the tmpfs that holds a pod's secrets.
+const secretsTmpfsSize = "16m"
+
+// The functions that mount and unmount a pod's secrets directory. Variables so that
+// tests, which cannot mount file systems, can replace them.
+var (
+	mountSecretsDir   = mountTmpfs
+	unmountSecretsDir = unmountTmpfs
+)
+
+// SecretsDir is the directory the pod's secrets are written to. It is backed by tmpfs,
+// so secret values are never written to disk.
+func (pod *Pod) SecretsDir() string {
+	return filepath.Join(pod.path, "secrets")
+}
+
+// writeSecrets fetches the values of the manifest's secrets from the pod's secret
+// providers and writes them to the pod's secrets directory, readable only by the pod's
+// user. Secrets that are no longer in the manifest are removed. If the manifest has no
+// secrets, the secrets directory is removed. Secret values are never logged.
+func (pod *Pod) writeSecrets(manifest Manifest, uid, gid int) error {
+	refs := manifest.GetSecrets()
+	if len(refs) == 0 {
+		return pod.removeSecrets()
+	}
+
+	// fetch everything before touching the directory, so that a missing secret
+	// leaves the previous secrets in place
+	values := make(map[string][]byte, len(refs))
+	for name, ref := range refs {
+		value, err := pod.SecretProviders.Get(ref.Provider, ref.Key)
+		if err != nil {
+			return util.Errorf("Could not fetch secret %s from provider %s: %s", name, ref.Provider, err)
+		}
+		values[name] = value
+	}
+
+	dir := pod.SecretsDir()
+	err := util.MkdirChownAll(dir, uid, gid, 0700)
+	if err != nil {
+		return util.Errorf("Could not create secrets dir for pod %s: %s", manifest.ID(), err)
+	}
+	err = mountSecretsDir(dir, uid, gid)
+	if err != nil {
+		return util.Errorf("Could not mount tmpfs for secrets of pod %s: %s", manifest.ID(), err)
+	}
+
+	for name, value := range values {
+		err = writeSecretFile(dir, name, value, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return util.Errorf("Could not list secrets dir %s: %s", dir, err)
+	}
+	for _, info := range existing {
+		if _, ok := values[info.Name()]; ok {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return util.Errorf("Could not remove stale secret %s: %s", info.Name(), err)
+		}
+	}
+	return nil
+}
+
+// writeSecretFile atomically replaces a secret file, so that the pod never reads a
+// partially written value.
+func writeSecretFile(dir, name string, value []byte, uid, gid int) error {
+	temp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return util.Errorf("Could not create secret %s: %s", name, err)
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(value)
+	if err == nil {
+		err = temp.Chmod(0400)
+	}
+	if err == nil {
+		err = temp.Chown(uid, gid)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return util.Errorf("Could not write secret %s: %s", name, err)
+	}
+	return os.Rename(temp.Name(), filepath.Join(dir, name))
+}
+
+// removeSecrets unmounts and removes the pod's secrets directory, if there is one.
+func (pod *Pod) removeSecrets() error {
+	dir := pod.SecretsDir()
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	err := unmountSecretsDir(dir)
+	if err != nil {
+		return util.Errorf("Could not unmount secrets dir %s: %s", dir, err)
+	}
+	return os.RemoveAll(dir)
+}
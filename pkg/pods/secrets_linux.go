@@ -0,0 +1,41 @@
+package pods
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// mountTmpfs mounts a tmpfs owned by the given user at dir, unless one is already
+// mounted there.
+func mountTmpfs(dir string, uid, gid int) error {
+	mounted, err := isMountPoint(dir)
+	if err != nil || mounted {
+		return err
+	}
+	options := fmt.Sprintf("mode=0700,uid=%d,gid=%d,size=%s", uid, gid, secretsTmpfsSize)
+	return syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, options)
+}
+
+// unmountTmpfs unmounts the file system at dir, if one is mounted there.
+func unmountTmpfs(dir string) error {
+	mounted, err := isMountPoint(dir)
+	if err != nil || !mounted {
+		return err
+	}
+	return syscall.Unmount(dir, 0)
+}
+
+// isMountPoint returns true if dir is on a different device than its parent.
+func isMountPoint(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	parentInfo, err := os.Stat(filepath.Dir(dir))
+	if err != nil {
+		return false, err
+	}
+	return info.Sys().(*syscall.Stat_t).Dev != parentInfo.Sys().(*syscall.Stat_t).Dev, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package pods
+
+import (
+	"github.com/square/p2/pkg/util"
+)
+
+func mountTmpfs(dir string, uid, gid int) error {
+	return util.Errorf("pod secrets are only supported on linux")
+}
+
+func unmountTmpfs(dir string) error {
+	return nil
+}
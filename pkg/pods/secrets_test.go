@@ -0,0 +1,86 @@
+package pods
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/square/p2/pkg/secrets"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestWriteSecrets(t *testing.T) {
+	// tests cannot mount a tmpfs, so the secrets dir is a plain directory
+	mountSecretsDir = func(string, int, int) error { return nil }
+	unmountSecretsDir = func(string) error { return nil }
+	defer func() {
+		mountSecretsDir = mountTmpfs
+		unmountSecretsDir = unmountTmpfs
+	}()
+
+	currUser, err := user.Current()
+	Assert(t).IsNil(err, "Could not get the current user")
+	uid, _ := strconv.Atoi(currUser.Uid)
+	gid, _ := strconv.Atoi(currUser.Gid)
+
+	secretRoot, _ := ioutil.TempDir("", "secrets")
+	defer os.RemoveAll(secretRoot)
+	err = ioutil.WriteFile(filepath.Join(secretRoot, "db-password"), []byte("hunter2"), 0600)
+	Assert(t).IsNil(err, "could not write test secret")
+	err = ioutil.WriteFile(filepath.Join(secretRoot, "api-token"), []byte("abc123"), 0600)
+	Assert(t).IsNil(err, "could not write test secret")
+
+	manifest, err := ManifestFromBytes([]byte(fmt.Sprintf(`id: thepod
+run_as: %s
+secrets:
+  db_password:
+    provider: vault
+    key: db-password
+  api_token:
+    provider: vault
+    key: api-token
+`, currUser.Username)))
+	Assert(t).IsNil(err, "should not have erred reading the manifest")
+	canonical, err := manifest.GetBuilder().GetManifest().Marshal()
+	Assert(t).IsNil(err, "should have marshaled the manifest")
+	Assert(t).IsFalse(strings.Contains(string(canonical), "hunter2"), "secret values should not be part of the manifest")
+
+	podTemp, _ := ioutil.TempDir("", "pod")
+	defer os.RemoveAll(podTemp)
+	pod := NewPod(manifest.ID(), PodPath(podTemp, manifest.ID()))
+	pod.SecretProviders = secrets.Providers{"vault": secrets.FileProvider{Root: secretRoot}}
+
+	err = pod.writeSecrets(manifest, uid, gid)
+	Assert(t).IsNil(err, "should have written secrets")
+	value, err := ioutil.ReadFile(filepath.Join(pod.SecretsDir(), "db_password"))
+	Assert(t).IsNil(err, "should have written the secret file")
+	Assert(t).AreEqual(string(value), "hunter2", "wrong secret value")
+	info, err := os.Stat(filepath.Join(pod.SecretsDir(), "db_password"))
+	Assert(t).IsNil(err, "should have written the secret file")
+	Assert(t).AreEqual(info.Mode().Perm(), os.FileMode(0400), "secret should only be readable by its owner")
+
+	builder := manifest.GetBuilder()
+	builder.SetSecrets(map[string]SecretRef{"db_password": {Provider: "vault", Key: "db-password"}})
+	err = pod.writeSecrets(builder.GetManifest(), uid, gid)
+	Assert(t).IsNil(err, "should have updated secrets")
+	_, err = os.Stat(filepath.Join(pod.SecretsDir(), "api_token"))
+	Assert(t).IsTrue(os.IsNotExist(err), "stale secret should have been removed")
+
+	builder.SetSecrets(map[string]SecretRef{"missing": {Provider: "vault", Key: "nope"}})
+	err = pod.writeSecrets(builder.GetManifest(), uid, gid)
+	Assert(t).IsNotNil(err, "should have failed to fetch a missing secret")
+	_, err = os.Stat(filepath.Join(pod.SecretsDir(), "db_password"))
+	Assert(t).IsNil(err, "a failed fetch should leave the previous secrets in place")
+
+	builder.SetSecrets(nil)
+	err = pod.writeSecrets(builder.GetManifest(), uid, gid)
+	Assert(t).IsNil(err, "should have removed secrets")
+	_, err = os.Stat(pod.SecretsDir())
+	Assert(t).IsTrue(os.IsNotExist(err), "secrets dir should have been removed")
+}
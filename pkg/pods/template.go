@@ -0,0 +1,128 @@
+package pods
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// Manifests scheduled by a replication controller can contain placeholders in the
+// string values of their config and env, which are resolved separately for each node
+// the manifest is scheduled on. The available parameters are:
+//
+//	${node.name}                the name of the node
+//	${node.labels.<label>}      the value of one of the node's labels
+//	${rc.id}                    the ID of the replication controller
+//	${rc.pod_labels.<label>}    the value of one of the RC's pod labels
+//
+// Other uses of "${" are left alone, so config values such as shell snippets are not
+// affected. "$${node." and "$${rc." are replaced by a literal "${node." and "${rc.".
+var templateParam = regexp.MustCompile(`\$(\$?)\{((?:node|rc)\.[^}]*)\}`)
+
+// IsTemplated returns true if the manifest's config or env contain any placeholders
+// that must be resolved with ResolveTemplate.
+func IsTemplated(m Manifest) bool {
+	templated := false
+	walkTemplateStrings(m, func(s string) string {
+		templated = templated || templateParam.MatchString(s)
+		return s
+	})
+	return templated
+}
+
+// ResolveTemplate returns a copy of the manifest in which every placeholder in its
+// config and env has been replaced by its value in params, which is keyed by
+// parameter name, such as "node.name". Returns an error if a placeholder has no value.
+// Signed manifests cannot be resolved, because the resolved manifest would no longer
+// match its signature.
+func ResolveTemplate(m Manifest, params map[string]string) (Manifest, error) {
+	if _, signature := m.SignatureData(); signature != nil {
+		return nil, util.Errorf("cannot resolve parameters in signed manifest %s, the signature would no longer match", m.ID())
+	}
+
+	missing := make(map[string]bool)
+	resolved := walkTemplateStrings(m, func(s string) string {
+		return templateParam.ReplaceAllStringFunc(s, func(placeholder string) string {
+			match := templateParam.FindStringSubmatch(placeholder)
+			if match[1] != "" {
+				// escaped, drop the extra "$"
+				return placeholder[1:]
+			}
+			value, ok := params[match[2]]
+			if !ok {
+				missing[match[2]] = true
+				return placeholder
+			}
+			return value
+		})
+	})
+
+	if len(missing) > 0 {
+		var names []string
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, util.Errorf("manifest %s has no value for parameters: %s", m.ID(), strings.Join(names, ", "))
+	}
+	if err := ValidManifest(resolved); err != nil {
+		return nil, util.Errorf("resolved manifest %s is invalid: %s", m.ID(), err)
+	}
+	return resolved, nil
+}
+
+// walkTemplateStrings applies f to every string value in the manifest's config, pod env
+// and launchable envs, and returns a copy of the manifest with the results. The
+// given manifest is not modified.
+func walkTemplateStrings(m Manifest, f func(string) string) Manifest {
+	builder := m.GetBuilder()
+
+	config, _ := walkConfig(m.GetConfig(), f).(map[interface{}]interface{})
+	builder.SetConfig(config)
+	builder.SetEnv(walkEnv(m.GetEnv(), f))
+
+	stanzas := make(map[string]LaunchableStanza)
+	for key, stanza := range m.GetLaunchableStanzas() {
+		stanza.Env = walkEnv(stanza.Env, f)
+		stanzas[key] = stanza
+	}
+	builder.SetLaunchables(stanzas)
+	return builder.GetManifest()
+}
+
+func walkConfig(node interface{}, f func(string) string) interface{} {
+	switch value := node.(type) {
+	case string:
+		return f(value)
+	case map[interface{}]interface{}:
+		if value == nil {
+			return value
+		}
+		copied := make(map[interface{}]interface{}, len(value))
+		for k, v := range value {
+			copied[k] = walkConfig(v, f)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = walkConfig(v, f)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+func walkEnv(env map[string]string, f func(string) string) map[string]string {
+	if env == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(env))
+	for name, value := range env {
+		copied[name] = f(value)
+	}
+	return copied
+}
@@ -0,0 +1,48 @@
+package pods
+
+import (
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestResolveTemplate(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte(`id: thepod
+env:
+  SHARD: ${node.labels.shard}
+launchables:
+  app:
+    launchable_type: hoist
+    launchable_id: web
+    location: https://localhost:4444/foo/bar/web_abc123.tar.gz
+    env:
+      OWNER: ${rc.id}
+config:
+  node: ${node.name}
+  script: echo ${HOME} $${node.name}
+  hosts:
+  - ${node.name}.example.com
+`))
+	Assert(t).IsNil(err, "should have parsed templated manifest")
+	Assert(t).IsTrue(IsTemplated(manifest), "manifest should be templated")
+
+	resolved, err := ResolveTemplate(manifest, map[string]string{
+		"node.name":         "node1",
+		"node.labels.shard": "3",
+		"rc.id":             "abc",
+	})
+	Assert(t).IsNil(err, "should have resolved manifest")
+	Assert(t).AreEqual(resolved.GetEnv()["SHARD"], "3", "node label should have been substituted")
+	Assert(t).AreEqual(resolved.GetLaunchableStanzas()["app"].Env["OWNER"], "abc", "rc ID should have been substituted")
+	config := resolved.GetConfig()
+	Assert(t).AreEqual(config["node"], "node1", "node name should have been substituted")
+	Assert(t).AreEqual(config["script"], "echo ${HOME} ${node.name}", "other and escaped placeholders should be left alone")
+	Assert(t).AreEqual(config["hosts"].([]interface{})[0], "node1.example.com", "lists should be substituted")
+	Assert(t).AreEqual(manifest.GetConfig()["node"], "${node.name}", "original manifest should not have changed")
+
+	_, err = ResolveTemplate(manifest, map[string]string{"node.name": "node1"})
+	Assert(t).IsNotNil(err, "missing parameters should be an error")
+
+	plain, _ := ManifestFromBytes([]byte(testPod()))
+	Assert(t).IsFalse(IsTemplated(plain), "manifest without placeholders should not be templated")
+}
@@ -0,0 +1,495 @@
+package pods
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/square/p2/Godeps/_workspace/src/golang.org/x/crypto/openpgp/clearsign"
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/digest"
+	"github.com/square/p2/pkg/runit"
+	"github.com/square/p2/pkg/uri"
+)
+
+// CurrentSchemaVersion is the newest manifest schema version understood by this
+// version of p2. Manifests without a schema_version are decoded leniently, ignoring
+// unknown fields. Manifests that declare a schema_version are decoded strictly, and
+// unknown fields make them invalid.
+const CurrentSchemaVersion = 1
+
+// A ValidationError is a single problem with a manifest. Path locates the offending
+// field in the manifest's YAML, such as "launchables.app.location", and is empty if
+// the problem is with the document as a whole.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors is every problem found with a manifest.
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ValidateManifestBytes returns every problem with a serialized manifest, which may be
+// clearsigned. Unknown fields are always reported, whatever the manifest's schema
+// version. Returns nil if the manifest is valid.
+func ValidateManifestBytes(bytes []byte) ValidationErrors {
+	signed, _ := clearsign.Decode(bytes)
+	if signed != nil {
+		bytes = signed.Plaintext
+	}
+	if looksLikeJSON(bytes) {
+		converted, err := jsonToYAML(bytes)
+		if err != nil {
+			return ValidationErrors{{Message: err.Error()}}
+		}
+		bytes = converted
+	}
+
+	problems := checkFields(bytes)
+	m := &manifest{}
+	err := yaml.Unmarshal(bytes, m)
+	if err != nil {
+		// checkFields reports type errors with their paths, so only report
+		// errors it did not find
+		if len(problems) == 0 {
+			problems = append(problems, ValidationError{Message: yamlErrorMessage(err)})
+		}
+		return problems
+	}
+	return append(problems, manifestProblems(m, true)...)
+}
+
+// ValidManifest checks the internal consistency of a manifest. Returns an error if the
+// data is inconsistent or "nil" otherwise. Manifests without a schema_version were
+// written before the values of older fields were checked strictly, and are only
+// checked for the problems that make them unusable.
+func ValidManifest(m Manifest) error {
+	problems := manifestProblems(m, m.GetSchemaVersion() > 0)
+	if len(problems) > 0 {
+		return problems[0]
+	}
+	return nil
+}
+
+// manifestProblems returns every problem with the values of a decoded manifest. Unless
+// strict is set, the status_port, the restart_policy, launchable cgroups and the URI
+// schemes of locations are not checked.
+func manifestProblems(m Manifest, strict bool) ValidationErrors {
+	var problems ValidationErrors
+	report := func(path string, format string, args ...interface{}) {
+		problems = append(problems, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if version := m.GetSchemaVersion(); version < 0 || version > CurrentSchemaVersion {
+		report("schema_version", "unsupported schema version %d, the newest supported version is %d", version, CurrentSchemaVersion)
+	}
+	if m.ID() == "" {
+		report("id", "manifest must contain an 'id'")
+	}
+	if port := m.GetStatusPort(); strict && (port < 0 || port > 65535) {
+		report("status_port", "%d is not a valid port", port)
+	}
+	switch policy := m.GetRestartPolicy(); {
+	case !strict, policy == runit.RestartPolicyAlways, policy == runit.RestartPolicyNever:
+	default:
+		report("restart_policy", "must be '%s' or '%s', got '%s'", runit.RestartPolicyAlways, runit.RestartPolicyNever, policy)
+	}
+	if err := validEnv(m.GetEnv()); err != nil {
+		report("env", "%s", err)
+	}
+
+	secretNames := make([]string, 0, len(m.GetSecrets()))
+	for name := range m.GetSecrets() {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+	for _, name := range secretNames {
+		ref := m.GetSecrets()[name]
+		if !secretName.MatchString(name) || name == "." || name == ".." {
+			report("secrets."+name, "'%s' is not a valid file name", name)
+		}
+		if ref.Provider == "" {
+			report("secrets."+name+".provider", "secret must contain a 'provider'")
+		}
+		if ref.Key == "" {
+			report("secrets."+name+".key", "secret must contain a 'key'")
+		}
+	}
+
+	volumes := m.GetVolumes()
+	volumeNames := make([]string, 0, len(volumes))
+	for name := range volumes {
+		volumeNames = append(volumeNames, name)
+	}
+	sort.Strings(volumeNames)
+	// the environment variables set for each volume, mapped to the volume's name
+	volumeEnv := make(map[string]string)
+	for _, name := range volumeNames {
+		volume := volumes[name]
+		path := "volumes." + name
+		if !volumeName.MatchString(name) {
+			report(path, "'%s' is not a valid volume name", name)
+			continue
+		}
+		for _, envName := range []string{VolumeEnvVar(name), VolumeQuotaEnvVar(name)} {
+			if other, ok := volumeEnv[envName]; ok {
+				report(path, "conflicts with volume '%s', both set %s", other, envName)
+			}
+			volumeEnv[envName] = name
+		}
+		if _, err := volume.GetMode(); err != nil {
+			report(path+".mode", "%s", err)
+		}
+		if volume.Quota < 0 {
+			report(path+".quota", "must not be negative")
+		}
+		switch retention := volume.GetRetention(); retention {
+		case VolumeRetentionKeep, VolumeRetentionDelete:
+		default:
+			report(path+".retention", "must be '%s' or '%s', got '%s'", VolumeRetentionKeep, VolumeRetentionDelete, retention)
+		}
+	}
+	checkVolumeEnv := func(path string, env map[string]string) {
+		for envName := range env {
+			if volume, ok := volumeEnv[envName]; ok {
+				report(path, "'%s' is set by volume '%s' and cannot be set in 'env'", envName, volume)
+			}
+		}
+	}
+	checkVolumeEnv("env", m.GetEnv())
+
+	if cgroup := m.GetCgroupConfig(); cgroup.CPUs < 0 {
+		report("cgroup.cpus", "must not be negative")
+	}
+	if cgroup := m.GetCgroupConfig(); cgroup.Memory < 0 {
+		report("cgroup.memory", "must not be negative")
+	}
+
+	rollback := m.GetRollbackPolicy()
+	if rollback.MaxLaunchFailures < 0 {
+		report("rollback.max_launch_failures", "must not be negative")
+	}
+	healthTimeout, err := rollback.GetHealthTimeout()
+	if err != nil {
+		report("rollback.health_timeout", "%s", err)
+	}
+	if healthTimeout > 0 && m.GetStatusPort() == 0 {
+		report("rollback.health_timeout", "requires a 'status_port'")
+	}
+
+	stanzas := m.GetLaunchableStanzas()
+	keys := make([]string, 0, len(stanzas))
+	for key := range stanzas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		stanza := stanzas[key]
+		path := "launchables." + key
+		if stanza.LaunchableType == "" {
+			report(path+".launchable_type", "launchable must contain a 'launchable_type'")
+		}
+		if stanza.LaunchableId == "" {
+			report(path+".launchable_id", "launchable must contain a 'launchable_id'")
+		}
+		if stanza.Artifact != "" {
+			if stanza.Location != "" {
+				report(path+".artifact", "a launchable cannot have both an 'artifact' and a 'location'")
+			}
+			if !strings.HasPrefix(stanza.Artifact, ArtifactDigestPrefix) || !digest.IsSHA256(stanza.ArtifactDigest()) {
+				report(path+".artifact", "'%s' is not of the form '%s<hex encoded SHA256>'", stanza.Artifact, ArtifactDigestPrefix)
+			} else if stanza.ArtifactSHA256 != "" && !strings.EqualFold(stanza.ArtifactSHA256, stanza.ArtifactDigest()) {
+				report(path+".artifact_sha256", "does not match the 'artifact'")
+			}
+		} else if stanza.Location == "" {
+			report(path+".location", "launchable must contain a 'location' or an 'artifact'")
+		} else if err := validLocation(stanza.Location); strict && err != nil {
+			report(path+".location", "%s", err)
+		}
+		if stanza.DigestLocation != "" && strict {
+			if err := validLocation(stanza.DigestLocation); err != nil {
+				report(path+".digest_location", "%s", err)
+			}
+		}
+		if stanza.DigestSignatureLocation != "" && strict {
+			if err := validLocation(stanza.DigestSignatureLocation); err != nil {
+				report(path+".digest_signature_location", "%s", err)
+			}
+		}
+		if stanza.ArtifactSHA256 != "" && !digest.IsSHA256(stanza.ArtifactSHA256) {
+			report(path+".artifact_sha256", "'%s' is not a hex encoded SHA256", stanza.ArtifactSHA256)
+		}
+		if len(stanza.Mirrors) > 0 && stanza.ArtifactSHA256 == "" && stanza.Artifact == "" {
+			report(path+".mirrors", "mirrors require an 'artifact_sha256' or an 'artifact'")
+		}
+		for i, mirror := range stanza.Mirrors {
+			if err := validLocation(mirror); err != nil {
+				report(fmt.Sprintf("%s.mirrors[%d]", path, i), "%s", err)
+			}
+		}
+		if stanza.CgroupConfig.CPUs < 0 && strict {
+			report(path+".cgroup.cpus", "must not be negative")
+		}
+		if stanza.CgroupConfig.Memory < 0 && strict {
+			report(path+".cgroup.memory", "must not be negative")
+		}
+		if err := validEnv(stanza.Env); err != nil {
+			report(path+".env", "%s", err)
+		}
+		checkVolumeEnv(path+".env", stanza.Env)
+		if stanza.StopSignal != "" {
+			if _, err := runit.ParseSignal(stanza.StopSignal); err != nil {
+				report(path+".stop_signal", "%s", err)
+			}
+		}
+		if timeout, err := stanza.GetGracefulTimeout(); err != nil {
+			report(path+".graceful_timeout", "%s", err)
+		} else if timeout < 0 {
+			report(path+".graceful_timeout", "must not be negative")
+		}
+		if timeout, err := stanza.PreStop.GetTimeout(); err != nil {
+			report(path+".pre_stop.timeout", "%s", err)
+		} else if timeout < 0 {
+			report(path+".pre_stop.timeout", "must not be negative")
+		}
+		if stanza.PreStop.Timeout != "" && len(stanza.PreStop.Command) == 0 {
+			report(path+".pre_stop.command", "pre_stop must contain a 'command'")
+		}
+	}
+	if _, err := launchableOrder(stanzas); err != nil {
+		problems = append(problems, err.(ValidationError))
+	}
+	return problems
+}
+
+// validLocation checks that a launchable location can be fetched.
+func validLocation(location string) error {
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	if !uri.IsSupportedScheme(u.Scheme) {
+		return fmt.Errorf("unsupported URI scheme '%s'", u.Scheme)
+	}
+	return nil
+}
+
+// ReservedEnvVars are set by p2 in every pod's environment, so manifests may not
+// define them.
+var ReservedEnvVars = []string{"CONFIG_PATH", "PLATFORM_CONFIG_PATH", "POD_HOME", "LAUNCHABLE_ROOT", "SECRETS_DIR"}
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+var volumeName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// validEnv checks that every variable can be written to a chpst environment
+// directory and does not shadow a variable that p2 sets itself.
+func validEnv(env map[string]string) error {
+	for name, value := range env {
+		if !envVarName.MatchString(name) {
+			return fmt.Errorf("'%s' is not a valid environment variable name", name)
+		}
+		for _, reserved := range ReservedEnvVars {
+			if name == reserved {
+				return fmt.Errorf("'%s' is reserved and cannot be set in 'env'", name)
+			}
+		}
+		if strings.ContainsAny(value, "\n\x00") {
+			return fmt.Errorf("value of '%s' must be a single line", name)
+		}
+	}
+	return nil
+}
+
+// launchableOrder returns the keys of the given launchable stanzas ordered so that
+// every launchable comes after the launchables it depends on. Launchables that do
+// not depend on each other are ordered by key, so the order is stable. Returns a
+// ValidationError if a launchable depends on itself, on a launchable that does not
+// exist, or on a cycle of launchables.
+func launchableOrder(stanzas map[string]LaunchableStanza) ([]string, error) {
+	keys := make([]string, 0, len(stanzas))
+	for key := range stanzas {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// the number of unordered launchables each launchable waits for, and the
+	// launchables waiting for each launchable
+	waiting := make(map[string]int, len(stanzas))
+	dependents := make(map[string][]string, len(stanzas))
+	for _, key := range keys {
+		path := "launchables." + key + ".depends_on"
+		seen := make(map[string]bool)
+		for _, dep := range stanzas[key].DependsOn {
+			switch {
+			case dep == key:
+				return nil, ValidationError{path, "launchable cannot depend on itself"}
+			case seen[dep]:
+				continue
+			}
+			if _, ok := stanzas[dep]; !ok {
+				return nil, ValidationError{path, fmt.Sprintf("unknown launchable '%s'", dep)}
+			}
+			seen[dep] = true
+			waiting[key]++
+			dependents[dep] = append(dependents[dep], key)
+		}
+	}
+
+	var ready, order []string
+	for _, key := range keys {
+		if waiting[key] == 0 {
+			ready = append(ready, key)
+		}
+	}
+	for len(ready) > 0 {
+		key := ready[0]
+		ready = ready[1:]
+		order = append(order, key)
+		for _, dependent := range dependents[key] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		sort.Strings(ready)
+	}
+
+	if len(order) < len(keys) {
+		var cycle []string
+		for _, key := range keys {
+			if waiting[key] > 0 {
+				cycle = append(cycle, key)
+			}
+		}
+		return nil, ValidationError{"launchables", fmt.Sprintf("launchables are in or depend on a dependency cycle: %s", strings.Join(cycle, ", "))}
+	}
+	return order, nil
+}
+
+var manifestType = reflect.TypeOf(manifest{})
+
+// checkFields decodes a YAML manifest generically and reports every field that is not
+// part of the manifest schema, and every field whose value has the wrong type.
+func checkFields(bytes []byte) ValidationErrors {
+	var doc interface{}
+	err := yaml.Unmarshal(bytes, &doc)
+	if err != nil {
+		return ValidationErrors{{Message: yamlErrorMessage(err)}}
+	}
+	return checkNode("", doc, manifestType)
+}
+
+// checkNode checks a generically decoded YAML node against the type it will be
+// decoded into. Structs are checked field by field and maps of structs entry by
+// entry. Other values are checked by decoding them.
+func checkNode(path string, node interface{}, t reflect.Type) ValidationErrors {
+	if node == nil {
+		return nil
+	}
+	isStruct := t.Kind() == reflect.Struct
+	isStructMap := t.Kind() == reflect.Map && t.Elem().Kind() == reflect.Struct
+	if !isStruct && !isStructMap {
+		out, err := yaml.Marshal(node)
+		if err == nil {
+			err = yaml.Unmarshal(out, reflect.New(t).Interface())
+		}
+		if err != nil {
+			return ValidationErrors{{path, yamlErrorMessage(err)}}
+		}
+		return nil
+	}
+
+	mapping, ok := node.(map[interface{}]interface{})
+	if !ok {
+		return ValidationErrors{{path, "must be a mapping"}}
+	}
+	keys := make([]string, 0, len(mapping))
+	values := make(map[string]interface{}, len(mapping))
+	for key, value := range mapping {
+		keyStr := fmt.Sprint(key)
+		keys = append(keys, keyStr)
+		values[keyStr] = value
+	}
+	sort.Strings(keys)
+
+	var fields map[string]reflect.Type
+	if isStruct {
+		fields = yamlFields(t)
+	}
+	var problems ValidationErrors
+	for _, key := range keys {
+		childPath := key
+		if path != "" {
+			childPath = path + "." + key
+		}
+		var childType reflect.Type
+		if isStruct {
+			childType, ok = fields[key]
+			if !ok {
+				problems = append(problems, ValidationError{childPath, "unknown field"})
+				continue
+			}
+		} else {
+			childType = t.Elem()
+		}
+		problems = append(problems, checkNode(childPath, values[key], childType)...)
+	}
+	return problems
+}
+
+// yamlFields maps the YAML names of a struct's fields to their types.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line \d+: `)
+
+// yamlErrorMessage strips the line numbers from YAML type errors, which refer to the
+// fragment being checked rather than to the whole manifest.
+func yamlErrorMessage(err error) string {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err.Error()
+	}
+	messages := make([]string, len(typeErr.Errors))
+	for i, message := range typeErr.Errors {
+		messages[i] = yamlErrorLine.ReplaceAllString(message, "")
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,159 @@
+package pods
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestUnknownFieldsIgnoredWithoutSchemaVersion(t *testing.T) {
+	_, err := ManifestFromBytes([]byte(testPod() + "restart_polcy: never\n"))
+	Assert(t).IsNil(err, "unversioned manifests should ignore unknown fields")
+}
+
+func TestUnknownFieldsRejectedWithSchemaVersion(t *testing.T) {
+	manifest, err := ManifestFromBytes([]byte("schema_version: 1\n" + testPod()))
+	Assert(t).IsNil(err, "versioned manifest without unknown fields should be accepted")
+	Assert(t).AreEqual(manifest.GetSchemaVersion(), 1, "schema version should have been read")
+
+	_, err = ManifestFromBytes([]byte("schema_version: 1\n" + testPod() + "restart_polcy: never\n"))
+	Assert(t).IsNotNil(err, "versioned manifest with an unknown field should be rejected")
+	Assert(t).IsTrue(strings.Contains(err.Error(), "restart_polcy: unknown field"), "error should name the unknown field")
+
+	_, err = ManifestFromBytes([]byte("schema_version: 2\n" + testPod()))
+	Assert(t).IsNotNil(err, "unsupported schema version should be rejected")
+}
+
+func TestValuesCheckedLenientlyWithoutSchemaVersion(t *testing.T) {
+	legacy := strings.Replace(testPod(), "https://localhost:4444", "ftp://localhost", 1) + "restart_policy: sometimes\n"
+	_, err := ManifestFromBytes([]byte(legacy))
+	Assert(t).IsNil(err, "unversioned manifests should be readable despite values that are now invalid")
+
+	_, err = ManifestFromBytes([]byte("schema_version: 1\n" + legacy))
+	Assert(t).IsNotNil(err, "versioned manifests should have their values checked strictly")
+}
+
+func TestValidateManifestBytesReportsEveryProblem(t *testing.T) {
+	problems := ValidateManifestBytes([]byte(`id: thepod
+status_port: 70000
+restart_policy: sometimes
+launchables:
+  app:
+    launchable_typ: hoist
+    launchable_id: app
+    location: ftp://example.com/app.tar.gz
+    cgroup:
+      memory: lots
+`))
+	paths := make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	Assert(t).IsTrue(paths["launchables.app.launchable_typ"], "unknown field should be reported")
+	Assert(t).IsTrue(paths["launchables.app.cgroup.memory"], "invalid size should be reported")
+	Assert(t).AreEqual(len(problems), 2, "fields with bad types prevent checking values")
+
+	problems = ValidateManifestBytes([]byte(`id: thepod
+status_port: 70000
+restart_policy: sometimes
+launchables:
+  app:
+    launchable_typ: hoist
+    launchable_id: app
+    location: ftp://example.com/app.tar.gz
+`))
+	paths = make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	Assert(t).IsTrue(paths["status_port"], "invalid port should be reported")
+	Assert(t).IsTrue(paths["restart_policy"], "invalid restart policy should be reported")
+	Assert(t).IsTrue(paths["launchables.app.launchable_typ"], "unknown field should be reported")
+	Assert(t).IsTrue(paths["launchables.app.launchable_type"], "missing field should be reported")
+	Assert(t).IsTrue(paths["launchables.app.location"], "unsupported scheme should be reported")
+
+	Assert(t).AreEqual(len(ValidateManifestBytes([]byte(testPod()))), 0, "valid manifest should have no problems")
+}
+
+func TestInvalidStopSettings(t *testing.T) {
+	problems := ValidateManifestBytes([]byte(`id: thepod
+launchables:
+  app:
+    launchable_type: hoist
+    launchable_id: app
+    location: https://localhost/app.tar.gz
+    stop_signal: SIGSTOP
+    graceful_timeout: forever
+    pre_stop:
+      timeout: 10s
+`))
+	paths := make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	Assert(t).IsTrue(paths["launchables.app.stop_signal"], "unsupported stop signal should be reported")
+	Assert(t).IsTrue(paths["launchables.app.graceful_timeout"], "invalid graceful timeout should be reported")
+	Assert(t).IsTrue(paths["launchables.app.pre_stop.command"], "pre_stop without a command should be reported")
+
+	_, err := ManifestFromBytes([]byte(`id: thepod
+launchables:
+  app:
+    launchable_type: hoist
+    launchable_id: app
+    location: https://localhost/app.tar.gz
+    stop_signal: int
+    graceful_timeout: 1m
+    pre_stop:
+      command: [bin/drain, --wait]
+      timeout: 45s
+`))
+	Assert(t).IsNil(err, "valid stop settings should be accepted")
+}
+
+func TestValidateLaunchableLocations(t *testing.T) {
+	problems := ValidateManifestBytes([]byte(`id: thepod
+launchables:
+  app:
+    launchable_type: hoist
+    launchable_id: app
+    location: s3://artifacts/app.tar.gz
+    digest_location: ftp://localhost/app.tar.gz.sha256
+    mirrors:
+    - https://mirror/app.tar.gz
+    - ftp://mirror/app.tar.gz
+`))
+	paths := make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	Assert(t).IsTrue(paths["launchables.app.mirrors"], "mirrors without an artifact SHA should be reported")
+	Assert(t).IsTrue(paths["launchables.app.mirrors[1]"], "a mirror with an unsupported scheme should be reported")
+	Assert(t).IsTrue(paths["launchables.app.digest_location"], "a digest location with an unsupported scheme should be reported")
+	Assert(t).AreEqual(len(problems), 3, "the S3 location and the valid mirror should not be reported")
+}
+
+func TestValidateContentAddressedArtifact(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	manifest := func(fields string) []byte {
+		return []byte(`id: thepod
+launchables:
+  app:
+    launchable_type: hoist
+    launchable_id: app
+` + fields)
+	}
+	Assert(t).AreEqual(len(ValidateManifestBytes(manifest("    artifact: sha256:"+sha+"\n    mirrors:\n    - https://mirror/app.tar.gz\n"))), 0, "a valid artifact digest should be accepted")
+
+	problems := ValidateManifestBytes(manifest("    artifact: sha256:" + sha + "\n    location: https://localhost/app.tar.gz\n    artifact_sha256: " + strings.Repeat("cd", 32) + "\n"))
+	paths := make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	Assert(t).IsTrue(paths["launchables.app.artifact"], "an artifact with a location should be reported")
+	Assert(t).IsTrue(paths["launchables.app.artifact_sha256"], "an artifact_sha256 that differs from the artifact should be reported")
+
+	problems = ValidateManifestBytes(manifest("    artifact: md5:0123\n"))
+	Assert(t).AreEqual(len(problems), 1, "an artifact that is not a SHA256 digest should be reported")
+	Assert(t).AreEqual(problems[0].Path, "launchables.app.artifact", "wrong problem path")
+}
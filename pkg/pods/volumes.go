@@ -0,0 +1,141 @@
+package pods
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/user"
+	"github.com/square/p2/pkg/util"
+)
+
+// VolumeEnvVar is the environment variable that holds the path of the named volume,
+// such as VOLUME_DATA for a volume named "data".
+func VolumeEnvVar(name string) string {
+	return "VOLUME_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// VolumeQuotaEnvVar is the environment variable that holds the quota of the named
+// volume in bytes, if it has one.
+func VolumeQuotaEnvVar(name string) string {
+	return VolumeEnvVar(name) + "_QUOTA"
+}
+
+// VolumesDir is the directory that holds the pod's volumes.
+func (pod *Pod) VolumesDir() string {
+	return filepath.Join(pod.path, "volumes")
+}
+
+// VolumeDir is the directory of the named volume.
+func (pod *Pod) VolumeDir(name string) string {
+	return filepath.Join(pod.VolumesDir(), name)
+}
+
+// volumeDirs maps the name of each of the manifest's volumes to its directory.
+func (pod *Pod) volumeDirs(manifest Manifest) map[string]string {
+	volumes := manifest.GetVolumes()
+	if len(volumes) == 0 {
+		return nil
+	}
+	dirs := make(map[string]string, len(volumes))
+	for name := range volumes {
+		dirs[name] = pod.VolumeDir(name)
+	}
+	return dirs
+}
+
+// setupVolumes creates the manifest's volumes, or updates the ownership and mode of
+// the ones that already exist. The contents of a volume are never touched. Volumes
+// that are no longer in the manifest are left alone until the pod is uninstalled.
+func (pod *Pod) setupVolumes(manifest Manifest, uid, gid int) error {
+	volumes := manifest.GetVolumes()
+	if len(volumes) == 0 {
+		return nil
+	}
+	err := util.MkdirChownAll(pod.VolumesDir(), uid, gid, 0755)
+	if err != nil {
+		return util.Errorf("Could not create volumes dir for pod %s: %s", manifest.ID(), err)
+	}
+
+	for name, volume := range volumes {
+		ownerUID, ownerGID := uid, gid
+		if volume.Owner != "" {
+			ownerUID, ownerGID, err = user.IDs(volume.Owner)
+			if err != nil {
+				return util.Errorf("Could not determine UID/GID of volume %s owner %s: %s", name, volume.Owner, err)
+			}
+		}
+		mode, err := volume.GetMode()
+		if err != nil {
+			return util.Errorf("Invalid mode for volume %s: %s", name, err)
+		}
+
+		dir := pod.VolumeDir(name)
+		err = util.MkdirChownAll(dir, ownerUID, ownerGID, mode)
+		if err != nil {
+			return util.Errorf("Could not create volume %s: %s", name, err)
+		}
+		// the directory may predate a change to the owner or mode
+		err = os.Chown(dir, ownerUID, ownerGID)
+		if err != nil {
+			return util.Errorf("Could not chown volume %s: %s", name, err)
+		}
+		err = os.Chmod(dir, mode)
+		if err != nil {
+			return util.Errorf("Could not chmod volume %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// removeHome removes the pod's home directory, except for the volumes that the
+// manifest keeps when the pod is uninstalled.
+func (pod *Pod) removeHome(manifest Manifest) error {
+	kept := make(map[string]bool)
+	for name, volume := range manifest.GetVolumes() {
+		if volume.GetRetention() == VolumeRetentionKeep {
+			kept[name] = true
+		}
+	}
+	if len(kept) == 0 {
+		return os.RemoveAll(pod.path)
+	}
+
+	err := removeAllExcept(pod.path, map[string]bool{filepath.Base(pod.VolumesDir()): true})
+	if err != nil {
+		return err
+	}
+	err = removeAllExcept(pod.VolumesDir(), kept)
+	if err != nil {
+		return err
+	}
+	for name := range kept {
+		pod.logger.WithFields(logrus.Fields{
+			"volume": name,
+			"path":   pod.VolumeDir(name),
+		}).Info("Keeping volume of uninstalled pod")
+	}
+	return nil
+}
+
+// removeAllExcept removes everything in dir except the entries with the given names.
+func removeAllExcept(dir string, keep map[string]bool) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package pods
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestVolumesSurviveUninstall(t *testing.T) {
+	currUser, err := user.Current()
+	Assert(t).IsNil(err, "Could not get the current user")
+	uid, _ := strconv.Atoi(currUser.Uid)
+	gid, _ := strconv.Atoi(currUser.Gid)
+
+	manifest, err := ManifestFromBytes([]byte(fmt.Sprintf(`id: thepod
+run_as: %s
+volumes:
+  data:
+    mode: "0700"
+    quota: 10G
+  scratch-space:
+    retention: delete
+`, currUser.Username)))
+	Assert(t).IsNil(err, "should not have erred reading the manifest")
+	Assert(t).IsNil(ValidManifest(manifest), "manifest should be valid")
+
+	podTemp, _ := ioutil.TempDir("", "pod")
+	defer os.RemoveAll(podTemp)
+	pod := NewPod(manifest.ID(), PodPath(podTemp, manifest.ID()))
+
+	layout, err := pod.Layout(manifest)
+	Assert(t).IsNil(err, "should have computed the layout")
+	Assert(t).AreEqual(layout.Env["VOLUME_DATA"], pod.VolumeDir("data"), "volume path should be in the env")
+	Assert(t).AreEqual(layout.Env["VOLUME_DATA_QUOTA"], "10737418240", "volume quota should be in the env")
+	Assert(t).AreEqual(layout.Env["VOLUME_SCRATCH_SPACE"], pod.VolumeDir("scratch-space"), "volume names should be usable as env vars")
+	_, ok := layout.Env["VOLUME_SCRATCH_SPACE_QUOTA"]
+	Assert(t).IsFalse(ok, "volumes without a quota should not set one")
+
+	err = pod.setupVolumes(manifest, uid, gid)
+	Assert(t).IsNil(err, "should have set up volumes")
+	info, err := os.Stat(pod.VolumeDir("data"))
+	Assert(t).IsNil(err, "should have created the volume")
+	Assert(t).AreEqual(info.Mode().Perm(), os.FileMode(0700), "volume should have its declared mode")
+	err = ioutil.WriteFile(filepath.Join(pod.VolumeDir("data"), "db"), []byte("state"), 0600)
+	Assert(t).IsNil(err, "could not write to the volume")
+	err = ioutil.WriteFile(filepath.Join(pod.VolumeDir("scratch-space"), "tmp"), []byte("junk"), 0600)
+	Assert(t).IsNil(err, "could not write to the volume")
+	err = os.MkdirAll(pod.ConfigDir(), 0755)
+	Assert(t).IsNil(err, "could not create the config dir")
+
+	err = pod.removeHome(manifest)
+	Assert(t).IsNil(err, "should have removed the pod home")
+	data, err := ioutil.ReadFile(filepath.Join(pod.VolumeDir("data"), "db"))
+	Assert(t).IsNil(err, "kept volume should survive uninstall")
+	Assert(t).AreEqual(string(data), "state", "kept volume should be unchanged")
+	_, err = os.Stat(pod.VolumeDir("scratch-space"))
+	Assert(t).IsTrue(os.IsNotExist(err), "deleted volume should have been removed")
+	_, err = os.Stat(pod.ConfigDir())
+	Assert(t).IsTrue(os.IsNotExist(err), "the rest of the pod home should have been removed")
+}
+
+func TestInvalidVolumes(t *testing.T) {
+	problems := ValidateManifestBytes([]byte(testPod() + `env:
+  VOLUME_DATA: /elsewhere
+volumes:
+  data:
+    mode: rwx
+    retention: forever
+  a-b: {}
+  a_b: {}
+`))
+	paths := make(map[string]bool)
+	for _, problem := range problems {
+		paths[problem.Path] = true
+	}
+	Assert(t).IsTrue(paths["volumes.data.mode"], "invalid mode should be reported")
+	Assert(t).IsTrue(paths["volumes.data.retention"], "invalid retention should be reported")
+	Assert(t).IsTrue(paths["volumes.a_b"], "volumes with the same env var should be reported")
+	Assert(t).IsTrue(paths["env"], "env set by a volume should be reported")
+}
@@ -0,0 +1,319 @@
+package preparer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/hooks"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/util"
+)
+
+// The extension of the journal files kept in the preparer's journal directory, one per
+// pod that is being transitioned from its reality manifest to its intent manifest.
+const journalExtension = ".yaml"
+
+// JournalPhase records how far a pod transition got before it was interrupted.
+type JournalPhase string
+
+const (
+	// The intent has been installed and verified, but the reality is still running.
+	JournalInstalled JournalPhase = "installed"
+	// The reality has been halted, but the intent has not been launched.
+	JournalHalted JournalPhase = "halted"
+	// The intent has been launched, but has not been written to the reality store.
+	JournalLaunched JournalPhase = "launched"
+	// The intent failed and the reality was relaunched in its place. This journal
+	// is kept so that the failed intent is not retried.
+	JournalRolledBack JournalPhase = "rolled_back"
+)
+
+// A Journal describes a pod transition in progress. The manifests are stored
+// verbatim so that signed manifests survive the round trip.
+type Journal struct {
+	Phase   JournalPhase `yaml:"phase"`
+	Intent  string       `yaml:"intent"`
+	Reality string       `yaml:"reality,omitempty"`
+	// The number of times launching this intent has failed so far.
+	LaunchFailures int `yaml:"launch_failures,omitempty"`
+}
+
+// journalPath returns the journal of the given pod. Journals are kept out of pod homes,
+// which their pods' users can write to, since resuming a transition launches the
+// journaled intent.
+func (p *Preparer) journalPath(podID string) string {
+	return filepath.Join(p.journalDir, podID+journalExtension)
+}
+
+// writeJournal atomically replaces the journal for the given pod, so that a crash
+// never leaves a partially written journal behind. Launch failures recorded for the
+// same intent are carried over.
+func (p *Preparer) writeJournal(pair ManifestPair, phase JournalPhase) error {
+	journal := &Journal{Phase: phase}
+	intent, err := pair.Intent.Marshal()
+	if err != nil {
+		return err
+	}
+	journal.Intent = string(intent)
+	if pair.Reality != nil {
+		reality, err := pair.Reality.Marshal()
+		if err != nil {
+			return err
+		}
+		journal.Reality = string(reality)
+	}
+	previous, err := p.readJournal(pair.ID)
+	if err == nil && previous != nil && previous.Intent == journal.Intent {
+		journal.LaunchFailures = previous.LaunchFailures
+	}
+	return p.saveJournal(pair.ID, journal)
+}
+
+func (p *Preparer) saveJournal(podID string, journal *Journal) error {
+	out, err := yaml.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	path := p.journalPath(podID)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return util.Errorf("could not create directory for journal %s: %s", path, err)
+	}
+	// a temp file left by a crash is replaced, and never written through a symlink
+	tempPath := path + ".tmp"
+	err = os.Remove(tempPath)
+	if err != nil && !os.IsNotExist(err) {
+		return util.Errorf("could not remove stale journal %s: %s", tempPath, err)
+	}
+	temp, err := os.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return util.Errorf("could not write journal %s: %s", tempPath, err)
+	}
+	_, err = temp.Write(out)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return util.Errorf("could not write journal %s: %s", tempPath, err)
+	}
+	return os.Rename(tempPath, path)
+}
+
+func (p *Preparer) removeJournal(podID string) error {
+	err := os.Remove(p.journalPath(podID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readJournal returns the journaled transition for the given pod, or nil if the pod
+// has no transition in progress.
+func (p *Preparer) readJournal(podID string) (*Journal, error) {
+	contents, err := ioutil.ReadFile(p.journalPath(podID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	journal := &Journal{}
+	err = yaml.Unmarshal(contents, journal)
+	if err != nil {
+		return nil, util.Errorf("could not parse journal for %s: %s", podID, err)
+	}
+	return journal, nil
+}
+
+// pair reconstructs the manifests that were being transitioned.
+func (j *Journal) pair(podID string) (ManifestPair, error) {
+	pair := ManifestPair{ID: podID}
+	intent, err := pods.ManifestFromBytes([]byte(j.Intent))
+	if err != nil {
+		return pair, util.Errorf("journaled intent is invalid: %s", err)
+	}
+	pair.Intent = intent
+	if j.Reality != "" {
+		reality, err := pods.ManifestFromBytes([]byte(j.Reality))
+		if err != nil {
+			return pair, util.Errorf("journaled reality is invalid: %s", err)
+		}
+		pair.Reality = reality
+	}
+	return pair, nil
+}
+
+// ResumeTransitions finds every pod with a journal whose transition was interrupted,
+// for example by a preparer crash, and either finishes it or rolls it back. It should
+// be called once at startup, before pod manifests are watched.
+func (p *Preparer) ResumeTransitions() {
+	entries, err := ioutil.ReadDir(p.journalDir)
+	if err != nil {
+		p.Logger.WithError(err).Errorln("Could not list journals to resume transitions")
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !strings.HasSuffix(entry.Name(), journalExtension) {
+			continue
+		}
+		podID := strings.TrimSuffix(entry.Name(), journalExtension)
+		logger := p.Logger.SubLogger(logrus.Fields{"pod": podID})
+		journal, err := p.readJournal(podID)
+		if err != nil {
+			logger.WithError(err).Errorln("Could not read transition journal")
+			continue
+		}
+		if journal == nil || journal.Phase == JournalRolledBack {
+			continue
+		}
+		pod := p.newPod(podID)
+		p.resumeTransition(podID, journal, pod, logger)
+	}
+}
+
+func (p *Preparer) resumeTransition(podID string, journal *Journal, pod Pod, logger logging.Logger) {
+	pair, err := journal.pair(podID)
+	if err != nil {
+		logger.WithError(err).Errorln("Discarding unreadable transition journal")
+		p.discardJournal(podID, logger)
+		return
+	}
+	logger = logger.SubLogger(logrus.Fields{"journal_phase": journal.Phase})
+	resumable, err := p.resumable(pair, logger)
+	if err != nil {
+		// keep the journal so that the next startup checks it again
+		logger.WithError(err).Errorln("Could not check transition journal")
+		return
+	} else if !resumable {
+		p.discardJournal(podID, logger)
+		return
+	}
+	logger.NoFields().Infoln("Resuming interrupted pod transition")
+
+	switch journal.Phase {
+	case JournalLaunched:
+		// the intent is already running, only the reality write is missing
+		p.finishTransition(pair, pod, logger)
+		return
+	case JournalInstalled:
+		if pair.Reality != nil {
+			success, err := pod.Halt(pair.Reality)
+			if err != nil {
+				logger.WithError(err).Errorln("Pod halt failed")
+			} else if !success {
+				logger.NoFields().Warnln("One or more launchables did not halt successfully")
+			}
+		}
+	case JournalHalted:
+	default:
+		logger.NoFields().Errorln("Discarding transition journal with unknown phase")
+		p.discardJournal(podID, logger)
+		return
+	}
+
+	// the reality is halted at this point, so something has to be launched
+	_, err = pod.Launch(pair.Intent)
+	if err == nil {
+		p.finishTransition(pair, pod, logger)
+		return
+	}
+	logger.WithError(err).Errorln("Launch of journaled intent failed, rolling back")
+
+	if pair.Reality != nil {
+		_, err = pod.Launch(pair.Reality)
+		if err != nil {
+			// nothing is running, so the reality store must not claim otherwise
+			logger.WithError(err).Errorln("Rollback to journaled reality failed")
+			dur, err := p.store.DeletePod(kp.RealityPath(p.node, podID))
+			if err != nil {
+				logger.WithErrorAndFields(err, logrus.Fields{"duration": dur}).
+					Errorln("Could not delete pod from reality store")
+				return
+			}
+		}
+	}
+	p.discardJournal(podID, logger)
+}
+
+// resumable returns true if the journaled transition may be resumed: its intent must
+// still be the pod's intent, its reality must still be in the reality store, and the
+// intent must pass the same checks as any other intent. Otherwise the journal is
+// stale or was not written by the preparer.
+func (p *Preparer) resumable(pair ManifestPair, logger logging.Logger) (bool, error) {
+	intent, _, err := p.store.Pod(kp.IntentPath(p.node, pair.ID))
+	if err != nil && err != pods.NoCurrentManifest {
+		return false, err
+	}
+	if !sameManifest(intent, pair.Intent) {
+		logger.NoFields().Warnln("Discarding transition journal whose intent is no longer the pod's intent")
+		return false, nil
+	}
+	reality, _, err := p.store.Pod(kp.RealityPath(p.node, pair.ID))
+	if err != nil && err != pods.NoCurrentManifest {
+		return false, err
+	}
+	if !sameManifest(reality, pair.Reality) {
+		logger.NoFields().Warnln("Discarding transition journal whose reality is not in the reality store")
+		return false, nil
+	}
+
+	reason, err := p.blocked(pair)
+	if err != nil {
+		return false, err
+	} else if reason != "" {
+		logger.WithField("reason", reason).Errorln("Discarding transition journal with a blocklisted intent")
+		return false, nil
+	}
+	if !p.authorize(pair.Intent, logger) {
+		logger.NoFields().Errorln("Discarding transition journal with an unauthorized intent")
+		return false, nil
+	}
+	return true, nil
+}
+
+// sameManifest returns true if both manifests are nil or have the same SHA.
+func sameManifest(a, b pods.Manifest) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	aSHA, err := a.SHA()
+	if err != nil {
+		return false
+	}
+	bSHA, err := b.SHA()
+	return err == nil && aSHA == bSHA
+}
+
+func (p *Preparer) finishTransition(pair ManifestPair, pod Pod, logger logging.Logger) {
+	duration, err := p.store.SetPod(kp.RealityPath(p.node, pair.ID), pair.Intent)
+	if err != nil {
+		// keep the journal so that the next startup tries again
+		logger.WithErrorAndFields(err, logrus.Fields{
+			"duration": duration}).
+			Errorln("Could not set pod in reality store")
+		return
+	}
+	p.discardJournal(pair.ID, logger)
+	p.tryRunHooks(hooks.AFTER_LAUNCH, pod, pair.Intent, logger)
+}
+
+func (p *Preparer) discardJournal(podID string, logger logging.Logger) {
+	err := p.removeJournal(podID)
+	if err != nil {
+		logger.WithError(err).Errorln("Could not remove transition journal")
+	}
+}
+
+func (p *Preparer) tryWriteJournal(pair ManifestPair, phase JournalPhase, logger logging.Logger) {
+	err := p.writeJournal(pair, phase)
+	if err != nil {
+		logger.WithError(err).Errorln("Could not write transition journal")
+	}
+}
@@ -0,0 +1,213 @@
+package preparer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	"github.com/square/p2/pkg/auth"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+)
+
+func updatePair(t *testing.T) ManifestPair {
+	manifest := testManifest(t)
+	builder := manifest.GetBuilder()
+	builder.SetStatusPort(1234)
+	return ManifestPair{ID: manifest.ID(), Intent: builder.GetManifest(), Reality: manifest}
+}
+
+// transitionStore returns a store whose intent and reality trees hold the pair, as
+// they do while the pair is being transitioned.
+func transitionStore(pair ManifestPair) *FakeStore {
+	return &FakeStore{manifests: map[string]pods.Manifest{
+		kp.IntentPath("hostname", pair.ID):  pair.Intent,
+		kp.RealityPath("hostname", pair.ID): pair.Reality,
+	}}
+}
+
+func TestSuccessfulTransitionRemovesJournal(t *testing.T) {
+	pair := updatePair(t)
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	success := p.resolvePair(pair, &TestPod{launchSuccess: true, haltSuccess: true}, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "transition should have succeeded")
+
+	journal, err := p.readJournal(pair.ID)
+	Assert(t).IsNil(err, "should have been able to check for a journal")
+	Assert(t).IsTrue(journal == nil, "journal should be removed once reality is written")
+}
+
+func TestFailedLaunchLeavesHaltedJournal(t *testing.T) {
+	pair := updatePair(t)
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchErr: fmt.Errorf("boom"), haltSuccess: true}
+	success := p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsFalse(success, "transition should have failed")
+
+	journal, err := p.readJournal(pair.ID)
+	Assert(t).IsNil(err, "should have been able to read the journal")
+	Assert(t).IsTrue(journal != nil, "journal should survive a failed launch")
+	Assert(t).AreEqual(journal.Phase, JournalHalted, "journal should record that the reality was halted")
+
+	journaled, err := journal.pair(pair.ID)
+	Assert(t).IsNil(err, "journaled manifests should parse")
+	intentSHA, _ := pair.Intent.SHA()
+	journaledSHA, _ := journaled.Intent.SHA()
+	Assert(t).AreEqual(journaledSHA, intentSHA, "journal should hold the intent manifest")
+	Assert(t).IsNotNil(journaled.Reality, "journal should hold the reality manifest")
+}
+
+func TestResumeLaunchedTransitionWritesReality(t *testing.T) {
+	pair := updatePair(t)
+	store := transitionStore(pair)
+	p, hooks, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	Assert(t).IsNil(p.writeJournal(pair, JournalLaunched), "should have written journal")
+	journal, _ := p.readJournal(pair.ID)
+	testPod := &TestPod{}
+	p.resumeTransition(pair.ID, journal, testPod, logging.DefaultLogger)
+
+	Assert(t).IsFalse(testPod.launched, "already launched pod should not be launched again")
+	Assert(t).AreEqual(len(store.setKeys), 1, "reality should have been written")
+	Assert(t).AreEqual(store.setKeys[0], kp.RealityPath(p.node, pair.ID), "wrong reality key written")
+	Assert(t).IsTrue(hooks.ranAfterLaunch, "after launch hooks should run once the transition finishes")
+	journal, _ = p.readJournal(pair.ID)
+	Assert(t).IsTrue(journal == nil, "journal should be removed")
+}
+
+func TestResumeHaltedTransitionLaunchesIntent(t *testing.T) {
+	pair := updatePair(t)
+	store := transitionStore(pair)
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	Assert(t).IsNil(p.writeJournal(pair, JournalHalted), "should have written journal")
+	journal, _ := p.readJournal(pair.ID)
+	testPod := &TestPod{launchSuccess: true}
+	p.resumeTransition(pair.ID, journal, testPod, logging.DefaultLogger)
+
+	Assert(t).IsFalse(testPod.halted, "halted pod should not be halted again")
+	Assert(t).IsTrue(testPod.launched, "intent should have been launched")
+	launchedSHA, _ := testPod.currentManifest.SHA()
+	intentSHA, _ := pair.Intent.SHA()
+	Assert(t).AreEqual(launchedSHA, intentSHA, "the intent should be the launched manifest")
+	Assert(t).AreEqual(len(store.setKeys), 1, "reality should have been written")
+}
+
+func TestResumeClearsRealityWhenNothingRuns(t *testing.T) {
+	pair := updatePair(t)
+	store := transitionStore(pair)
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	Assert(t).IsNil(p.writeJournal(pair, JournalInstalled), "should have written journal")
+	journal, _ := p.readJournal(pair.ID)
+	testPod := &TestPod{launchErr: fmt.Errorf("boom"), haltSuccess: true}
+	p.resumeTransition(pair.ID, journal, testPod, logging.DefaultLogger)
+
+	Assert(t).IsTrue(testPod.halted, "reality should be halted before launching the intent")
+	launchedSHA, _ := testPod.currentManifest.SHA()
+	realitySHA, _ := pair.Reality.SHA()
+	Assert(t).AreEqual(launchedSHA, realitySHA, "rollback to the reality should have been attempted")
+	Assert(t).AreEqual(len(store.setKeys), 0, "reality should not claim the intent is running")
+	Assert(t).AreEqual(len(store.deletedKeys), 1, "reality should be deleted when nothing is running")
+	journal, _ = p.readJournal(pair.ID)
+	Assert(t).IsTrue(journal == nil, "journal should be removed")
+}
+
+func TestJournalIsKeptOutOfPodHome(t *testing.T) {
+	pair := updatePair(t)
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	Assert(t).IsNil(p.writeJournal(pair, JournalHalted), "should have written journal")
+	podHome := pods.PodPath(p.podRoot, pair.ID) + string(filepath.Separator)
+	Assert(t).IsFalse(filepath.HasPrefix(p.journalPath(pair.ID), podHome), "the journal should not be in the pod home")
+	info, err := os.Stat(p.journalDir)
+	Assert(t).IsNil(err, "the journal directory should exist")
+	Assert(t).AreEqual(info.Mode().Perm(), os.FileMode(0700), "the journal directory should only be accessible to the preparer")
+
+	// a symlink planted at the temp path is replaced, not written through
+	target := filepath.Join(fakePodRoot, "target")
+	err = os.Symlink(target, p.journalPath(pair.ID)+".tmp")
+	Assert(t).IsNil(err, "test setup: could not plant symlink")
+	Assert(t).IsNil(p.writeJournal(pair, JournalLaunched), "should have written journal")
+	_, err = os.Stat(target)
+	Assert(t).IsTrue(os.IsNotExist(err), "the journal should not be written through a symlink")
+}
+
+func TestResumeDiscardsTamperedJournal(t *testing.T) {
+	pair := updatePair(t)
+	store := transitionStore(pair)
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	// an intent that was never in the intent tree
+	builder := pair.Intent.GetBuilder()
+	builder.SetRunAsUser("root")
+	tampered := pair
+	tampered.Intent = builder.GetManifest()
+	Assert(t).IsNil(p.writeJournal(tampered, JournalHalted), "should have written journal")
+	journal, _ := p.readJournal(pair.ID)
+	testPod := &TestPod{launchSuccess: true}
+	p.resumeTransition(pair.ID, journal, testPod, logging.DefaultLogger)
+
+	Assert(t).IsFalse(testPod.launched, "a journaled intent that is not the pod's intent should not be launched")
+	Assert(t).AreEqual(len(store.setKeys), 0, "reality should not be written")
+	journal, _ = p.readJournal(pair.ID)
+	Assert(t).IsTrue(journal == nil, "the tampered journal should be discarded")
+}
+
+func TestResumeDiscardsUnauthorizedJournal(t *testing.T) {
+	pair := updatePair(t)
+	store := transitionStore(pair)
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+	// only signed manifests are authorized
+	p.authPolicy = auth.FixedKeyringPolicy{}
+
+	Assert(t).IsNil(p.writeJournal(pair, JournalLaunched), "should have written journal")
+	journal, _ := p.readJournal(pair.ID)
+	testPod := &TestPod{launchSuccess: true}
+	p.resumeTransition(pair.ID, journal, testPod, logging.DefaultLogger)
+
+	Assert(t).IsFalse(testPod.launched, "an unauthorized intent should not be launched")
+	Assert(t).AreEqual(len(store.setKeys), 0, "an unauthorized intent should not be written to reality")
+	journal, _ = p.readJournal(pair.ID)
+	Assert(t).IsTrue(journal == nil, "the unauthorized journal should be discarded")
+}
+
+func TestResumeDiscardsBlockedJournal(t *testing.T) {
+	pair := updatePair(t)
+	store := transitionStore(pair)
+	sha, _ := pair.Intent.SHA()
+	store.blocked = map[string]string{sha: "bad release"}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	Assert(t).IsNil(p.writeJournal(pair, JournalHalted), "should have written journal")
+	journal, _ := p.readJournal(pair.ID)
+	testPod := &TestPod{launchSuccess: true}
+	p.resumeTransition(pair.ID, journal, testPod, logging.DefaultLogger)
+
+	Assert(t).IsFalse(testPod.launched, "a blocklisted intent should not be launched")
+	journal, _ = p.readJournal(pair.ID)
+	Assert(t).IsTrue(journal == nil, "the blocklisted journal should be discarded")
+}
@@ -22,6 +22,8 @@ type HookListener struct {
 	ExecDir        string // The directory that will actually be executed by the HookDir
 	Logger         logging.Logger
 	authPolicy     auth.Policy
+	// returns the hook pod with the given ID at a path, pods.NewPod if nil
+	newPod func(id string, path string) *pods.Pod
 }
 
 // Sync keeps manifests located at the hook pods in the intent store.
@@ -76,7 +78,11 @@ func (l *HookListener) installHook(result kp.ManifestResult) error {
 		return err
 	}
 
-	hookPod := pods.NewPod(result.Manifest.ID(), filepath.Join(l.DestinationDir, result.Manifest.ID()))
+	newPod := l.newPod
+	if newPod == nil {
+		newPod = pods.NewPod
+	}
+	hookPod := newPod(result.Manifest.ID(), filepath.Join(l.DestinationDir, result.Manifest.ID()))
 
 	// Figure out if we even need to install anything.
 	// Hooks aren't running services and so there isn't a need
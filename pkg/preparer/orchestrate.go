@@ -1,6 +1,7 @@
 package preparer
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
@@ -36,6 +37,13 @@ type Store interface {
 	Pod(key string) (pods.Manifest, time.Duration, error)
 	DeletePod(key string) (time.Duration, error)
 	WatchPods(string, <-chan struct{}, chan<- error, chan<- []kp.ManifestResult)
+	GetHealth(service, node string) (kp.WatchResult, error)
+	PutEvent(kp.Event) (time.Duration, error)
+	IntentOverridden(node string) (bool, error)
+	ManifestBlocked(sha string) (bool, string, error)
+	SetPrestageStatus(node, podID string, status kp.PrestageStatus) error
+	PrestageStatus(node, podID string) (kp.PrestageStatus, bool, error)
+	DeletePrestageStatus(node, podID string) error
 }
 
 func (p *Preparer) WatchForHooks(quit chan struct{}) {
@@ -91,7 +99,10 @@ func (p *Preparer) WatchForPodManifestsForNode(quitAndAck chan struct{}) {
 					p.Logger.NoFields().Errorln("Intent results set did not contain p2-preparer pod ID, consul data may be corrupted")
 				} else {
 					resultPairs := ZipResultSets(intentResults, realityResults)
+					resultPairs, withheld, reason := p.limitUninstalls(resultPairs, len(realityResults))
+					p.refuseUninstalls(withheld, reason)
 					for _, pair := range resultPairs {
+						p.refusals.clear(pair.ID, UninstallLimitEventType)
 						if _, ok := podChanMap[pair.ID]; !ok {
 							// spin goroutine for this pod
 							podChanMap[pair.ID] = make(chan ManifestPair)
@@ -124,6 +135,29 @@ func (p *Preparer) tryRunHooks(hookType hooks.HookType, pod hooks.Pod, manifest
 	}
 }
 
+// newPod returns the pod with the given ID in the preparer's pod root.
+func (p *Preparer) newPod(id string) *pods.Pod {
+	pod := p.newPodAt(id, pods.PodPath(p.podRoot, id))
+	// TODO better solution: force the preparer to have a 0s default timeout, prevent KILLs
+	if pod.Id == POD_ID {
+		pod.DefaultTimeout = time.Duration(0)
+	}
+	return pod
+}
+
+// newPodAt returns the pod with the given ID at the path, which fetches its artifacts
+// and secrets as the preparer is configured to.
+func (p *Preparer) newPodAt(id string, path string) *pods.Pod {
+	pod := pods.NewPod(id, path)
+	pod.SecretProviders = p.secretProviders
+	pod.ArtifactFetcher = p.artifactFetcher
+	p.configLock.RLock()
+	pod.MirrorRewrites = p.mirrorRewrites
+	pod.ArtifactRegistry = p.artifactRegistry
+	p.configLock.RUnlock()
+	return pod
+}
+
 // no return value, no output channels. This should do everything it needs to do
 // without outside intervention (other than being signalled to quit)
 func (p *Preparer) handlePods(podChan <-chan ManifestPair, quit <-chan struct{}) {
@@ -159,17 +193,12 @@ func (p *Preparer) handlePods(podChan <-chan ManifestPair, quit <-chan struct{})
 				// non-nil intent manifests need to be authorized first
 				working = p.authorize(nextLaunch.Intent, manifestLogger)
 				if !working {
-					p.tryRunHooks(hooks.AFTER_AUTH_FAIL, pods.NewPod(nextLaunch.ID, pods.PodPath(p.podRoot, nextLaunch.ID)), nextLaunch.Intent, manifestLogger)
+					p.tryRunHooks(hooks.AFTER_AUTH_FAIL, p.newPod(nextLaunch.ID), nextLaunch.Intent, manifestLogger)
 				}
 			}
 		case <-time.After(1 * time.Second):
 			if working {
-				pod := pods.NewPod(nextLaunch.ID, pods.PodPath(p.podRoot, nextLaunch.ID))
-
-				// TODO better solution: force the preparer to have a 0s default timeout, prevent KILLs
-				if pod.Id == POD_ID {
-					pod.DefaultTimeout = time.Duration(0)
-				}
+				pod := p.newPod(nextLaunch.ID)
 
 				// podChan is being fed values gathered from a kp.Watch() in
 				// WatchForPodManifestsForNode(). If the watch returns a new pair of
@@ -195,7 +224,9 @@ func (p *Preparer) handlePods(podChan <-chan ManifestPair, quit <-chan struct{})
 					nextLaunch.Reality = reality
 				}
 
+				unlock := p.podLocks.lock(nextLaunch.ID)
 				ok := p.resolvePair(nextLaunch, pod, manifestLogger)
+				unlock()
 				if ok {
 					nextLaunch = ManifestPair{}
 					working = false
@@ -250,9 +281,30 @@ func (p *Preparer) resolvePair(pair ManifestPair, pod Pod, logger logging.Logger
 }
 
 func (p *Preparer) installAndLaunchPod(pair ManifestPair, pod Pod, logger logging.Logger) bool {
+	if p.rolledBack(pair) {
+		logger.NoFields().Debugln("manifest was rolled back, waiting for a new intent")
+		return true
+	}
+
+	reason, err := p.blocked(pair)
+	if err != nil {
+		logger.WithError(err).Errorln("Could not check manifest blocklist")
+		return false
+	} else if reason != "" {
+		// the refusal is final until the intent or the reason changes, so it is only
+		// reported once
+		sha, _ := pair.Intent.SHA()
+		if p.refusals.changed(pair.ID, refusal{BlockedManifestEventType, sha, reason}) {
+			logger.WithField("reason", reason).Errorln("Refusing to install blocklisted manifest")
+			p.reportEvent(pair.ID, BlockedManifestEventType, reason, logger)
+		}
+		return true
+	}
+	p.refusals.clear(pair.ID, BlockedManifestEventType)
+
 	p.tryRunHooks(hooks.BEFORE_INSTALL, pod, pair.Intent, logger)
 
-	err := pod.Install(pair.Intent)
+	err = pod.Install(pair.Intent)
 	if err != nil {
 		// install failed, abort and retry
 		logger.WithError(err).Errorln("Install failed")
@@ -269,6 +321,14 @@ func (p *Preparer) installAndLaunchPod(pair ManifestPair, pod Pod, logger loggin
 
 	p.tryRunHooks(hooks.AFTER_INSTALL, pod, pair.Intent, logger)
 
+	// the journal lets ResumeTransitions finish or roll back this transition if
+	// the preparer dies before the reality store is updated
+	err = p.writeJournal(pair, JournalInstalled)
+	if err != nil {
+		logger.WithError(err).Errorln("Could not write transition journal")
+		return false
+	}
+
 	if pair.Reality != nil {
 		success, err := pod.Halt(pair.Reality)
 		if err != nil {
@@ -278,29 +338,43 @@ func (p *Preparer) installAndLaunchPod(pair ManifestPair, pod Pod, logger loggin
 			logger.NoFields().Warnln("One or more launchables did not halt successfully")
 		}
 	}
+	p.tryWriteJournal(pair, JournalHalted, logger)
 
 	p.tryRunHooks(hooks.BEFORE_LAUNCH, pod, pair.Intent, logger)
 
+	launchTime := time.Now()
 	ok, err := pod.Launch(pair.Intent)
 	if err != nil {
 		logger.WithError(err).
 			Errorln("Launch failed")
+		if p.recordLaunchFailure(pair, logger) {
+			return p.rollback(pair, pod, fmt.Sprintf("launch failed: %s", err), logger)
+		}
 	} else {
+		p.tryWriteJournal(pair, JournalLaunched, logger)
 		duration, err := p.store.SetPod(kp.RealityPath(p.node, pair.ID), pair.Intent)
 		if err != nil {
 			logger.WithErrorAndFields(err, logrus.Fields{
 				"duration": duration}).
 				Errorln("Could not set pod in reality store")
+		} else {
+			p.discardJournal(pair.ID, logger)
+			p.clearInstalledPrestage(pair, logger)
 		}
 
 		p.tryRunHooks(hooks.AFTER_LAUNCH, pod, pair.Intent, logger)
 
-		pod.Prune(p.maxLaunchableDiskUsage, pair.Intent) // errors are logged internally
+		pod.Prune(p.getMaxLaunchableDiskUsage(), pair.Intent) // errors are logged internally
+
+		if !p.waitForHealth(pair, launchTime, logger) {
+			return p.rollback(pair, pod, "health check did not pass in time", logger)
+		}
 	}
 	return err == nil && ok
 }
 
 func (p *Preparer) stopAndUninstallPod(pair ManifestPair, pod Pod, logger logging.Logger) bool {
+	p.refusals.clear(pair.ID, UninstallLimitEventType)
 	success, err := pod.Halt(pair.Reality)
 	if err != nil {
 		logger.WithError(err).Errorln("Pod halt failed")
@@ -316,6 +390,8 @@ func (p *Preparer) stopAndUninstallPod(pair ManifestPair, pod Pod, logger loggin
 		return false
 	}
 	logger.NoFields().Infoln("Successfully uninstalled")
+	// the journal is not in the pod home, so it does not go away with it
+	p.discardJournal(pair.ID, logger)
 
 	dur, err := p.store.DeletePod(kp.RealityPath(p.node, pair.ID))
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
@@ -18,6 +19,7 @@ import (
 	"github.com/square/p2/pkg/kp"
 	"github.com/square/p2/pkg/logging"
 	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/secrets"
 	"github.com/square/p2/pkg/util"
 	"github.com/square/p2/pkg/util/size"
 )
@@ -26,6 +28,8 @@ type TestPod struct {
 	currentManifest                                                      pods.Manifest
 	installed, uninstalled, launched, launchSuccess, halted, haltSuccess bool
 	installErr, uninstallErr, launchErr, haltError, currentManifestError error
+	prestaged                                                            bool
+	prestageErr                                                          error
 	configDir, envDir                                                    string
 }
 
@@ -56,6 +60,11 @@ func (t *TestPod) Uninstall() error {
 	return t.uninstallErr
 }
 
+func (t *TestPod) Prestage(manifest pods.Manifest) error {
+	t.prestaged = true
+	return t.prestageErr
+}
+
 func (t *TestPod) Verify(manifest pods.Manifest, authPolicy auth.Policy) error {
 	return nil
 }
@@ -157,6 +166,14 @@ func testSignedManifest(t *testing.T, modify func(pods.ManifestBuilder, *openpgp
 type FakeStore struct {
 	currentManifest      pods.Manifest
 	currentManifestError error
+	setKeys, deletedKeys []string
+	healthStatus         string
+	healthTime           time.Time
+	events               []kp.Event
+	overridden           bool
+	blocked              map[string]string
+	prestageStatuses     map[string]kp.PrestageStatus
+	manifests            map[string]pods.Manifest
 }
 
 func (f *FakeStore) ListPods(string) ([]kp.ManifestResult, time.Duration, error) {
@@ -171,27 +188,76 @@ func (f *FakeStore) ListPods(string) ([]kp.ManifestResult, time.Duration, error)
 	}, 0, nil
 }
 
-func (f *FakeStore) SetPod(string, pods.Manifest) (time.Duration, error) {
+func (f *FakeStore) SetPod(key string, _ pods.Manifest) (time.Duration, error) {
+	f.setKeys = append(f.setKeys, key)
 	return 0, nil
 }
 
 func (f *FakeStore) Pod(key string) (pods.Manifest, time.Duration, error) {
-	return nil, 0, fmt.Errorf("not implemented")
+	manifest, ok := f.manifests[key]
+	if !ok {
+		return nil, 0, pods.NoCurrentManifest
+	}
+	return manifest, 0, nil
 }
 
-func (f *FakeStore) DeletePod(string) (time.Duration, error) {
+func (f *FakeStore) DeletePod(key string) (time.Duration, error) {
+	f.deletedKeys = append(f.deletedKeys, key)
+	delete(f.manifests, key)
 	return 0, nil
 }
 
 func (f *FakeStore) WatchPods(string, <-chan struct{}, chan<- error, chan<- []kp.ManifestResult) {}
 
+func (f *FakeStore) GetHealth(service, node string) (kp.WatchResult, error) {
+	healthTime := f.healthTime
+	if healthTime.IsZero() {
+		healthTime = time.Now()
+	}
+	return kp.WatchResult{Service: service, Node: node, Status: f.healthStatus, Time: healthTime}, nil
+}
+
+func (f *FakeStore) IntentOverridden(node string) (bool, error) {
+	return f.overridden, nil
+}
+
+func (f *FakeStore) ManifestBlocked(sha string) (bool, string, error) {
+	reason, ok := f.blocked[sha]
+	return ok, reason, nil
+}
+
+func (f *FakeStore) SetPrestageStatus(node, podID string, status kp.PrestageStatus) error {
+	if f.prestageStatuses == nil {
+		f.prestageStatuses = make(map[string]kp.PrestageStatus)
+	}
+	f.prestageStatuses[podID] = status
+	return nil
+}
+
+func (f *FakeStore) PrestageStatus(node, podID string) (kp.PrestageStatus, bool, error) {
+	status, ok := f.prestageStatuses[podID]
+	return status, ok, nil
+}
+
+func (f *FakeStore) DeletePrestageStatus(node, podID string) error {
+	delete(f.prestageStatuses, podID)
+	return nil
+}
+
+func (f *FakeStore) PutEvent(event kp.Event) (time.Duration, error) {
+	f.events = append(f.events, event)
+	return 0, nil
+}
+
+// testPreparer returns a preparer whose pod root and journal directory are in a new
+// temporary directory, which is returned for the caller to remove.
 func testPreparer(t *testing.T, f *FakeStore) (*Preparer, *fakeHooks, string) {
-	podRoot, _ := ioutil.TempDir("", "pod_root")
+	root, _ := ioutil.TempDir("", "pod_root")
 	cfg := &PreparerConfig{
 		NodeName:       "hostname",
 		ConsulAddress:  "0.0.0.0",
 		HooksDirectory: util.From(runtime.Caller(0)).ExpandPath("test_hooks"),
-		PodRoot:        podRoot,
+		PodRoot:        filepath.Join(root, "pods"),
 		Auth:           map[string]interface{}{"type": "none"},
 	}
 	p, err := New(cfg, logging.DefaultLogger)
@@ -199,7 +265,7 @@ func testPreparer(t *testing.T, f *FakeStore) (*Preparer, *fakeHooks, string) {
 	hooks := &fakeHooks{}
 	p.hooks = hooks
 	p.store = f
-	return p, hooks, podRoot
+	return p, hooks, root
 }
 
 func TestPreparerLaunchesNewPodsThatArentInstalledYet(t *testing.T) {
@@ -304,6 +370,26 @@ func TestPreparerWillLaunchPreparerAsRoot(t *testing.T) {
 	Assert(t).IsFalse(hooks.ranAfterAuthFail, "Should not have run after_auth_fail hooks")
 }
 
+func TestNewPodNeverTimesOutThePreparer(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	Assert(t).AreEqual(p.newPod(POD_ID).DefaultTimeout, time.Duration(0), "the preparer should not be killed when it is stopped")
+	Assert(t).AreNotEqual(p.newPod("hello").DefaultTimeout, time.Duration(0), "other pods should have the default timeout")
+}
+
+func TestNewPodUsesThePreparersSecretProviders(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+	p.secretProviders = secrets.Providers{"vault": secrets.FileProvider{Root: fakePodRoot}}
+
+	_, ok := p.newPod("hello").SecretProviders["vault"]
+	Assert(t).IsTrue(ok, "the pod should use the providers from the preparer's config")
+	Assert(t).AreEqual(len(secrets.DefaultProviders), 0, "the default providers should not be changed")
+}
+
 func TestPreparerWillNotInstallOrLaunchIfSHAIsTheSame(t *testing.T) {
 	testManifest := testManifest(t)
 	newPair := ManifestPair{
@@ -0,0 +1,143 @@
+package preparer
+
+import (
+	"fmt"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/digest"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/util"
+)
+
+// PlanAction describes what the preparer would do with a single pod.
+type PlanAction string
+
+const (
+	PlanInstall   PlanAction = "install"
+	PlanUpdate    PlanAction = "update"
+	PlanUninstall PlanAction = "uninstall"
+	PlanReject    PlanAction = "reject"
+	PlanNone      PlanAction = "none"
+)
+
+// PlanEntry is the planned outcome for one pod on this node.
+type PlanEntry struct {
+	ID     string     `json:"id"`
+	Action PlanAction `json:"action"`
+	OldSHA string     `json:"old_sha,omitempty"`
+	NewSHA string     `json:"new_sha,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+}
+
+// A Plan lists the actions the preparer would take to reconcile the intent and reality
+// trees of its node. Computing a plan never executes launchables or hooks.
+type Plan struct {
+	Node    string      `json:"node"`
+	Entries []PlanEntry `json:"entries"`
+}
+
+// Plan reads the current intent and reality for this node and reports what the preparer
+// would do with each pod, including authorization and digest signature checks, without
+// changing anything on the host.
+func (p *Preparer) Plan() (Plan, error) {
+	intentResults, _, err := p.store.ListPods(kp.IntentPath(p.node))
+	if err != nil {
+		return Plan{}, util.Errorf("could not read intent: %s", err)
+	}
+	realityResults, _, err := p.store.ListPods(kp.RealityPath(p.node))
+	if err != nil {
+		return Plan{}, util.Errorf("could not read reality: %s", err)
+	}
+	if !checkResultsForID(intentResults, POD_ID) {
+		return Plan{}, util.Errorf("intent results set did not contain %s pod ID, consul data may be corrupted", POD_ID)
+	}
+	pairs := ZipResultSets(intentResults, realityResults)
+	allowed, withheld, reason := p.limitUninstalls(pairs, len(realityResults))
+	entries := p.planPairs(allowed)
+	for _, pair := range withheld {
+		entry := p.planPair(pair)
+		entry.Action = PlanReject
+		entry.Reason = fmt.Sprintf("uninstall refused: %s", reason)
+		entries = append(entries, entry)
+	}
+	return Plan{
+		Node:    p.node,
+		Entries: entries,
+	}, nil
+}
+
+func (p *Preparer) planPairs(pairs []ManifestPair) []PlanEntry {
+	entries := make([]PlanEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		entries = append(entries, p.planPair(pair))
+	}
+	return entries
+}
+
+func (p *Preparer) planPair(pair ManifestPair) PlanEntry {
+	entry := PlanEntry{ID: pair.ID}
+	if pair.Reality != nil {
+		entry.OldSHA, _ = pair.Reality.SHA()
+	}
+	if pair.Intent != nil {
+		entry.NewSHA, _ = pair.Intent.SHA()
+	}
+
+	switch {
+	case entry.NewSHA == "":
+		entry.Action = PlanUninstall
+		return entry
+	case entry.OldSHA == entry.NewSHA:
+		entry.Action = PlanNone
+		return entry
+	case entry.OldSHA == "":
+		entry.Action = PlanInstall
+	default:
+		entry.Action = PlanUpdate
+	}
+
+	if p.rolledBack(pair) {
+		entry.Action = PlanNone
+		entry.Reason = "manifest was rolled back after failing on this node"
+		return entry
+	}
+
+	reason, err := p.blocked(pair)
+	if err != nil {
+		entry.Action = PlanReject
+		entry.Reason = fmt.Sprintf("could not check manifest blocklist: %s", err)
+		return entry
+	} else if reason != "" {
+		entry.Action = PlanReject
+		entry.Reason = reason
+		return entry
+	}
+
+	logger := p.Logger.SubLogger(logrus.Fields{"pod": pair.ID, "plan": true})
+	err = p.authPolicy.AuthorizeApp(pair.Intent, logger)
+	if err != nil {
+		entry.Action = PlanReject
+		entry.Reason = fmt.Sprintf("authorization failed: %s", err)
+		return entry
+	}
+
+	for key, stanza := range pair.Intent.GetLaunchableStanzas() {
+		if stanza.DigestLocation == "" {
+			continue
+		}
+		launchableDigest, err := digest.ParseUris(
+			p.fetcher,
+			stanza.DigestLocation,
+			stanza.DigestSignatureLocation,
+		)
+		if err == nil {
+			err = p.authPolicy.CheckDigest(launchableDigest)
+		}
+		if err != nil {
+			entry.Action = PlanReject
+			entry.Reason = fmt.Sprintf("digest check failed for launchable %s: %s", key, err)
+			return entry
+		}
+	}
+	return entry
+}
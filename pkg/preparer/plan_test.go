@@ -0,0 +1,66 @@
+package preparer
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	"github.com/square/p2/pkg/auth"
+)
+
+func TestPlanReportsEveryAction(t *testing.T) {
+	manifest := testManifest(t)
+	builder := manifest.GetBuilder()
+	builder.SetID("other")
+	other := builder.GetManifest()
+	changedBuilder := manifest.GetBuilder()
+	changedBuilder.SetStatusPort(1234)
+	changed := changedBuilder.GetManifest()
+
+	p, hooks, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	entries := p.planPairs([]ManifestPair{
+		{ID: manifest.ID(), Intent: changed, Reality: manifest},
+		{ID: "other", Intent: other},
+		{ID: "gone", Reality: podWithID("gone")},
+		{ID: "same", Intent: podWithID("same"), Reality: podWithID("same")},
+	})
+
+	Assert(t).AreEqual(len(entries), 4, "expected an entry for every pair")
+	Assert(t).AreEqual(entries[0].Action, PlanUpdate, "changed manifest should be updated")
+	Assert(t).AreNotEqual(entries[0].OldSHA, entries[0].NewSHA, "update should report both SHAs")
+	Assert(t).AreEqual(entries[1].Action, PlanInstall, "new manifest should be installed")
+	Assert(t).AreEqual(entries[2].Action, PlanUninstall, "missing intent should be uninstalled")
+	Assert(t).AreEqual(entries[3].Action, PlanNone, "unchanged manifest needs no action")
+	Assert(t).IsFalse(hooks.ranBeforeInstall, "planning should not run hooks")
+}
+
+func TestPlanRejectsUnauthorizedManifests(t *testing.T) {
+	manifest := testManifest(t)
+
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+	p.authPolicy = auth.FixedKeyringPolicy{}
+
+	entries := p.planPairs([]ManifestPair{{ID: manifest.ID(), Intent: manifest}})
+	Assert(t).AreEqual(entries[0].Action, PlanReject, "unsigned manifest should be rejected")
+	Assert(t).AreNotEqual(entries[0].Reason, "", "rejection should have a reason")
+}
+
+func TestPlanRequiresPreparerInIntent(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{currentManifest: podWithID("hello")})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	_, err := p.Plan()
+	Assert(t).IsNotNil(err, "plan should refuse an intent set without the preparer")
+
+	p.store = &FakeStore{currentManifest: podWithID(POD_ID)}
+	plan, err := p.Plan()
+	Assert(t).IsNil(err, "plan should have succeeded")
+	Assert(t).AreEqual(plan.Node, "hostname", "plan should name its node")
+	Assert(t).AreEqual(plan.Entries[0].Action, PlanNone, "the same manifest in intent and reality needs no action")
+}
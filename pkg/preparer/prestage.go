@@ -0,0 +1,224 @@
+package preparer
+
+import (
+	"os"
+	"sync"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/auth"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/util"
+)
+
+// PrestagePod is a pod whose launchables can be fetched before the pod is installed.
+type PrestagePod interface {
+	Prestage(pods.Manifest) error
+	Verify(pods.Manifest, auth.Policy) error
+}
+
+// WatchForPrestages fetches and verifies the manifests in this node's pre-stage tree,
+// and reports whether each one is ready under the pre-stage status tree. Manifests are
+// never launched, they are only made ready so that installing them is quick when their
+// intent is set. A pod's pre-stage request and status are removed once the requested
+// manifest is installed.
+func (p *Preparer) WatchForPrestages(quit chan struct{}) {
+	quitChan := make(chan struct{})
+	errChan := make(chan error)
+	podChan := make(chan []kp.ManifestResult)
+	go p.store.WatchPods(kp.PrestagePath(p.node), quitChan, errChan, podChan)
+
+	// the pods that this preparer has reported a pre-stage status for
+	reported := make(map[string]bool)
+	for {
+		select {
+		case <-quit:
+			close(quitChan)
+			return
+		case err := <-errChan:
+			p.Logger.WithError(err).Errorln("Error reading pre-stage manifests")
+		case results := <-podChan:
+			p.prestageAll(results, reported)
+		}
+	}
+}
+
+// prestageAll pre-stages each manifest that is not ready yet. Readiness is read back
+// from the pre-stage status tree, so a restarted preparer does not fetch everything
+// again. Manifests that are already installed are not pre-staged, and their requests
+// are removed. Manifests that fail are tried again the next time the pre-stage tree
+// changes. When a request is removed before its pod is installed, the pre-staged files
+// are removed with it.
+func (p *Preparer) prestageAll(results []kp.ManifestResult, reported map[string]bool) {
+	present := make(map[string]bool)
+	for _, result := range results {
+		id := result.Manifest.ID()
+		present[id] = true
+		sha, err := result.Manifest.SHA()
+		if err != nil {
+			p.Logger.WithErrorAndFields(err, logrus.Fields{"pod": id}).Errorln("Could not compute pre-stage manifest SHA")
+			continue
+		}
+
+		logger := p.Logger.SubLogger(logrus.Fields{
+			"pod":      id,
+			"sha":      sha,
+			"prestage": true,
+		})
+		reality, _, err := p.store.Pod(kp.RealityPath(p.node, id))
+		if err == nil {
+			if realitySHA, _ := reality.SHA(); realitySHA == sha {
+				p.clearPrestage(id, logger)
+				delete(reported, id)
+				continue
+			}
+		} else if err != pods.NoCurrentManifest {
+			logger.WithError(err).Warnln("Could not read reality manifest")
+		}
+
+		last, ok, err := p.store.PrestageStatus(p.node, id)
+		if err != nil {
+			logger.WithError(err).Warnln("Could not read pre-stage status")
+		} else if ok && last.Ready && last.SHA == sha {
+			reported[id] = true
+			continue
+		}
+
+		pod := p.newPod(id)
+		status := kp.PrestageStatus{SHA: sha}
+		unlock := p.podLocks.lock(id)
+		err = p.prestage(result.Manifest, pod, logger)
+		unlock()
+		if err != nil {
+			logger.WithError(err).Errorln("Pre-stage failed")
+			status.Error = err.Error()
+		} else {
+			status.Ready = true
+		}
+
+		err = p.store.SetPrestageStatus(p.node, id, status)
+		if err != nil {
+			logger.WithError(err).Errorln("Could not report pre-stage status")
+			continue
+		}
+		reported[id] = true
+	}
+
+	for id := range reported {
+		if present[id] {
+			continue
+		}
+		logger := p.Logger.SubLogger(logrus.Fields{"pod": id, "prestage": true})
+		p.removeUnusedPrestage(id, logger)
+		err := p.store.DeletePrestageStatus(p.node, id)
+		if err != nil {
+			logger.WithError(err).Errorln("Could not remove pre-stage status")
+			continue
+		}
+		delete(reported, id)
+	}
+}
+
+// removeUnusedPrestage removes the home of a pod that was pre-staged but is neither in
+// this node's intent nor its reality, so that the pre-staged artifacts do not use disk
+// space forever. Uninstall only ever removes pods that are in the reality.
+func (p *Preparer) removeUnusedPrestage(podID string, logger logging.Logger) {
+	unlock := p.podLocks.lock(podID)
+	defer unlock()
+	for _, key := range []string{kp.IntentPath(p.node, podID), kp.RealityPath(p.node, podID)} {
+		_, _, err := p.store.Pod(key)
+		if err == nil {
+			return
+		} else if err != pods.NoCurrentManifest {
+			logger.WithErrorAndFields(err, logrus.Fields{"key": key}).Warnln("Could not check whether pre-staged pod is in use")
+			return
+		}
+	}
+	err := os.RemoveAll(pods.PodPath(p.podRoot, podID))
+	if err != nil {
+		logger.WithError(err).Errorln("Could not remove pre-staged pod")
+		return
+	}
+	logger.NoFields().Infoln("Removed pre-staged pod whose request was withdrawn")
+}
+
+// clearInstalledPrestage removes the pod's pre-stage request and status if the request
+// was for the manifest that was just installed.
+func (p *Preparer) clearInstalledPrestage(pair ManifestPair, logger logging.Logger) {
+	requested, _, err := p.store.Pod(kp.PrestagePath(p.node, pair.ID))
+	if err == pods.NoCurrentManifest {
+		return
+	} else if err != nil {
+		logger.WithError(err).Warnln("Could not read pre-stage request")
+		return
+	}
+	requestedSHA, _ := requested.SHA()
+	installedSHA, _ := pair.Intent.SHA()
+	if requestedSHA == installedSHA {
+		p.clearPrestage(pair.ID, logger)
+	}
+}
+
+// clearPrestage removes the pod's pre-stage request and status, so that the pre-stage
+// trees do not grow with every manifest that was ever pre-staged.
+func (p *Preparer) clearPrestage(podID string, logger logging.Logger) {
+	dur, err := p.store.DeletePod(kp.PrestagePath(p.node, podID))
+	if err != nil {
+		logger.WithErrorAndFields(err, logrus.Fields{"duration": dur}).Errorln("Could not remove pre-stage request")
+		return
+	}
+	err = p.store.DeletePrestageStatus(p.node, podID)
+	if err != nil {
+		logger.WithError(err).Errorln("Could not remove pre-stage status")
+	}
+}
+
+// prestage fetches and verifies the launchables of a manifest, subject to the same
+// authorization and blocklist as installing it.
+func (p *Preparer) prestage(manifest pods.Manifest, pod PrestagePod, logger logging.Logger) error {
+	if !p.authorize(manifest, logger) {
+		return util.Errorf("manifest is not authorized")
+	}
+	reason, err := p.blocked(ManifestPair{ID: manifest.ID(), Intent: manifest})
+	if err != nil {
+		return util.Errorf("could not check manifest blocklist: %s", err)
+	} else if reason != "" {
+		return util.Errorf("%s", reason)
+	}
+
+	err = pod.Prestage(manifest)
+	if err != nil {
+		return err
+	}
+	err = pod.Verify(manifest, p.authPolicy)
+	if err != nil {
+		return util.Errorf("digest verification failed: %s", err)
+	}
+	logger.NoFields().Infoln("Pre-staged manifest")
+	return nil
+}
+
+// podLocks serializes the changes that the preparer makes to each pod, so that a
+// pre-stage does not extract a launchable at the same time as an install of it.
+type podLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// lock locks the pod with the given ID and returns a function that unlocks it.
+func (l *podLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	podLock, ok := l.locks[id]
+	if !ok {
+		podLock = &sync.Mutex{}
+		l.locks[id] = podLock
+	}
+	l.mu.Unlock()
+
+	podLock.Lock()
+	return podLock.Unlock
+}
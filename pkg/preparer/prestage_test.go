@@ -0,0 +1,122 @@
+package preparer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/util"
+)
+
+func TestPrestage(t *testing.T) {
+	manifest := testManifest(t)
+	sha, _ := manifest.SHA()
+	store := &FakeStore{}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{}
+	err := p.prestage(manifest, testPod, logging.DefaultLogger)
+	Assert(t).IsNil(err, "pre-stage should have succeeded")
+	Assert(t).IsTrue(testPod.prestaged, "launchables should have been pre-staged")
+	Assert(t).IsFalse(testPod.installed, "pre-staging should not install the pod")
+	Assert(t).IsFalse(testPod.launched, "pre-staging should not launch the pod")
+
+	testPod = &TestPod{prestageErr: util.Errorf("could not fetch")}
+	err = p.prestage(manifest, testPod, logging.DefaultLogger)
+	Assert(t).IsNotNil(err, "pre-stage errors should be returned")
+
+	store.blocked = map[string]string{sha: "bad build"}
+	testPod = &TestPod{}
+	err = p.prestage(manifest, testPod, logging.DefaultLogger)
+	Assert(t).IsNotNil(err, "blocklisted manifests should not be pre-staged")
+	Assert(t).IsFalse(testPod.prestaged, "blocklisted manifests should not be fetched")
+}
+
+func TestPrestageAllSkipsReadyAndInstalledManifests(t *testing.T) {
+	manifest := testManifest(t)
+	sha, _ := manifest.SHA()
+	id := manifest.ID()
+	store := &FakeStore{
+		prestageStatuses: map[string]kp.PrestageStatus{id: {SHA: sha, Ready: true}},
+	}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+	results := []kp.ManifestResult{{Manifest: manifest}}
+
+	// a ready status from before a restart is not pre-staged again
+	reported := make(map[string]bool)
+	p.prestageAll(results, reported)
+	Assert(t).IsTrue(reported[id], "the existing status should be remembered")
+	Assert(t).AreEqual(store.prestageStatuses[id].Ready, true, "the status should be unchanged")
+
+	// once installed, the request and status are removed
+	store.manifests = map[string]pods.Manifest{
+		kp.RealityPath(p.node, id):  manifest,
+		kp.PrestagePath(p.node, id): manifest,
+	}
+	p.prestageAll(results, reported)
+	_, ok := store.prestageStatuses[id]
+	Assert(t).IsFalse(ok, "the status of an installed manifest should be removed")
+	_, ok = store.manifests[kp.PrestagePath(p.node, id)]
+	Assert(t).IsFalse(ok, "the request for an installed manifest should be removed")
+	Assert(t).IsFalse(reported[id], "the removed status should be forgotten")
+}
+
+func TestPrestageAllRemovesWithdrawnPrestages(t *testing.T) {
+	manifest := testManifest(t)
+	id := manifest.ID()
+	store := &FakeStore{prestageStatuses: make(map[string]kp.PrestageStatus)}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	// the pod home that pre-staging extracted the launchables into
+	podHome := pods.PodPath(p.podRoot, id)
+	err := os.MkdirAll(filepath.Join(podHome, "installs"), 0755)
+	Assert(t).IsNil(err, "test setup: could not create pod home")
+	reported := map[string]bool{id: true}
+
+	// a pod that is about to be installed keeps its pre-staged files
+	store.manifests = map[string]pods.Manifest{kp.IntentPath(p.node, id): manifest}
+	p.prestageAll(nil, reported)
+	_, err = os.Stat(podHome)
+	Assert(t).IsNil(err, "a pod in the intent should keep its pre-staged files")
+
+	// a pod that is never installed does not
+	store.manifests = nil
+	reported[id] = true
+	p.prestageAll(nil, reported)
+	_, err = os.Stat(podHome)
+	Assert(t).IsTrue(os.IsNotExist(err), "a withdrawn pre-stage should be removed from disk")
+	Assert(t).IsFalse(reported[id], "the removed status should be forgotten")
+}
+
+func TestClearInstalledPrestage(t *testing.T) {
+	manifest := testManifest(t)
+	id := manifest.ID()
+	store := &FakeStore{}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	other := podWithID(id)
+	store.manifests = map[string]pods.Manifest{kp.PrestagePath(p.node, id): other}
+	store.SetPrestageStatus(p.node, id, kp.PrestageStatus{Ready: true})
+	p.clearInstalledPrestage(ManifestPair{ID: id, Intent: manifest}, logging.DefaultLogger)
+	_, ok := store.manifests[kp.PrestagePath(p.node, id)]
+	Assert(t).IsTrue(ok, "a request for a different manifest should be kept")
+
+	store.manifests[kp.PrestagePath(p.node, id)] = manifest
+	p.clearInstalledPrestage(ManifestPair{ID: id, Intent: manifest}, logging.DefaultLogger)
+	_, ok = store.manifests[kp.PrestagePath(p.node, id)]
+	Assert(t).IsFalse(ok, "the request for the installed manifest should be removed")
+	_, ok = store.prestageStatuses[id]
+	Assert(t).IsFalse(ok, "the status for the installed manifest should be removed")
+}
@@ -0,0 +1,114 @@
+package preparer
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/auth"
+	"github.com/square/p2/pkg/util"
+	"github.com/square/p2/pkg/util/param"
+	"github.com/square/p2/pkg/util/size"
+)
+
+// Reload validates a new configuration and applies it to the running preparer. The
+// auth policy, log level and destinations, max_launchable_disk_usage, intent_safety,
+// mirror_rewrites, artifact_registry and params can change live. If any other
+// setting differs from the configuration in effect, or any setting is invalid,
+// nothing is changed and an error is returned.
+func (p *Preparer) Reload(newConfig *PreparerConfig) error {
+	p.configLock.Lock()
+	defer p.configLock.Unlock()
+
+	immutable := immutableChanges(&p.config, newConfig)
+	if len(immutable) > 0 {
+		return util.Errorf("cannot change %s without restarting the preparer", strings.Join(immutable, ", "))
+	}
+
+	level, err := logLevel(newConfig)
+	if err != nil {
+		return err
+	}
+	maxLaunchableDiskUsage, err := newConfig.getMaxLaunchableDiskUsage()
+	if err != nil {
+		return err
+	}
+	err = newConfig.IntentSafety.validate()
+	if err != nil {
+		return err
+	}
+	err = newConfig.validateArtifactSources()
+	if err != nil {
+		return err
+	}
+	policy, err := newAuthPolicy(newConfig)
+	if err != nil {
+		return err
+	}
+	swappable, ok := p.authPolicy.(*auth.ReloadablePolicy)
+	if !ok {
+		policy.Close()
+		return util.Errorf("the preparer's auth policy cannot be reloaded")
+	}
+	// params are applied last among the fallible steps, since they can only be
+	// validated by applying them. param.Reload() holds the param lock while it does.
+	err = param.Reload(newConfig.Params)
+	if err != nil {
+		policy.Close()
+		return util.Errorf("invalid parameter: %s", err)
+	}
+
+	swappable.Swap(policy)
+	p.reloadableLog.Reload(level, logHooks(newConfig, p.Logger))
+	p.maxLaunchableDiskUsage = maxLaunchableDiskUsage
+	p.intentSafety = newConfig.IntentSafety
+	p.mirrorRewrites = newConfig.MirrorRewrites
+	p.artifactRegistry = newConfig.ArtifactRegistry
+	p.config = *newConfig
+
+	p.Logger.WithFields(logrus.Fields{
+		"auth_type": newConfig.Auth["type"],
+		"log_level": level,
+	}).Infoln("Preparer configuration reloaded")
+	return nil
+}
+
+// immutableChanges lists the YAML names of the settings that differ between two
+// configurations but can only take effect when the preparer restarts.
+func immutableChanges(old, new *PreparerConfig) []string {
+	var changed []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	check("node_name", old.NodeName, new.NodeName)
+	check("consul_address", old.ConsulAddress, new.ConsulAddress)
+	check("consul_https", old.ConsulHttps, new.ConsulHttps)
+	check("consul_token_path", old.ConsulTokenPath, new.ConsulTokenPath)
+	check("hooks_directory", old.HooksDirectory, new.HooksDirectory)
+	check("ca_file", old.CAFile, new.CAFile)
+	check("cert_file", old.CertFile, new.CertFile)
+	check("key_file", old.KeyFile, new.KeyFile)
+	check("consul_ca_file", old.ConsulCAFile, new.ConsulCAFile)
+	check("pod_root", old.PodRoot, new.PodRoot)
+	check("journal_dir", old.JournalDir, new.JournalDir)
+	check("status_port", old.StatusPort, new.StatusPort)
+	check("status_socket", old.StatusSocket, new.StatusSocket)
+	check("secret_providers", old.SecretProviders, new.SecretProviders)
+	check("artifact_cache", old.ArtifactCache, new.ArtifactCache)
+	check("downloads", old.Downloads, new.Downloads)
+	return changed
+}
+
+func (p *Preparer) getMaxLaunchableDiskUsage() size.ByteCount {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.maxLaunchableDiskUsage
+}
+
+func (p *Preparer) getIntentSafety() IntentSafety {
+	p.configLock.RLock()
+	defer p.configLock.RUnlock()
+	return p.intentSafety
+}
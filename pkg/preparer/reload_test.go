@@ -0,0 +1,90 @@
+package preparer
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	"github.com/square/p2/pkg/uri"
+	"github.com/square/p2/pkg/util/size"
+)
+
+func TestReloadAppliesLiveSettings(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	newConfig := p.config
+	newConfig.MaxLaunchableDiskUsage = "1G"
+	newConfig.IntentSafety = IntentSafety{MaxUninstalls: 3}
+	err := p.Reload(&newConfig)
+	Assert(t).IsNil(err, "reloading live settings should have succeeded")
+	Assert(t).AreEqual(p.getMaxLaunchableDiskUsage(), size.Gibibyte, "disk usage should have been reloaded")
+	Assert(t).AreEqual(p.getIntentSafety().MaxUninstalls, 3, "intent safety should have been reloaded")
+
+	newConfig.MirrorRewrites = []uri.Rewrite{{From: "https://artifacts/", To: "file:///mnt/mirror/"}}
+	newConfig.ArtifactRegistry = "https://registry"
+	err = p.Reload(&newConfig)
+	Assert(t).IsNil(err, "reloading artifact sources should have succeeded")
+	pod := p.newPod("hello")
+	Assert(t).AreEqual(len(pod.MirrorRewrites), 1, "new pods should use the reloaded mirror rewrites")
+	Assert(t).AreEqual(pod.ArtifactRegistry, "https://registry", "new pods should use the reloaded registry")
+}
+
+func TestPreparersDoNotShareArtifactSources(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	config := p.config
+	config.Downloads = &uri.FetcherConfig{Retries: 3}
+	config.MirrorRewrites = []uri.Rewrite{{From: "https://artifacts/", To: "file:///mnt/mirror/"}}
+	config.ArtifactRegistry = "https://registry"
+	other, err := New(&config, p.Logger)
+	Assert(t).IsNil(err, "should have created a second preparer")
+	defer other.Close()
+
+	pod := other.newPod("hello")
+	Assert(t).AreEqual(pod.ArtifactRegistry, "https://registry", "the preparer's registry should be used")
+	Assert(t).AreEqual(pod.ArtifactFetcher.(uri.BasicFetcher).Config.Retries, 3, "the preparer's downloads should be used")
+
+	pod = p.newPod("hello")
+	Assert(t).AreEqual(len(pod.MirrorRewrites), 0, "another preparer's mirror rewrites should not be used")
+	Assert(t).AreEqual(pod.ArtifactRegistry, "", "another preparer's registry should not be used")
+	Assert(t).AreEqual(pod.ArtifactFetcher, uri.DefaultFetcher, "another preparer's downloads should not be used")
+}
+
+func TestReloadRejectsImmutableChanges(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	newConfig := p.config
+	newConfig.NodeName = "otherhost"
+	newConfig.PodRoot = "/somewhere/else"
+	newConfig.MaxLaunchableDiskUsage = "1G"
+	err := p.Reload(&newConfig)
+	Assert(t).IsNotNil(err, "changing the node name and pod root should be refused")
+	Assert(t).AreEqual(p.node, "hostname", "node name should not have changed")
+	Assert(t).AreNotEqual(p.getMaxLaunchableDiskUsage(), size.Gibibyte, "nothing should change when the reload is refused")
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	p, _, fakePodRoot := testPreparer(t, &FakeStore{})
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	newConfig := p.config
+	newConfig.Auth = map[string]interface{}{"type": "keyring"}
+	Assert(t).IsNotNil(p.Reload(&newConfig), "keyring auth without a keyring should be refused")
+
+	newConfig = p.config
+	newConfig.LogLevel = "loud"
+	Assert(t).IsNotNil(p.Reload(&newConfig), "unknown log levels should be refused")
+
+	newConfig = p.config
+	newConfig.Params = map[string]string{"no_such_param": "true"}
+	newConfig.MaxLaunchableDiskUsage = "1G"
+	Assert(t).IsNotNil(p.Reload(&newConfig), "unknown params should be refused")
+	Assert(t).AreNotEqual(p.getMaxLaunchableDiskUsage(), size.Gibibyte, "nothing should change when the reload is refused")
+}
@@ -0,0 +1,130 @@
+package preparer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/health"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/logging"
+)
+
+// The type of the event recorded when a pod is rolled back.
+const RollbackEventType = "rollback"
+
+// How often the health of a newly launched pod is checked while waiting for it to
+// pass. Variable so that tests can shorten it.
+var healthPollInterval = 1 * time.Second
+
+// rolledBack returns true if the intent of the given pair has already been rolled
+// back, in which case it should not be retried until the intent changes.
+func (p *Preparer) rolledBack(pair ManifestPair) bool {
+	journal, err := p.readJournal(pair.ID)
+	if err != nil || journal == nil || journal.Phase != JournalRolledBack {
+		return false
+	}
+	intent, err := pair.Intent.Marshal()
+	if err != nil {
+		return false
+	}
+	return journal.Intent == string(intent)
+}
+
+// recordLaunchFailure counts a failed launch of the pair's intent and returns true
+// if the intent's rollback policy says to give up on it.
+func (p *Preparer) recordLaunchFailure(pair ManifestPair, logger logging.Logger) bool {
+	journal, err := p.readJournal(pair.ID)
+	if err != nil || journal == nil {
+		logger.WithError(err).Errorln("Could not read transition journal to record launch failure")
+		return false
+	}
+	journal.LaunchFailures++
+	err = p.saveJournal(pair.ID, journal)
+	if err != nil {
+		logger.WithError(err).Errorln("Could not record launch failure")
+	}
+
+	maxFailures := pair.Intent.GetRollbackPolicy().MaxLaunchFailures
+	return maxFailures > 0 && journal.LaunchFailures >= maxFailures
+}
+
+// waitForHealth polls the health of the pair's intent until it passes or the
+// rollback policy's health timeout expires. Only results written after launchTime
+// count, since the previous version of the pod reports health under the same key.
+// Returns true if the pod became healthy or the policy has no health timeout.
+func (p *Preparer) waitForHealth(pair ManifestPair, launchTime time.Time, logger logging.Logger) bool {
+	timeout, _ := pair.Intent.GetRollbackPolicy().GetHealthTimeout() // validated with the manifest
+	if timeout <= 0 {
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		result, err := p.store.GetHealth(pair.ID, p.node)
+		if err == nil && result.Status == string(health.Passing) &&
+			result.Time.After(launchTime) && !result.IsStale() {
+			return true
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			logger.WithFields(logrus.Fields{
+				"status":  result.Status,
+				"timeout": timeout,
+			}).Errorln("Pod did not become healthy in time")
+			return false
+		}
+		if remaining > healthPollInterval {
+			remaining = healthPollInterval
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// rollback halts the failed intent of the pair and relaunches its reality, which is
+// still installed on disk. The rollback is recorded in the journal, so the failed
+// intent is not retried, and reported as an event. Returns true if the pod was left
+// in a settled state.
+func (p *Preparer) rollback(pair ManifestPair, pod Pod, reason string, logger logging.Logger) bool {
+	logger = logger.SubLogger(logrus.Fields{"rollback_reason": reason})
+	logger.NoFields().Errorln("Rolling back to last good manifest")
+
+	success, err := pod.Halt(pair.Intent)
+	if err != nil {
+		logger.WithError(err).Errorln("Pod halt failed")
+	} else if !success {
+		logger.NoFields().Warnln("One or more launchables did not halt successfully")
+	}
+
+	message := fmt.Sprintf("%s; no previous version to roll back to", reason)
+	if pair.Reality != nil {
+		err = pod.Install(pair.Reality)
+		if err == nil {
+			_, err = pod.Launch(pair.Reality)
+		}
+		if err != nil {
+			logger.WithError(err).Errorln("Rollback launch failed")
+			return false
+		}
+		duration, err := p.store.SetPod(kp.RealityPath(p.node, pair.ID), pair.Reality)
+		if err != nil {
+			logger.WithErrorAndFields(err, logrus.Fields{
+				"duration": duration}).
+				Errorln("Could not set pod in reality store")
+		}
+		oldSHA, _ := pair.Reality.SHA()
+		message = fmt.Sprintf("%s; rolled back to %s", reason, oldSHA)
+	} else {
+		// the failed intent may already have been written to reality
+		dur, err := p.store.DeletePod(kp.RealityPath(p.node, pair.ID))
+		if err != nil {
+			logger.WithErrorAndFields(err, logrus.Fields{"duration": dur}).
+				Errorln("Could not delete pod from reality store")
+		}
+	}
+
+	p.tryWriteJournal(pair, JournalRolledBack, logger)
+
+	newSHA, _ := pair.Intent.SHA()
+	p.reportEvent(pair.ID, RollbackEventType, fmt.Sprintf("%s failed: %s", newSHA, message), logger)
+	return true
+}
@@ -0,0 +1,138 @@
+package preparer
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	"github.com/square/p2/pkg/health"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+)
+
+func rollbackPair(t *testing.T, policy pods.RollbackPolicy) ManifestPair {
+	pair := updatePair(t)
+	builder := pair.Intent.GetBuilder()
+	builder.SetRollbackPolicy(policy)
+	pair.Intent = builder.GetManifest()
+	return pair
+}
+
+func TestRollbackAfterMaxLaunchFailures(t *testing.T) {
+	pair := rollbackPair(t, pods.RollbackPolicy{MaxLaunchFailures: 2})
+	store := &FakeStore{}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchErr: fmt.Errorf("boom"), haltSuccess: true}
+	success := p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsFalse(success, "first launch failure should be retried")
+	Assert(t).AreEqual(len(store.events), 0, "should not roll back before the limit")
+
+	// the old manifest launches fine, the new one does not
+	testPod.launchErr = nil
+	failingPod := &failingIntentPod{TestPod: testPod, failing: pair.Intent}
+	success = p.resolvePair(pair, failingPod, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "rollback should settle the pod")
+	realitySHA, _ := pair.Reality.SHA()
+	launchedSHA, _ := testPod.currentManifest.SHA()
+	Assert(t).AreEqual(launchedSHA, realitySHA, "reality should have been relaunched")
+	Assert(t).AreEqual(len(store.events), 1, "rollback should be reported")
+	Assert(t).AreEqual(store.events[0].Type, RollbackEventType, "wrong event type")
+	Assert(t).AreEqual(store.events[0].PodID, pair.ID, "wrong event pod")
+
+	testPod.launched = false
+	success = p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "rolled back intent should be left alone")
+	Assert(t).IsFalse(testPod.launched, "rolled back intent should not be retried")
+
+	entry := p.planPair(pair)
+	Assert(t).AreEqual(entry.Action, PlanNone, "plan should not update a rolled back intent")
+}
+
+func TestLaunchFailuresWithoutPolicyRetryForever(t *testing.T) {
+	pair := updatePair(t)
+	store := &FakeStore{}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchErr: fmt.Errorf("boom"), haltSuccess: true}
+	for i := 0; i < 5; i++ {
+		Assert(t).IsFalse(p.resolvePair(pair, testPod, logging.DefaultLogger), "launch should keep failing")
+	}
+	Assert(t).AreEqual(len(store.events), 0, "should never roll back without a policy")
+	journal, _ := p.readJournal(pair.ID)
+	Assert(t).AreEqual(journal.LaunchFailures, 5, "every failure should be counted")
+}
+
+func TestRollbackWhenHealthDoesNotPass(t *testing.T) {
+	healthPollInterval = time.Millisecond
+	defer func() { healthPollInterval = time.Second }()
+
+	pair := rollbackPair(t, pods.RollbackPolicy{HealthTimeout: "10ms"})
+	store := &FakeStore{healthStatus: string(health.Critical)}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchSuccess: true, haltSuccess: true}
+	success := p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "rollback should settle the pod")
+	realitySHA, _ := pair.Reality.SHA()
+	launchedSHA, _ := testPod.currentManifest.SHA()
+	Assert(t).AreEqual(launchedSHA, realitySHA, "reality should have been relaunched")
+	Assert(t).AreEqual(len(store.setKeys), 2, "reality should be written for the intent, then restored")
+	Assert(t).AreEqual(len(store.events), 1, "rollback should be reported")
+}
+
+func TestRollbackWhenOnlyOldHealthPasses(t *testing.T) {
+	healthPollInterval = time.Millisecond
+	defer func() { healthPollInterval = time.Second }()
+
+	pair := rollbackPair(t, pods.RollbackPolicy{HealthTimeout: "10ms"})
+	// the previous version's passing result, written before the launch
+	store := &FakeStore{healthStatus: string(health.Passing), healthTime: time.Now().Add(-time.Second)}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchSuccess: true, haltSuccess: true}
+	success := p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "rollback should settle the pod")
+	realitySHA, _ := pair.Reality.SHA()
+	launchedSHA, _ := testPod.currentManifest.SHA()
+	Assert(t).AreEqual(launchedSHA, realitySHA, "reality should have been relaunched")
+	Assert(t).AreEqual(len(store.events), 1, "health from before the launch should not count")
+}
+
+func TestNoRollbackWhenHealthPasses(t *testing.T) {
+	pair := rollbackPair(t, pods.RollbackPolicy{HealthTimeout: "1m"})
+	store := &FakeStore{healthStatus: string(health.Passing)}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchSuccess: true, haltSuccess: true}
+	success := p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "healthy launch should succeed")
+	Assert(t).AreEqual(len(store.events), 0, "healthy pod should not be rolled back")
+}
+
+// failingIntentPod fails to launch one particular manifest and delegates
+// everything else to a TestPod.
+type failingIntentPod struct {
+	*TestPod
+	failing pods.Manifest
+}
+
+func (f *failingIntentPod) Launch(manifest pods.Manifest) (bool, error) {
+	if manifest == f.failing {
+		f.TestPod.launched = true
+		return false, fmt.Errorf("boom")
+	}
+	return f.TestPod.Launch(manifest)
+}
@@ -0,0 +1,168 @@
+package preparer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/util"
+)
+
+// The types of the events recorded when the preparer refuses an intent change.
+const (
+	UninstallLimitEventType  = "uninstall_limit"
+	BlockedManifestEventType = "blocked_manifest"
+)
+
+// IntentSafety limits how much damage a single bad change to the intent tree can do
+// to a node. A zero limit is not enforced. Limits can be bypassed by setting the
+// node's key under the intent_override tree.
+type IntentSafety struct {
+	// The maximum number of pods that may be uninstalled by one intent change.
+	MaxUninstalls int `yaml:"max_uninstalls,omitempty"`
+	// The maximum percentage of the node's pods that may be uninstalled by one
+	// intent change.
+	MaxUninstallPercent int `yaml:"max_uninstall_percent,omitempty"`
+}
+
+func (s IntentSafety) validate() error {
+	if s.MaxUninstalls < 0 {
+		return util.Errorf("intent_safety max_uninstalls must not be negative")
+	}
+	if s.MaxUninstallPercent < 0 || s.MaxUninstallPercent > 100 {
+		return util.Errorf("intent_safety max_uninstall_percent must be between 0 and 100, got %d", s.MaxUninstallPercent)
+	}
+	return nil
+}
+
+// exceeded returns a description of the limit that uninstalling the given number
+// of pods out of the installed number would break, or "" if none would be.
+func (s IntentSafety) exceeded(uninstalls, installed int) string {
+	if s.MaxUninstalls > 0 && uninstalls > s.MaxUninstalls {
+		return fmt.Sprintf("%d pods would be uninstalled, limit is %d", uninstalls, s.MaxUninstalls)
+	}
+	if s.MaxUninstallPercent > 0 && installed > 0 && uninstalls*100 > s.MaxUninstallPercent*installed {
+		return fmt.Sprintf("%d of %d pods would be uninstalled, limit is %d%%", uninstalls, installed, s.MaxUninstallPercent)
+	}
+	return ""
+}
+
+// limitUninstalls withholds every uninstall in the given pairs if there are more of
+// them than the preparer's intent safety limits allow, unless the node's override
+// key is set. Returns the pairs that may be acted on, the pairs that were withheld
+// and the limit that was exceeded.
+func (p *Preparer) limitUninstalls(pairs []ManifestPair, installed int) ([]ManifestPair, []ManifestPair, string) {
+	var allowed, uninstalls []ManifestPair
+	for _, pair := range pairs {
+		if pair.Intent == nil && pair.Reality != nil {
+			uninstalls = append(uninstalls, pair)
+		} else {
+			allowed = append(allowed, pair)
+		}
+	}
+	reason := p.getIntentSafety().exceeded(len(uninstalls), installed)
+	if reason == "" {
+		return pairs, nil, ""
+	}
+
+	overridden, err := p.store.IntentOverridden(p.node)
+	if err != nil {
+		// fail closed, the override cannot be confirmed
+		p.Logger.WithError(err).Errorln("Could not check for intent override")
+	} else if overridden {
+		p.Logger.WithField("limit", reason).Warnln("Intent safety limit exceeded, but override is set")
+		return pairs, nil, ""
+	}
+	return allowed, uninstalls, reason
+}
+
+// refuseUninstalls reports the uninstalls withheld by limitUninstalls.
+func (p *Preparer) refuseUninstalls(withheld []ManifestPair, reason string) {
+	for _, pair := range withheld {
+		logger := p.Logger.SubLogger(logrus.Fields{"pod": pair.ID})
+		sha, _ := pair.Reality.SHA()
+		if !p.refusals.changed(pair.ID, refusal{UninstallLimitEventType, sha, reason}) {
+			logger.WithField("limit", reason).Debugln("Still refusing to uninstall pod")
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"limit":    reason,
+			"override": kp.OverridePath(p.node),
+		}).Errorln("Refusing to uninstall pod, intent change exceeds safety limits")
+		p.reportEvent(pair.ID, UninstallLimitEventType, fmt.Sprintf("refused to uninstall: %s", reason), logger)
+	}
+}
+
+// refusal is a change to a pod that the preparer refused: the type of the event that
+// reported it, the SHA of the manifest that was refused and the reason.
+type refusal struct {
+	eventType string
+	sha       string
+	reason    string
+}
+
+// refusals remembers the last refusal reported for each pod. The preparer sees the
+// same intent on every watch delivery, and a refusal should only be reported again
+// when something about it changes.
+type refusals struct {
+	mu   sync.Mutex
+	last map[string]refusal
+}
+
+// changed records the refusal for the pod, and returns true if it differs from the
+// last one recorded.
+func (r *refusals) changed(podID string, refused refusal) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		r.last = make(map[string]refusal)
+	}
+	if last, ok := r.last[podID]; ok && last == refused {
+		return false
+	}
+	r.last[podID] = refused
+	return true
+}
+
+// clear forgets the pod's last refusal if it was of the given type, once that kind of
+// change to the pod has been accepted.
+func (r *refusals) clear(podID string, eventType string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last[podID].eventType == eventType {
+		delete(r.last, podID)
+	}
+}
+
+// blocked returns a description of why the pair's intent is on the manifest
+// blocklist, or "" if it is not. Errors reading the blocklist are returned so that
+// callers can fail closed.
+func (p *Preparer) blocked(pair ManifestPair) (string, error) {
+	sha, err := pair.Intent.SHA()
+	if err != nil {
+		return "", err
+	}
+	isBlocked, reason, err := p.store.ManifestBlocked(sha)
+	if err != nil || !isBlocked {
+		return "", err
+	}
+	if reason == "" {
+		reason = "no reason given"
+	}
+	return fmt.Sprintf("manifest %s is blocklisted: %s", sha, reason), nil
+}
+
+func (p *Preparer) reportEvent(podID string, eventType string, message string, logger logging.Logger) {
+	dur, err := p.store.PutEvent(kp.Event{
+		Node:    p.node,
+		PodID:   podID,
+		Type:    eventType,
+		Message: message,
+	})
+	if err != nil {
+		logger.WithErrorAndFields(err, logrus.Fields{"duration": dur, "event_type": eventType}).
+			Errorln("Could not record event")
+	}
+}
@@ -0,0 +1,79 @@
+package preparer
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	"github.com/square/p2/pkg/logging"
+)
+
+func TestIntentSafetyLimits(t *testing.T) {
+	Assert(t).AreEqual(IntentSafety{}.exceeded(100, 100), "", "zero limits should not be enforced")
+	Assert(t).AreEqual(IntentSafety{MaxUninstalls: 2}.exceeded(2, 10), "", "limit should be inclusive")
+	Assert(t).AreNotEqual(IntentSafety{MaxUninstalls: 2}.exceeded(3, 10), "", "count limit should be enforced")
+	Assert(t).AreEqual(IntentSafety{MaxUninstallPercent: 50}.exceeded(2, 4), "", "percent limit should be inclusive")
+	Assert(t).AreNotEqual(IntentSafety{MaxUninstallPercent: 50}.exceeded(3, 4), "", "percent limit should be enforced")
+}
+
+func TestLimitUninstallsWithholdsUninstalls(t *testing.T) {
+	store := &FakeStore{}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+	p.intentSafety = IntentSafety{MaxUninstalls: 1}
+
+	pairs := []ManifestPair{
+		{ID: "a", Reality: podWithID("a")},
+		{ID: "b", Reality: podWithID("b")},
+		{ID: "c", Intent: podWithID("c")},
+	}
+	allowed, withheld, reason := p.limitUninstalls(pairs, 2)
+	Assert(t).AreNotEqual(reason, "", "limit should have been exceeded")
+	Assert(t).AreEqual(len(allowed), 1, "only the install should be allowed")
+	Assert(t).AreEqual(allowed[0].ID, "c", "wrong pair allowed")
+	Assert(t).AreEqual(len(withheld), 2, "both uninstalls should be withheld")
+
+	p.refuseUninstalls(withheld, reason)
+	Assert(t).AreEqual(len(store.events), 2, "every refusal should be reported")
+	Assert(t).AreEqual(store.events[0].Type, UninstallLimitEventType, "wrong event type")
+	p.refuseUninstalls(withheld, reason)
+	Assert(t).AreEqual(len(store.events), 2, "a refusal should not be reported again on every watch")
+	p.refuseUninstalls(withheld, "another reason")
+	Assert(t).AreEqual(len(store.events), 4, "a refusal should be reported again when its reason changes")
+
+	store.overridden = true
+	allowed, withheld, reason = p.limitUninstalls(pairs, 2)
+	Assert(t).AreEqual(reason, "", "override should lift the limit")
+	Assert(t).AreEqual(len(allowed), 3, "override should allow every pair")
+	Assert(t).AreEqual(len(withheld), 0, "override should withhold nothing")
+}
+
+func TestBlockedManifestIsRefused(t *testing.T) {
+	pair := updatePair(t)
+	sha, _ := pair.Intent.SHA()
+	store := &FakeStore{blocked: map[string]string{sha: "bad build"}}
+	p, _, fakePodRoot := testPreparer(t, store)
+	defer p.Close()
+	defer os.RemoveAll(fakePodRoot)
+
+	testPod := &TestPod{launchSuccess: true}
+	success := p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsTrue(success, "refusal should not be retried")
+	Assert(t).IsFalse(testPod.installed, "blocked manifest should not be installed")
+	Assert(t).IsFalse(testPod.halted, "reality should be left running")
+	Assert(t).AreEqual(len(store.events), 1, "refusal should be reported")
+	Assert(t).AreEqual(store.events[0].Type, BlockedManifestEventType, "wrong event type")
+	p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).AreEqual(len(store.events), 1, "refusal should not be reported again on every watch")
+
+	delete(store.blocked, sha)
+	p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).IsTrue(testPod.installed, "unblocked manifest should be installed")
+	store.blocked[sha] = "bad build"
+	p.resolvePair(pair, testPod, logging.DefaultLogger)
+	Assert(t).AreEqual(len(store.events), 2, "refusal should be reported again after the manifest was accepted")
+
+	entry := p.planPair(pair)
+	Assert(t).AreEqual(entry.Action, PlanReject, "plan should reject blocked manifest")
+}
@@ -6,19 +6,25 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/square/p2/Godeps/_workspace/src/github.com/Sirupsen/logrus"
 	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/artifactcache"
 	"github.com/square/p2/pkg/auth"
 	"github.com/square/p2/pkg/hooks"
 	"github.com/square/p2/pkg/kp"
 	"github.com/square/p2/pkg/launch"
 	"github.com/square/p2/pkg/logging"
 	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/secrets"
+	"github.com/square/p2/pkg/uri"
 	"github.com/square/p2/pkg/util"
 	"github.com/square/p2/pkg/util/param"
 	"github.com/square/p2/pkg/util/size"
@@ -44,9 +50,28 @@ type Preparer struct {
 	hookListener           HookListener
 	Logger                 logging.Logger
 	podRoot                string
+	journalDir             string
 	caFile                 string
 	authPolicy             auth.Policy
 	maxLaunchableDiskUsage size.ByteCount
+	intentSafety           IntentSafety
+	artifactCache          *artifactcache.Cache
+	secretProviders        secrets.Providers
+	fetcher                uri.Fetcher // fetches digests and other data that is not an artifact
+	artifactFetcher        uri.Fetcher // goes through the artifact cache if there is one
+	mirrorRewrites         []uri.Rewrite
+	artifactRegistry       string
+	reloadableLog          *logging.Reloadable
+
+	// serializes installs and pre-stages of each pod
+	podLocks podLocks
+	// the last refused change to each pod that was reported
+	refusals refusals
+
+	// guards the fields above that Reload() may change, and config
+	configLock sync.RWMutex
+	// the configuration currently in effect
+	config PreparerConfig
 }
 
 type PreparerConfig struct {
@@ -66,6 +91,27 @@ type PreparerConfig struct {
 	ExtraLogDestinations   []LogDestination       `yaml:"extra_log_destinations,omitempty"`
 	LogLevel               string                 `yaml:"log_level,omitempty"`
 	MaxLaunchableDiskUsage string                 `yaml:"max_launchable_disk_usage"`
+	IntentSafety           IntentSafety           `yaml:"intent_safety,omitempty"`
+	// JournalDir holds the journals of interrupted pod transitions. It must not be
+	// writable by pod users. Defaults to a "journal" directory beside the pod root.
+	JournalDir string `yaml:"journal_dir,omitempty"`
+	// SecretProviders are the sources of the secrets that manifests refer to, keyed by
+	// the provider names used in manifests.
+	SecretProviders map[string]secrets.Config `yaml:"secret_providers,omitempty"`
+	// ArtifactCache configures a cache of launchable artifacts shared by all pods. If
+	// it is not set, every install downloads its artifact.
+	ArtifactCache *artifactcache.Config `yaml:"artifact_cache,omitempty"`
+	// Downloads configures the retries, timeout and limits of HTTP downloads, such as
+	// the downloads of launchable artifacts, and the object store that s3:// locations
+	// are fetched from.
+	Downloads *uri.FetcherConfig `yaml:"downloads,omitempty"`
+	// MirrorRewrites give mirrors of artifact locations, which are tried in order when
+	// an artifact cannot be downloaded. They are only used for artifacts with an
+	// artifact_sha256 and for signed digests.
+	MirrorRewrites []uri.Rewrite `yaml:"mirror_rewrites,omitempty"`
+	// ArtifactRegistry is the base URL that launchables with a content-addressed
+	// "artifact" are fetched from, as <artifact_registry>/sha256/<hex encoded SHA256>.
+	ArtifactRegistry string `yaml:"artifact_registry,omitempty"`
 
 	// Params defines a collection of miscellaneous runtime parameters defined throughout the
 	// source files.
@@ -215,14 +261,35 @@ func (c *PreparerConfig) GetClient() (*http.Client, error) {
 	return getTLSClient(c.CertFile, c.KeyFile, c.CAFile)
 }
 
-func addHooks(preparerConfig *PreparerConfig, logger logging.Logger) {
+// logHooks creates the hooks for the configuration's extra log destinations.
+func logHooks(preparerConfig *PreparerConfig, logger logging.Logger) logrus.LevelHooks {
+	hooks := make(logrus.LevelHooks)
 	for _, dest := range preparerConfig.ExtraLogDestinations {
-		logger.WithFields(logrus.Fields{
+		destLogger := logger.SubLogger(logrus.Fields{
 			"type": dest.Type,
 			"path": dest.Path,
-		}).Infoln("Adding log destination")
-		logger.AddHook(dest.Type, dest.Path)
+		})
+		hook, err := logging.NewHook(dest.Type, dest.Path)
+		if err != nil {
+			destLogger.WithError(err).Errorln("Could not add log destination")
+			continue
+		}
+		destLogger.NoFields().Infoln("Adding log destination")
+		hooks.Add(hook)
+	}
+	return hooks
+}
+
+// logLevel parses the configuration's log level, which defaults to info.
+func logLevel(preparerConfig *PreparerConfig) (logrus.Level, error) {
+	if preparerConfig.LogLevel == "" {
+		return logrus.InfoLevel, nil
+	}
+	level, err := logrus.ParseLevel(preparerConfig.LogLevel)
+	if err != nil {
+		return level, util.Errorf("Received invalid log level %q", preparerConfig.LogLevel)
 	}
+	return level, nil
 }
 
 // castYaml() allows a YAML block to be reparsed into a struct type by
@@ -236,8 +303,6 @@ func castYaml(in map[string]interface{}, out interface{}) error {
 }
 
 func New(preparerConfig *PreparerConfig, logger logging.Logger) (*Preparer, error) {
-	addHooks(preparerConfig, logger)
-
 	if preparerConfig.ConsulAddress == "" {
 		return nil, util.Errorf("No Consul address given to the preparer")
 	}
@@ -245,15 +310,154 @@ func New(preparerConfig *PreparerConfig, logger logging.Logger) (*Preparer, erro
 		return nil, util.Errorf("No pod root given to the preparer")
 	}
 
-	if preparerConfig.LogLevel != "" {
-		lv, err := logrus.ParseLevel(preparerConfig.LogLevel)
+	level, err := logLevel(preparerConfig)
+	if err != nil {
+		return nil, err
+	}
+	// the logger is shared with the rest of the preparer, so Reload() can only change
+	// its level and hooks through a Reloadable
+	reloadableLog := logging.MakeReloadable(logger.Logger)
+	reloadableLog.Reload(level, logHooks(preparerConfig, logger))
+
+	policy, err := newAuthPolicy(preparerConfig)
+	if err != nil {
+		return nil, err
+	}
+	// the policy is shared with the hook listener and can be swapped by Reload()
+	authPolicy := auth.NewReloadablePolicy(policy)
+
+	store, err := preparerConfig.GetStore()
+	if err != nil {
+		return nil, err
+	}
+
+	maxLaunchableDiskUsage, err := preparerConfig.getMaxLaunchableDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	err = preparerConfig.IntentSafety.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	secretProviders, err := secrets.NewProviders(preparerConfig.SecretProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	fetcher := uri.DefaultFetcher
+	if preparerConfig.Downloads != nil {
+		fetcher, err = uri.NewFetcher(*preparerConfig.Downloads)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = preparerConfig.validateArtifactSources()
+	if err != nil {
+		return nil, err
+	}
+
+	artifactFetcher := fetcher
+	var artifactCache *artifactcache.Cache
+	if preparerConfig.ArtifactCache != nil {
+		cache, err := artifactcache.New(*preparerConfig.ArtifactCache, fetcher, logger.SubLogger(logrus.Fields{"component": "artifact_cache"}))
 		if err != nil {
-			return nil, util.Errorf("Received invalid log level %q", preparerConfig.LogLevel)
+			return nil, err
+		}
+		artifactFetcher = cache
+		artifactCache = cache
+	}
+
+	listener := HookListener{
+		Intent:         store,
+		HookPrefix:     kp.HOOK_TREE,
+		DestinationDir: path.Join(pods.DEFAULT_PATH, "hooks"),
+		ExecDir:        preparerConfig.HooksDirectory,
+		Logger:         logger,
+		authPolicy:     authPolicy,
+	}
+
+	err = os.MkdirAll(preparerConfig.PodRoot, 0755)
+	if err != nil {
+		return nil, util.Errorf("Could not create preparer pod directory: %s", err)
+	}
+
+	// pod homes belong to their pods' users, so journals are kept outside of them
+	journalDir := preparerConfig.JournalDir
+	if journalDir == "" {
+		journalDir = filepath.Join(filepath.Dir(filepath.Clean(preparerConfig.PodRoot)), "journal")
+	}
+	err = os.MkdirAll(journalDir, 0700)
+	if err != nil {
+		return nil, util.Errorf("Could not create preparer journal directory: %s", err)
+	}
+
+	consulCAFile := preparerConfig.ConsulCAFile
+	if consulCAFile == "" {
+		consulCAFile = preparerConfig.CAFile
+	}
+
+	preparer := &Preparer{
+		node:                   preparerConfig.NodeName,
+		store:                  store,
+		hooks:                  hooks.Hooks(preparerConfig.HooksDirectory, &logger),
+		hookListener:           listener,
+		Logger:                 logger,
+		podRoot:                preparerConfig.PodRoot,
+		journalDir:             journalDir,
+		authPolicy:             authPolicy,
+		caFile:                 consulCAFile,
+		maxLaunchableDiskUsage: maxLaunchableDiskUsage,
+		intentSafety:           preparerConfig.IntentSafety,
+		artifactCache:          artifactCache,
+		secretProviders:        secretProviders,
+		fetcher:                fetcher,
+		artifactFetcher:        artifactFetcher,
+		mirrorRewrites:         preparerConfig.MirrorRewrites,
+		artifactRegistry:       preparerConfig.ArtifactRegistry,
+		reloadableLog:          reloadableLog,
+		config:                 *preparerConfig,
+	}
+	// hooks are fetched like any other pod
+	preparer.hookListener.newPod = preparer.newPodAt
+	return preparer, nil
+}
+
+// validateArtifactSources checks the mirror rewrites and artifact registry that pods
+// fetch their artifacts from.
+func (c *PreparerConfig) validateArtifactSources() error {
+	for _, rewrite := range c.MirrorRewrites {
+		if rewrite.From == "" || rewrite.To == "" {
+			return util.Errorf("Mirror rewrites need both 'from' and 'to', got %+v", rewrite)
+		}
+	}
+	if c.ArtifactRegistry != "" {
+		registry, err := url.Parse(c.ArtifactRegistry)
+		if err != nil || !uri.IsSupportedScheme(registry.Scheme) {
+			return util.Errorf("Invalid artifact registry %q", c.ArtifactRegistry)
 		}
-		logger.Logger.Level = lv
 	}
+	return nil
+}
 
-	var err error
+// RemovePartialDownloads removes the downloads that a previous preparer left in the
+// artifact cache when it stopped. It should be called once at startup, before any
+// pods are installed, and never by a preparer that only plans.
+func (p *Preparer) RemovePartialDownloads() {
+	if p.artifactCache == nil {
+		return
+	}
+	err := p.artifactCache.RemovePartialDownloads()
+	if err != nil {
+		p.Logger.WithError(err).Errorln("Could not remove partial downloads from the artifact cache")
+	}
+}
+
+// newAuthPolicy constructs the auth policy described by the "auth" section of the
+// configuration.
+func newAuthPolicy(preparerConfig *PreparerConfig) (auth.Policy, error) {
 	var authPolicy auth.Policy
 	switch t, _ := preparerConfig.Auth["type"].(string); t {
 	case "":
@@ -303,48 +507,16 @@ func New(preparerConfig *PreparerConfig, logger logging.Logger) (*Preparer, erro
 		}
 		return nil, util.Errorf("unrecognized auth type")
 	}
+	return authPolicy, nil
+}
 
-	store, err := preparerConfig.GetStore()
-	if err != nil {
-		return nil, err
-	}
-
-	maxLaunchableDiskUsage := launch.DefaultAllowableDiskUsage
-	if preparerConfig.MaxLaunchableDiskUsage != "" {
-		maxLaunchableDiskUsage, err = size.Parse(preparerConfig.MaxLaunchableDiskUsage)
-		if err != nil {
-			return nil, util.Errorf("Unparseable value for max_launchable_disk_usage %v, %v", preparerConfig.MaxLaunchableDiskUsage, err)
-		}
-	}
-
-	listener := HookListener{
-		Intent:         store,
-		HookPrefix:     kp.HOOK_TREE,
-		DestinationDir: path.Join(pods.DEFAULT_PATH, "hooks"),
-		ExecDir:        preparerConfig.HooksDirectory,
-		Logger:         logger,
-		authPolicy:     authPolicy,
+func (c *PreparerConfig) getMaxLaunchableDiskUsage() (size.ByteCount, error) {
+	if c.MaxLaunchableDiskUsage == "" {
+		return launch.DefaultAllowableDiskUsage, nil
 	}
-
-	err = os.MkdirAll(preparerConfig.PodRoot, 0755)
+	maxLaunchableDiskUsage, err := size.Parse(c.MaxLaunchableDiskUsage)
 	if err != nil {
-		return nil, util.Errorf("Could not create preparer pod directory: %s", err)
+		return 0, util.Errorf("Unparseable value for max_launchable_disk_usage %v, %v", c.MaxLaunchableDiskUsage, err)
 	}
-
-	consulCAFile := preparerConfig.ConsulCAFile
-	if consulCAFile == "" {
-		consulCAFile = preparerConfig.CAFile
-	}
-
-	return &Preparer{
-		node:                   preparerConfig.NodeName,
-		store:                  store,
-		hooks:                  hooks.Hooks(preparerConfig.HooksDirectory, &logger),
-		hookListener:           listener,
-		Logger:                 logger,
-		podRoot:                preparerConfig.PodRoot,
-		authPolicy:             authPolicy,
-		caFile:                 consulCAFile,
-		maxLaunchableDiskUsage: maxLaunchableDiskUsage,
-	}, nil
+	return maxLaunchableDiskUsage, nil
 }
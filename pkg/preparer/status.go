@@ -1,6 +1,7 @@
 package preparer
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,11 +10,20 @@ import (
 	"github.com/square/p2/pkg/logging"
 )
 
+// A Planner reports what the preparer would do without doing it. *Preparer implements
+// this interface.
+type Planner interface {
+	Plan() (Plan, error)
+}
+
 type StatusServer struct {
 	listener net.Listener
 	server   *http.Server
 	logger   *logging.Logger
 	Exit     chan error
+
+	// If set, the plan for this node is served at "/_plan"
+	Planner Planner
 }
 
 func (s *StatusServer) Close() error {
@@ -57,6 +67,9 @@ func (s *StatusServer) Serve() {
 	mux.HandleFunc("/_status", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "p2-preparer OK")
 	})
+	if s.Planner != nil {
+		mux.HandleFunc("/_plan", s.servePlan)
+	}
 
 	s.server.Handler = mux
 	err := s.server.Serve(s.listener)
@@ -65,6 +78,20 @@ func (s *StatusServer) Serve() {
 	close(s.Exit)
 }
 
+func (s *StatusServer) servePlan(w http.ResponseWriter, r *http.Request) {
+	plan, err := s.Planner.Plan()
+	if err != nil {
+		s.logger.WithError(err).Warnln("Could not compute plan")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(plan)
+	if err != nil {
+		s.logger.WithError(err).Warnln("Could not write plan")
+	}
+}
+
 func (s *StatusServer) listenOnPort(statusPort int) (net.Listener, error) {
 	s.logger.WithField("port", statusPort).Infof("Reporting status on port %d", statusPort)
 	return net.Listen("tcp", fmt.Sprintf(":%d", statusPort))
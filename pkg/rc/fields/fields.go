@@ -41,12 +41,16 @@ type RC struct {
 // RawRC defines the JSON format used to store data into Consul. It should only be used
 // while (de-)serializing the RC state. Prefer using the "RC" when possible.
 type RawRC struct {
-	ID              ID         `json:"id"`
-	Manifest        string     `json:"manifest"`
-	NodeSelector    string     `json:"node_selector"`
-	PodLabels       labels.Set `json:"pod_labels"`
-	ReplicasDesired int        `json:"replicas_desired"`
-	Disabled        bool       `json:"disabled"`
+	ID       ID     `json:"id"`
+	Manifest string `json:"manifest"`
+	// ManifestObject is the manifest as a JSON object, so that the RC store can be
+	// queried by the manifest's fields. It is optional and carries no signature, so
+	// Manifest takes precedence when both are present.
+	ManifestObject  json.RawMessage `json:"manifest_object,omitempty"`
+	NodeSelector    string          `json:"node_selector"`
+	PodLabels       labels.Set      `json:"pod_labels"`
+	ReplicasDesired int             `json:"replicas_desired"`
+	Disabled        bool            `json:"disabled"`
 }
 
 // MarshalJSON implements the json.Marshaler interface for serializing the RC to JSON
@@ -59,13 +63,16 @@ type RawRC struct {
 // we own pods.Manifest, but we don't own labels.Selector, so we have to
 // implement the json marshaling here to wrap around the interface values
 func (rc RC) MarshalJSON() ([]byte, error) {
-	var manifest []byte
+	var manifest, manifestObject []byte
 	var err error
 	if rc.Manifest != nil {
 		manifest, err = rc.Manifest.Marshal()
 		if err != nil {
 			return nil, err
 		}
+		// the object is optional, manifests that cannot be represented in JSON
+		// are only stored as text
+		manifestObject, _ = rc.Manifest.MarshalJSON()
 	}
 
 	var nodeSel string
@@ -76,6 +83,7 @@ func (rc RC) MarshalJSON() ([]byte, error) {
 	return json.Marshal(RawRC{
 		ID:              rc.ID,
 		Manifest:        string(manifest),
+		ManifestObject:  manifestObject,
 		NodeSelector:    nodeSel,
 		PodLabels:       rc.PodLabels,
 		ReplicasDesired: rc.ReplicasDesired,
@@ -93,7 +101,11 @@ func (rc *RC) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	m, err := pods.ManifestFromBytes([]byte(rawRC.Manifest))
+	manifest := []byte(rawRC.Manifest)
+	if len(manifest) == 0 && len(rawRC.ManifestObject) > 0 {
+		manifest = rawRC.ManifestObject
+	}
+	m, err := pods.ManifestFromBytes(manifest)
 	if err != nil {
 		return err
 	}
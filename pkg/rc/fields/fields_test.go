@@ -29,3 +29,19 @@ func TestJSONMarshal(t *testing.T) {
 	Assert(t).AreEqual(rc1.ID, rc2.ID, "RC ID changed when serialized")
 	Assert(t).AreEqual(rc1.Manifest.ID(), rc2.Manifest.ID(), "Manifest ID changed when serialized")
 }
+
+func TestJSONUnmarshalManifestObject(t *testing.T) {
+	b := []byte(`{"id": "hello", "manifest_object": {"id": "hello", "launchables": {}}, "node_selector": ""}`)
+	var rc fields.RC
+	err := json.Unmarshal(b, &rc)
+	Assert(t).IsNil(err, "should have unmarshaled an RC with only a manifest object")
+	Assert(t).AreEqual(rc.Manifest.ID(), "hello", "manifest should have been read from the object")
+
+	b, err = json.Marshal(rc)
+	Assert(t).IsNil(err, "should have marshaled")
+	var raw fields.RawRC
+	err = json.Unmarshal(b, &raw)
+	Assert(t).IsNil(err, "should have unmarshaled the raw RC")
+	Assert(t).IsTrue(raw.Manifest != "", "manifest text should always be stored")
+	Assert(t).IsTrue(len(raw.ManifestObject) > 0, "manifest object should be stored")
+}
@@ -225,10 +225,15 @@ func (rc *replicationController) forEachLabel(node string, f func(id, k, v strin
 }
 
 func (rc *replicationController) schedule(node string) error {
+	manifest, err := rc.nodeManifest(node)
+	if err != nil {
+		return err
+	}
+
 	// First, schedule the new pod.
 	intentPath := kp.IntentPath(node, rc.Manifest.ID())
 	rc.logger.NoFields().Infof("Scheduling on %s", intentPath)
-	_, err := rc.kpStore.SetPod(intentPath, rc.Manifest)
+	_, err = rc.kpStore.SetPod(intentPath, manifest)
 	if err != nil {
 		return err
 	}
@@ -242,6 +247,36 @@ func (rc *replicationController) schedule(node string) error {
 	})
 }
 
+// nodeManifest returns the manifest to schedule on the given node, with any template
+// parameters in it resolved for that node.
+func (rc *replicationController) nodeManifest(node string) (pods.Manifest, error) {
+	return NodeManifest(rc.RC, node, rc.podApplicator)
+}
+
+// NodeManifest returns the manifest that the replication controller schedules on the
+// given node, with any template parameters in it resolved for that node.
+func NodeManifest(rc fields.RC, node string, applicator labels.Applicator) (pods.Manifest, error) {
+	if !pods.IsTemplated(rc.Manifest) {
+		return rc.Manifest, nil
+	}
+
+	nodeLabels, err := applicator.GetLabels(labels.NODE, node)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{
+		"node.name": node,
+		"rc.id":     rc.ID.String(),
+	}
+	for k, v := range nodeLabels.Labels {
+		params["node.labels."+k] = v
+	}
+	for k, v := range rc.PodLabels {
+		params["rc.pod_labels."+k] = v
+	}
+	return pods.ResolveTemplate(rc.Manifest, params)
+}
+
 func (rc *replicationController) unschedule(node string) error {
 	intentPath := kp.IntentPath(node, rc.Manifest.ID())
 	rc.logger.NoFields().Infof("Uncheduling from %s", intentPath)
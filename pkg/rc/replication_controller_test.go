@@ -142,6 +142,33 @@ func TestSchedule(t *testing.T) {
 	}
 }
 
+func TestScheduleResolvesTemplate(t *testing.T) {
+	_, kp, applicator, rc := setup(t)
+	impl := rc.(*replicationController)
+	builder := impl.Manifest.GetBuilder()
+	builder.SetConfig(map[interface{}]interface{}{
+		"node":  "${node.name}",
+		"shard": "${node.labels.shard}",
+		"owner": "${rc.pod_labels.podTest}",
+	})
+	impl.Manifest = builder.GetManifest()
+
+	err := applicator.SetLabel(labels.NODE, "node2", "shard", "7")
+	Assert(t).IsNil(err, "expected no error labeling node2")
+
+	err = impl.schedule("node2")
+	Assert(t).IsNil(err, "expected no error scheduling templated manifest")
+	config := kp.manifests["intent/node2/testPod"].GetConfig()
+	Assert(t).AreEqual(config["node"], "node2", "expected node name to be resolved")
+	Assert(t).AreEqual(config["shard"], "7", "expected node label to be resolved")
+	Assert(t).AreEqual(config["owner"], "successful", "expected pod label to be resolved")
+
+	err = impl.schedule("node3")
+	Assert(t).IsNotNil(err, "expected an error scheduling on a node without the label")
+	_, ok := kp.manifests["intent/node3/testPod"]
+	Assert(t).IsFalse(ok, "expected no manifest to be scheduled without the label")
+}
+
 func TestSchedulePartial(t *testing.T) {
 	rcStore, kp, applicator, rc := setup(t)
 
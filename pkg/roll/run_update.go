@@ -296,7 +296,12 @@ func (u update) countHealthy(id rcf.ID, checks map[string]health.Result) (rcNode
 			return ret, err
 		}
 		realSHA, _ := realManifest.SHA()
-		targetSHA, _ := rcFields.Manifest.SHA()
+		// a templated manifest is resolved differently for each node
+		targetManifest, err := rc.NodeManifest(rcFields, node, u.labeler)
+		if err != nil {
+			return ret, err
+		}
+		targetSHA, _ := targetManifest.SHA()
 		if targetSHA == realSHA {
 			ret.Real++
 		} else {
@@ -7,6 +7,14 @@ import (
 	"time"
 
 	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+	klabels "github.com/square/p2/Godeps/_workspace/src/k8s.io/kubernetes/pkg/labels"
+	"github.com/square/p2/pkg/health"
+	"github.com/square/p2/pkg/kp"
+	"github.com/square/p2/pkg/kp/rcstore"
+	"github.com/square/p2/pkg/labels"
+	"github.com/square/p2/pkg/logging"
+	"github.com/square/p2/pkg/pods"
+	"github.com/square/p2/pkg/rc"
 )
 
 func TestWouldBlock(t *testing.T) {
@@ -120,3 +128,55 @@ func SimulateRollingUpgradeDisable(t *testing.T, full, nonew bool) {
 		}
 	}
 }
+
+// fakeKpStore holds the reality manifests of pods. Other kp.Store methods are not
+// implemented.
+type fakeKpStore struct {
+	kp.Store
+	manifests map[string]pods.Manifest
+}
+
+func (s fakeKpStore) Pod(key string) (pods.Manifest, time.Duration, error) {
+	manifest, ok := s.manifests[key]
+	if !ok {
+		return nil, 0, pods.NoCurrentManifest
+	}
+	return manifest, 0, nil
+}
+
+func TestCountHealthyResolvesTemplates(t *testing.T) {
+	builder := pods.NewManifestBuilder()
+	builder.SetID("testPod")
+	builder.SetConfig(map[interface{}]interface{}{"node": "${node.name}"})
+	manifest := builder.GetManifest()
+
+	rcs := rcstore.NewFake()
+	rcFields, err := rcs.Create(manifest, klabels.Everything(), nil)
+	Assert(t).IsNil(err, "test setup: could not create RC")
+	applicator := labels.NewFakeApplicator()
+	kps := fakeKpStore{manifests: make(map[string]pods.Manifest)}
+	checks := make(map[string]health.Result)
+	for _, node := range []string{"node1", "node2"} {
+		err = applicator.SetLabel(labels.POD, node+"/testPod", rc.RCIDLabel, rcFields.ID.String())
+		Assert(t).IsNil(err, "test setup: could not label pod")
+		resolved, err := rc.NodeManifest(rcFields, node, applicator)
+		Assert(t).IsNil(err, "test setup: could not resolve manifest")
+		kps.manifests[kp.RealityPath(node, "testPod")] = resolved
+		checks[node] = health.Result{Status: health.Passing}
+	}
+	// node2 is still running the manifest resolved for another node
+	kps.manifests[kp.RealityPath("node2", "testPod")] = kps.manifests[kp.RealityPath("node1", "testPod")]
+
+	u := update{
+		kps:     kps,
+		rcs:     rcs,
+		labeler: applicator,
+		sched:   rc.NewApplicatorScheduler(applicator),
+		logger:  logging.TestLogger(),
+	}
+	counts, err := u.countHealthy(rcFields.ID, checks)
+	Assert(t).IsNil(err, "should have counted nodes")
+	Assert(t).AreEqual(counts.Current, 2, "both nodes should be current")
+	Assert(t).AreEqual(counts.Real, 1, "only the node running its resolved manifest should be real")
+	Assert(t).AreEqual(counts.Healthy, 1, "only the real node should be counted as healthy")
+}
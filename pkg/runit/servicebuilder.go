@@ -24,6 +24,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/square/p2/pkg/util"
 
@@ -51,6 +52,12 @@ type ServiceTemplate struct {
 	Log      []string `yaml:"log,omitempty"`
 	Sleep    *int     `yaml:"sleep,omitempty"`
 	LogSleep *int     `yaml:"logsleep,omitempty"`
+	// Paths of services that must be up before this service runs. The run script
+	// exits if any of them cannot be started, so runsv retries it later.
+	Requires []string `yaml:"requires,omitempty"`
+	// The signal that stops the service, such as "INT". runsv sends TERM if this
+	// is empty.
+	StopSignal string `yaml:"stop_signal,omitempty"`
 }
 
 func (s ServiceTemplate) RunScript() ([]byte, error) {
@@ -69,19 +76,63 @@ func (s ServiceTemplate) RunScript() ([]byte, error) {
 		sleep = *s.Sleep
 	}
 
+	requires := ""
+	for _, service := range s.Requires {
+		requires += fmt.Sprintf("exit 1 unless system(%s, 'start', %s)\n", rubyQuote(DefaultSV.Bin), rubyQuote(service))
+	}
+
 	ret := fmt.Sprintf(`#!/usr/bin/ruby
 $stderr.reopen(STDOUT)
 require 'yaml'
 sleep %d
-exec *YAML.load(DATA.read)
+%sexec *YAML.load(DATA.read)
 sleep 2
 __END__
 %s
 %s
-`, sleep, yamlSeparator, args)
+`, sleep, requires, yamlSeparator, args)
+	return []byte(ret), nil
+}
+
+// rubyQuote returns the given string as a single-quoted ruby string literal.
+func rubyQuote(str string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(str) + "'"
+}
+
+// StopScript returns the runsv control script that sends the service's stop signal
+// in place of TERM, or nil if the service is stopped with TERM. See
+// http://smarden.org/runit/runsv.8.html for how control scripts are run.
+func (s ServiceTemplate) StopScript() ([]byte, error) {
+	if s.StopSignal == "" {
+		return nil, nil
+	}
+	signal, err := ParseSignal(s.StopSignal)
+	if err != nil {
+		return nil, err
+	}
+
+	// exiting 0 tells runsv not to send TERM itself
+	ret := fmt.Sprintf(`#!/usr/bin/ruby
+Process.kill(%s, File.read('supervise/pid').to_i)
+`, rubyQuote(signal))
 	return []byte(ret), nil
 }
 
+// The signals that a service may be stopped with.
+var stopSignals = []string{"HUP", "INT", "QUIT", "KILL", "USR1", "USR2", "TERM", "WINCH"}
+
+// ParseSignal returns the name of a signal without its "SIG" prefix, such as "INT" for
+// "SIGINT" or "int". Returns an error for signals that cannot stop a service.
+func ParseSignal(name string) (string, error) {
+	signal := strings.TrimPrefix(strings.ToUpper(name), "SIG")
+	for _, stopSignal := range stopSignals {
+		if signal == stopSignal {
+			return signal, nil
+		}
+	}
+	return "", util.Errorf("%q is not a supported stop signal, must be one of %s", name, strings.Join(stopSignals, ", "))
+}
+
 func (s ServiceTemplate) LogScript() ([]byte, error) {
 	sleep := 2
 	if s.LogSleep != nil && *s.LogSleep >= 0 {
@@ -210,6 +261,23 @@ func (s *ServiceBuilder) stage(templates map[string]ServiceTemplate, restartPoli
 			return err
 		}
 
+		stopScript, err := template.StopScript()
+		if err != nil {
+			return err
+		}
+		stopPath := filepath.Join(stageDir, "control", "t")
+		if stopScript != nil {
+			if err = os.MkdirAll(filepath.Dir(stopPath), 0755); err != nil {
+				return err
+			}
+			if _, err = util.WriteIfChanged(stopPath, stopScript, 0755); err != nil {
+				return err
+			}
+		} else if err = os.Remove(stopPath); err != nil && !os.IsNotExist(err) {
+			// left over from a previous installation with a stop signal
+			return util.Errorf("Unable to remove stop script: %s", err)
+		}
+
 		// If a "down" file is not present, runit will restart the process
 		// whenever it finishes. Prevent that if the requested restart policy
 		// is not RestartAlways
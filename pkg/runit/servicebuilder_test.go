@@ -110,6 +110,47 @@ func TestDownFile(t *testing.T) {
 	Assert(t).IsTrue(os.IsNotExist(err), "down file should not have existed when restart policy is 'always'")
 }
 
+func TestRunScriptStartsRequiredServices(t *testing.T) {
+	script, err := ServiceTemplate{
+		Run:      []string{"foo"},
+		Requires: []string{"/var/service/bar", "/var/service/it's"},
+	}.RunScript()
+	Assert(t).IsNil(err, "should have generated run script")
+	Assert(t).IsTrue(strings.Contains(string(script), "exit 1 unless system('/usr/bin/sv', 'start', '/var/service/bar')\n"), "run script should start the required service")
+	Assert(t).IsTrue(strings.Contains(string(script), `'/var/service/it\'s'`), "service paths should be quoted")
+
+	script, err = ServiceTemplate{Run: []string{"foo"}}.RunScript()
+	Assert(t).IsNil(err, "should have generated run script")
+	Assert(t).IsFalse(strings.Contains(string(script), "system("), "run script should not start anything without requirements")
+}
+
+func TestStopSignalScript(t *testing.T) {
+	sb := FakeServiceBuilder()
+	defer sb.Cleanup()
+
+	templates := map[string]ServiceTemplate{
+		"foo": ServiceTemplate{
+			Run:        []string{"foo"},
+			StopSignal: "SIGINT",
+		},
+	}
+	err := sb.stage(templates, RestartPolicyAlways)
+	Assert(t).IsNil(err, "should have staged")
+	stopPath := filepath.Join(sb.StagingRoot, "foo", "control", "t")
+	script, err := ioutil.ReadFile(stopPath)
+	Assert(t).IsNil(err, "should have written a stop script")
+	Assert(t).IsTrue(strings.Contains(string(script), "Process.kill('INT', "), "stop script should send the stop signal")
+
+	err = sb.stage(fakeTemplate, RestartPolicyAlways)
+	Assert(t).IsNil(err, "should have staged")
+	_, err = os.Stat(stopPath)
+	Assert(t).IsTrue(os.IsNotExist(err), "stop script should be removed when there is no stop signal")
+
+	templates["foo"] = ServiceTemplate{Run: []string{"foo"}, StopSignal: "STOP"}
+	err = sb.stage(templates, RestartPolicyAlways)
+	Assert(t).IsNotNil(err, "signals that cannot stop a service should be rejected")
+}
+
 func verifyRuby18(t *testing.T, filename, displayName string) {
 	binData, err := ioutil.ReadFile(filename)
 	Assert(t).IsNil(err, fmt.Sprintf("should have been able to read %s", displayName))
@@ -0,0 +1,86 @@
+// Package secrets fetches the secret values that pod manifests refer to by name. The
+// values live on the host, or in a service the host can reach, and never appear in
+// the manifest itself, so they do not affect the manifest's SHA.
+package secrets
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// A Provider looks up secret values by key.
+type Provider interface {
+	// Get returns the value of the secret with the given key. Errors must not contain
+	// the value.
+	Get(key string) ([]byte, error)
+}
+
+// Config describes a provider in the preparer's configuration. Type selects the
+// implementation, and the other fields are specific to it.
+type Config struct {
+	Type string `yaml:"type"`
+	// For the "file" type, the directory holding one file per secret.
+	Path string `yaml:"path,omitempty"`
+}
+
+// Providers maps the names that manifests use for providers to the providers.
+type Providers map[string]Provider
+
+// DefaultProviders are the providers used to resolve the secrets of pods that are
+// not given providers of their own.
+var DefaultProviders = Providers{}
+
+// NewProviders creates the providers described by the given configurations, keyed by
+// name.
+func NewProviders(configs map[string]Config) (Providers, error) {
+	providers := make(Providers, len(configs))
+	for name, config := range configs {
+		provider, err := NewProvider(config)
+		if err != nil {
+			return nil, util.Errorf("secret provider %s: %s", name, err)
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// NewProvider creates the provider described by the given configuration.
+func NewProvider(config Config) (Provider, error) {
+	switch config.Type {
+	case "file":
+		if config.Path == "" {
+			return nil, util.Errorf("file provider must contain a path")
+		}
+		return FileProvider{Root: config.Path}, nil
+	default:
+		return nil, util.Errorf("unknown secret provider type %q", config.Type)
+	}
+}
+
+// Get looks up a secret with the named provider.
+func (p Providers) Get(provider, key string) ([]byte, error) {
+	source, ok := p[provider]
+	if !ok {
+		return nil, util.Errorf("no secret provider named %q is configured", provider)
+	}
+	return source.Get(key)
+}
+
+// FileProvider reads each secret from a file under Root, named by the secret's key.
+// Keys may contain slashes to refer to files in subdirectories, but may not refer to
+// files outside of Root.
+type FileProvider struct {
+	Root string
+}
+
+func (p FileProvider) Get(key string) ([]byte, error) {
+	path := filepath.Join(p.Root, filepath.FromSlash(key))
+	rel, err := filepath.Rel(p.Root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, util.Errorf("secret key %q is outside of %s", key, p.Root)
+	}
+	return ioutil.ReadFile(path)
+}
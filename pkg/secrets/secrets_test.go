@@ -0,0 +1,37 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func TestFileProvider(t *testing.T) {
+	root, err := ioutil.TempDir("", "secrets")
+	Assert(t).IsNil(err, "should have created a temp dir")
+	defer os.RemoveAll(root)
+	err = os.MkdirAll(filepath.Join(root, "db"), 0700)
+	Assert(t).IsNil(err, "should have created a subdirectory")
+	err = ioutil.WriteFile(filepath.Join(root, "db", "password"), []byte("hunter2"), 0600)
+	Assert(t).IsNil(err, "should have written a secret")
+
+	providers, err := NewProviders(map[string]Config{"local": {Type: "file", Path: root}})
+	Assert(t).IsNil(err, "should have created the provider")
+
+	value, err := providers.Get("local", "db/password")
+	Assert(t).IsNil(err, "should have read the secret")
+	Assert(t).AreEqual(string(value), "hunter2", "wrong secret value")
+
+	_, err = providers.Get("local", "../etc/passwd")
+	Assert(t).IsNotNil(err, "keys outside of the root should be refused")
+	_, err = providers.Get("local", "db/missing")
+	Assert(t).IsNotNil(err, "missing secrets should be an error")
+	_, err = providers.Get("vault", "db/password")
+	Assert(t).IsNotNil(err, "unknown providers should be an error")
+
+	_, err = NewProviders(map[string]Config{"bad": {Type: "carrier-pigeon"}})
+	Assert(t).IsNotNil(err, "unknown provider types should be refused")
+}
@@ -0,0 +1,455 @@
+package uri
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/square/p2/pkg/util"
+	"github.com/square/p2/pkg/util/limit"
+	"github.com/square/p2/pkg/util/size"
+)
+
+const (
+	// DefaultBackoff is the wait before the first retry of a failed download.
+	DefaultBackoff = time.Second
+	// DefaultMaxBackoff is the longest wait between retries of a failed download.
+	DefaultMaxBackoff = 30 * time.Second
+	// DefaultMaxHostWait is the longest a download waits for another download from
+	// the same host to finish.
+	DefaultMaxHostWait = 5 * time.Minute
+)
+
+// FetcherConfig configures how a BasicFetcher downloads over HTTP. The zero value makes
+// one attempt per download, with no timeout and no limits.
+type FetcherConfig struct {
+	// How many times a failed download is retried. A download that fails part way is
+	// resumed where it stopped if the server supports range requests.
+	Retries int `yaml:"retries,omitempty"`
+	// The wait before the first retry, which doubles with each retry up to MaxBackoff.
+	Backoff    time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"max_backoff,omitempty"`
+	// A download attempt fails if it receives no data for this long.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// The most downloads from one host that may run at once. Other downloads from the
+	// host wait for one of them to be closed, and fail if they wait for longer than
+	// MaxHostWait.
+	MaxConnsPerHost int           `yaml:"max_conns_per_host,omitempty"`
+	MaxHostWait     time.Duration `yaml:"max_host_wait,omitempty"`
+	// The most bytes per second that all downloads may receive together.
+	MaxBandwidth size.ByteCount `yaml:"max_bandwidth,omitempty"`
+	// The object store that "s3://bucket/key" locations are fetched from.
+	S3 *S3Config `yaml:"s3,omitempty"`
+}
+
+// NewFetcher returns a BasicFetcher that uses the default HTTP client and downloads
+// according to the configuration.
+func NewFetcher(config FetcherConfig) (BasicFetcher, error) {
+	if config.Retries < 0 || config.Backoff < 0 || config.MaxBackoff < 0 || config.Timeout < 0 {
+		return BasicFetcher{}, util.Errorf("Download retries, backoff and timeout may not be negative")
+	}
+	if config.MaxConnsPerHost < 0 || config.MaxHostWait < 0 || config.MaxBandwidth < 0 {
+		return BasicFetcher{}, util.Errorf("Download limits may not be negative")
+	}
+	if config.S3 != nil {
+		err := config.S3.validate()
+		if err != nil {
+			return BasicFetcher{}, err
+		}
+	}
+	if config.Backoff == 0 {
+		config.Backoff = DefaultBackoff
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	if config.MaxHostWait == 0 {
+		config.MaxHostWait = DefaultMaxHostWait
+	}
+	limits, err := newFetchLimits(config)
+	if err != nil {
+		return BasicFetcher{}, err
+	}
+	return BasicFetcher{
+		Client: http.DefaultClient,
+		Config: config,
+		limits: limits,
+	}, nil
+}
+
+// backoff returns the wait before the given retry, counting from 1.
+func (c FetcherConfig) backoff(retry int) time.Duration {
+	wait := c.Backoff
+	for i := 1; i < retry && wait < c.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if c.MaxBackoff > 0 && wait > c.MaxBackoff {
+		wait = c.MaxBackoff
+	}
+	return wait
+}
+
+// fetchLimits are the limits that all downloads of a fetcher share.
+type fetchLimits struct {
+	maxPerHost int
+	maxWait    time.Duration
+	hostsLock  sync.Mutex
+	hosts      map[string]chan struct{}
+
+	// one token is one byte
+	bucketLock sync.Mutex
+	bucket     *limit.TokenBucket
+	refill     time.Duration
+	maxRead    int
+}
+
+func newFetchLimits(config FetcherConfig) (*fetchLimits, error) {
+	limits := &fetchLimits{
+		maxPerHost: config.MaxConnsPerHost,
+		maxWait:    config.MaxHostWait,
+		hosts:      make(map[string]chan struct{}),
+	}
+	if config.MaxBandwidth > 0 {
+		// the bucket holds a second of bandwidth, and cannot refill faster than a byte
+		// per nanosecond
+		limits.refill = time.Second / time.Duration(config.MaxBandwidth)
+		if limits.refill <= 0 {
+			limits.refill = time.Nanosecond
+		}
+		bucket, err := limit.NewTokenBucket(int64(config.MaxBandwidth), int64(config.MaxBandwidth), limits.refill)
+		if err != nil {
+			return nil, util.Errorf("Invalid download bandwidth %s: %s", config.MaxBandwidth, err)
+		}
+		limits.bucket = bucket
+		limits.maxRead = int(config.MaxBandwidth)
+	}
+	return limits, nil
+}
+
+// acquireHost waits until a download from the host may start, and returns a function
+// that ends it. It returns an error if the wait takes longer than the limit.
+func (l *fetchLimits) acquireHost(host string) (func(), error) {
+	if l == nil || l.maxPerHost <= 0 {
+		return func() {}, nil
+	}
+	l.hostsLock.Lock()
+	slots, ok := l.hosts[host]
+	if !ok {
+		slots = make(chan struct{}, l.maxPerHost)
+		l.hosts[host] = slots
+	}
+	l.hostsLock.Unlock()
+
+	if l.maxWait > 0 {
+		timer := time.NewTimer(l.maxWait)
+		defer timer.Stop()
+		select {
+		case slots <- struct{}{}:
+		case <-timer.C:
+			return nil, util.Errorf("waited more than %s for other downloads from %s to finish", l.maxWait, host)
+		}
+	} else {
+		slots <- struct{}{}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-slots })
+	}, nil
+}
+
+// readSize shortens a read buffer so that one read never needs more bandwidth than the
+// bucket can hold.
+func (l *fetchLimits) readSize(p []byte) []byte {
+	if l == nil || l.bucket == nil || len(p) <= l.maxRead {
+		return p
+	}
+	return p[:l.maxRead]
+}
+
+// use waits until n bytes of bandwidth are available and takes them.
+func (l *fetchLimits) use(n int) {
+	if l == nil || l.bucket == nil || n <= 0 {
+		return
+	}
+	for {
+		l.bucketLock.Lock()
+		count, ok := l.bucket.TryUse(int64(n))
+		l.bucketLock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(time.Duration(int64(n)-count) * l.refill)
+	}
+}
+
+// permanentError is a download failure that retrying will not fix.
+type permanentError struct {
+	error
+}
+
+// openHTTP starts a download of the URL. If sign is not nil, it is called to sign each
+// request before it is sent.
+func (f BasicFetcher) openHTTP(u *url.URL, sign func(*http.Request) error) (io.ReadCloser, error) {
+	release, err := f.limits.acquireHost(u.Host)
+	if err != nil {
+		return nil, util.Errorf("%q: %s", u.String(), err)
+	}
+	d := &download{
+		client:  f.Client,
+		config:  f.Config,
+		limits:  f.limits,
+		url:     u.String(),
+		sign:    sign,
+		release: release,
+	}
+	err = d.connect(nil)
+	if err != nil {
+		d.release()
+		return nil, err
+	}
+	return d, nil
+}
+
+// download is the body of an HTTP download. When reading the body fails, it is
+// requested again from where it stopped, until the download runs out of retries.
+type download struct {
+	client  *http.Client
+	config  FetcherConfig
+	limits  *fetchLimits
+	url     string
+	sign    func(*http.Request) error
+	release func()
+
+	body io.ReadCloser
+	// cancel stops the current request, and expire stops it because of its timeout,
+	// which closes expired
+	cancel  func()
+	expire  func()
+	expired chan struct{}
+	timer   *time.Timer
+	retries int
+	// how many bytes have been read, and the ETag or Last-Modified of the data, which
+	// a resumed request must match
+	offset    int64
+	validator string
+}
+
+// connect requests the rest of the download, retrying as configured. cause is the
+// error that ended the previous request, if there was one.
+func (d *download) connect(cause error) error {
+	for {
+		if cause != nil {
+			if _, ok := cause.(permanentError); ok || d.retries >= d.config.Retries {
+				return cause
+			}
+			d.retries++
+			time.Sleep(d.config.backoff(d.retries))
+		}
+		cause = d.request()
+		if cause == nil {
+			return nil
+		}
+	}
+}
+
+func (d *download) request() error {
+	client := d.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	if d.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+	if d.sign != nil {
+		err = d.sign(req)
+		if err != nil {
+			return permanentError{util.Errorf("%q: could not sign the request: %s", d.url, err)}
+		}
+	}
+	d.setCancel(client, req)
+	if d.config.Timeout > 0 {
+		d.timer = time.AfterFunc(d.config.Timeout, d.expire)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		err = d.timeoutError(err)
+		d.stop()
+		return err
+	}
+	err = d.checkResponse(resp)
+	if err != nil {
+		resp.Body.Close()
+		d.stop()
+		return err
+	}
+	d.body = resp.Body
+	return nil
+}
+
+// checkResponse checks that the response continues the download at its offset. A
+// server that does not support range requests sends all of the data again, so the part
+// that was already read is skipped.
+func (d *download) checkResponse(resp *http.Response) error {
+	// weak ETags cannot be used with If-Range
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if d.offset == 0 {
+			d.validator = validator
+			return nil
+		}
+		if validator != d.validator {
+			return permanentError{util.Errorf("%q: changed during the download", d.url)}
+		}
+		return d.skip(resp.Body, d.offset)
+	case resp.StatusCode == http.StatusPartialContent && d.offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", d.offset)) {
+			return permanentError{util.Errorf("%q: HTTP server returned range %q instead of bytes %d-", d.url, resp.Header.Get("Content-Range"), d.offset)}
+		}
+		return nil
+	}
+
+	err := util.Errorf("%q: HTTP server returned status: %s", d.url, resp.Status)
+	// 429 is Too Many Requests
+	if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+		return err
+	}
+	return permanentError{err}
+}
+
+// skip reads and discards n bytes of the body, resetting the timeout as data arrives.
+func (d *download) skip(body io.Reader, n int64) error {
+	buf := make([]byte, 32*1024)
+	for n > 0 {
+		if int64(len(buf)) > n {
+			buf = buf[:n]
+		}
+		read, err := body.Read(buf)
+		n -= int64(read)
+		if read > 0 && d.timer != nil {
+			d.timer.Reset(d.config.Timeout)
+		}
+		if err == io.EOF && n > 0 {
+			return util.Errorf("%q: HTTP server returned less data than before", d.url)
+		} else if err != nil && err != io.EOF {
+			return d.timeoutError(err)
+		}
+	}
+	return nil
+}
+
+// canceler is implemented by transports that can cancel a request whose response
+// body is being read, such as http.Transport.
+type canceler interface {
+	CancelRequest(*http.Request)
+}
+
+// setCancel prepares the cancel function of a new request. The request's Cancel channel
+// stops it while it waits for a response, and the transport stops the body.
+func (d *download) setCancel(client *http.Client, req *http.Request) {
+	cancelc := make(chan struct{})
+	req.Cancel = cancelc
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	var once sync.Once
+	d.cancel = func() {
+		once.Do(func() {
+			close(cancelc)
+			if c, ok := transport.(canceler); ok {
+				c.CancelRequest(req)
+			}
+		})
+	}
+
+	expired := make(chan struct{})
+	var expireOnce sync.Once
+	d.expired = expired
+	cancel := d.cancel
+	d.expire = func() {
+		expireOnce.Do(func() {
+			close(expired)
+			cancel()
+		})
+	}
+}
+
+// timeoutError explains an error caused by the request being canceled by its timer.
+func (d *download) timeoutError(err error) error {
+	select {
+	case <-d.expired:
+		return util.Errorf("%q: no data received for %s", d.url, d.config.Timeout)
+	default:
+		return err
+	}
+}
+
+// stop cancels the current request.
+func (d *download) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel()
+	if d.body != nil {
+		d.body.Close()
+		d.body = nil
+	}
+}
+
+func (d *download) Read(p []byte) (int, error) {
+	p = d.limits.readSize(p)
+	for {
+		if d.body == nil {
+			return 0, util.Errorf("%q: read from a closed download", d.url)
+		}
+		n, err := d.body.Read(p)
+		if n > 0 {
+			d.offset += int64(n)
+			if d.timer != nil {
+				d.timer.Reset(d.config.Timeout)
+			}
+			d.limits.use(n)
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		err = d.timeoutError(err)
+		d.stop()
+		err = d.connect(err)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (d *download) Close() error {
+	var err error
+	if d.body != nil {
+		err = d.body.Close()
+		d.body = nil
+	}
+	d.stop()
+	d.release()
+	return err
+}
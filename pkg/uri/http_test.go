@@ -0,0 +1,196 @@
+package uri
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/square/p2/Godeps/_workspace/src/github.com/anthonybishopric/gotcha"
+)
+
+func newTestFetcher(t *testing.T, config FetcherConfig) BasicFetcher {
+	config.Backoff = time.Millisecond
+	fetcher, err := NewFetcher(config)
+	Assert(t).IsNil(err, "test setup: could not create fetcher")
+	return fetcher
+}
+
+func fetchAll(fetcher BasicFetcher, location string) ([]byte, error) {
+	r, err := fetcher.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// abortingWriter breaks the connection after the given number of bytes of the body
+// have been written.
+type abortingWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *abortingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.left {
+		w.ResponseWriter.Write(p[:w.left])
+		w.ResponseWriter.(http.Flusher).Flush()
+		conn, _, err := w.ResponseWriter.(http.Hijacker).Hijack()
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return w.left, io.ErrClosedPipe
+	}
+	w.left -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestFetcherRetriesServerErrors(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		count := requests
+		lock.Unlock()
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case count <= 3:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer ts.Close()
+
+	_, err := fetchAll(newTestFetcher(t, FetcherConfig{Retries: 1}), ts.URL+"/hello")
+	Assert(t).IsNotNil(err, "the download should have run out of retries")
+
+	data, err := fetchAll(newTestFetcher(t, FetcherConfig{Retries: 2}), ts.URL+"/hello")
+	Assert(t).IsNil(err, "the download should have been retried")
+	Assert(t).AreEqual(string(data), "hello", "wrong downloaded contents")
+	Assert(t).AreEqual(requests, 4, "wrong number of requests")
+
+	_, err = fetchAll(newTestFetcher(t, FetcherConfig{Retries: 5}), ts.URL+"/missing")
+	Assert(t).IsNotNil(err, "a missing file should not be downloaded")
+	Assert(t).AreEqual(requests, 5, "a missing file should not be retried")
+}
+
+func TestFetcherResumesInterruptedDownloads(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	modTime := time.Now().Add(-time.Hour)
+
+	for _, supportsRanges := range []bool{true, false} {
+		var ranges []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			if !supportsRanges {
+				r.Header.Del("Range")
+				modTime = time.Time{}
+			}
+			if len(ranges) == 1 {
+				w = &abortingWriter{ResponseWriter: w, left: 40000}
+			}
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+		}))
+
+		data, err := fetchAll(newTestFetcher(t, FetcherConfig{Retries: 1}), ts.URL+"/artifact")
+		ts.Close()
+		Assert(t).IsNil(err, "the interrupted download should have been resumed")
+		Assert(t).IsTrue(bytes.Equal(data, content), "wrong downloaded contents")
+		Assert(t).AreEqual(len(ranges), 2, "wrong number of requests")
+		Assert(t).AreEqual(ranges[1], "bytes=40000-", "the download should have resumed where it stopped")
+	}
+}
+
+func TestFetcherLimitsConnectionsPerHost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	fetcher := newTestFetcher(t, FetcherConfig{MaxConnsPerHost: 1})
+
+	first, err := fetcher.Open(ts.URL + "/first")
+	Assert(t).IsNil(err, "the first download should have started")
+	done := make(chan error)
+	go func() {
+		_, err := fetchAll(fetcher, ts.URL+"/second")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("the second download should wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case err = <-done:
+		Assert(t).IsNil(err, "the second download should have succeeded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second download should start when the first one is closed")
+	}
+}
+
+func TestFetcherBoundsWaitForHost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	fetcher := newTestFetcher(t, FetcherConfig{MaxConnsPerHost: 1, MaxHostWait: 50 * time.Millisecond})
+
+	first, err := fetcher.Open(ts.URL + "/first")
+	Assert(t).IsNil(err, "the first download should have started")
+	defer first.Close()
+	_, err = fetcher.Open(ts.URL + "/second")
+	Assert(t).IsNotNil(err, "a download should fail when it waits too long for its host")
+}
+
+func TestFetcherLimitsBandwidth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2000))
+	}))
+	defer ts.Close()
+	fetcher := newTestFetcher(t, FetcherConfig{MaxBandwidth: 1000})
+
+	start := time.Now()
+	data, err := fetchAll(fetcher, ts.URL+"/artifact")
+	Assert(t).IsNil(err, "the download should have succeeded")
+	Assert(t).AreEqual(len(data), 2000, "wrong downloaded size")
+	// the first second of bandwidth is available at once
+	Assert(t).IsTrue(time.Since(start) >= 900*time.Millisecond, "the download should have been limited to 1000 bytes per second")
+}
+
+func TestFetcherTimesOutStalledDownloads(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+	fetcher := newTestFetcher(t, FetcherConfig{Timeout: 50 * time.Millisecond})
+
+	done := make(chan error)
+	go func() {
+		_, err := fetchAll(fetcher, ts.URL+"/artifact")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		Assert(t).IsNotNil(err, "the stalled download should have failed")
+		Assert(t).IsTrue(strings.Contains(err.Error(), "no data received"), "wrong error: "+err.Error())
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled download should have timed out")
+	}
+}
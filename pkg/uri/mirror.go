@@ -0,0 +1,71 @@
+package uri
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/square/p2/pkg/util"
+)
+
+// A Rewrite maps the locations under one prefix to the same paths under another, such
+// as "https://artifacts.prod/" to a mirror at "file:///mnt/mirror/".
+type Rewrite struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// Mirrors returns the locations that the rewrites map the location to, in order.
+func Mirrors(rewrites []Rewrite, location string) []string {
+	var mirrors []string
+	for _, rewrite := range rewrites {
+		if rewrite.From != "" && strings.HasPrefix(location, rewrite.From) {
+			mirrors = append(mirrors, rewrite.To+strings.TrimPrefix(location, rewrite.From))
+		}
+	}
+	return mirrors
+}
+
+// A MirrorFetcher opens the mirrors of a location, in order, when the location itself
+// cannot be opened. A mirror may serve different data than the location, so it should
+// only be used for data that is verified, such as signed digests.
+type MirrorFetcher struct {
+	Fetcher  Fetcher
+	Rewrites []Rewrite
+}
+
+func (f MirrorFetcher) Open(srcUri string) (io.ReadCloser, error) {
+	data, err := f.Fetcher.Open(srcUri)
+	mirrors := Mirrors(f.Rewrites, srcUri)
+	if err == nil || len(mirrors) == 0 {
+		return data, err
+	}
+	failures := []string{err.Error()}
+	for _, mirror := range mirrors {
+		data, err = f.Fetcher.Open(mirror)
+		if err == nil {
+			return data, nil
+		}
+		failures = append(failures, err.Error())
+	}
+	return nil, util.Errorf("%q and its mirrors could not be fetched: %s", srcUri, strings.Join(failures, "; "))
+}
+
+func (f MirrorFetcher) CopyLocal(srcUri, dstPath string) (err error) {
+	src, err := f.Open(srcUri)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if errC := dest.Close(); err == nil {
+			err = errC
+		}
+	}()
+	_, err = io.Copy(dest, src)
+	return err
+}
@@ -0,0 +1,220 @@
+package uri
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/square/p2/Godeps/_workspace/src/gopkg.in/yaml.v2"
+	"github.com/square/p2/pkg/util"
+)
+
+// DefaultS3Region is the region that S3 requests are signed for if none is configured.
+const DefaultS3Region = "us-east-1"
+
+// the SHA256 of an empty request body
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Config configures the S3-compatible object store that "s3://bucket/key" locations
+// are fetched from. Requests are signed with AWS Signature Version 4.
+type S3Config struct {
+	// The URL of the store's API, such as "https://s3.us-west-2.amazonaws.com". Objects
+	// are addressed by path, as <endpoint>/<bucket>/<key>.
+	Endpoint string `yaml:"endpoint"`
+	// The region that requests are signed for.
+	Region string `yaml:"region,omitempty"`
+	// A YAML file with the access_key_id, secret_access_key and optional session_token
+	// to sign requests with. It is read for each download, so the credentials can be
+	// rotated without restarting.
+	CredentialsFile string `yaml:"credentials_file"`
+}
+
+// S3Credentials are the contents of an S3 credentials file.
+type S3Credentials struct {
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token,omitempty"`
+}
+
+func (c *S3Config) validate() error {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return util.Errorf("The S3 endpoint must be an http or https URL, got %q", c.Endpoint)
+	}
+	if c.CredentialsFile == "" {
+		return util.Errorf("The S3 configuration needs a credentials_file")
+	}
+	return nil
+}
+
+func (c *S3Config) region() string {
+	if c.Region == "" {
+		return DefaultS3Region
+	}
+	return c.Region
+}
+
+// credentials reads the credentials file.
+func (c *S3Config) credentials() (S3Credentials, error) {
+	data, err := ioutil.ReadFile(c.CredentialsFile)
+	if err != nil {
+		return S3Credentials{}, util.Errorf("Could not read S3 credentials: %s", err)
+	}
+	var creds S3Credentials
+	err = yaml.Unmarshal(data, &creds)
+	if err != nil {
+		return S3Credentials{}, util.Errorf("Could not parse S3 credentials in %s: %s", c.CredentialsFile, err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return S3Credentials{}, util.Errorf("%s must contain an access_key_id and a secret_access_key", c.CredentialsFile)
+	}
+	return creds, nil
+}
+
+// objectURL returns the HTTP URL of an object in a bucket.
+func (c *S3Config) objectURL(bucket string, key string) (*url.URL, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + strings.TrimPrefix(key, "/")
+	// send the path encoded the way that it is signed
+	u.RawPath = s3EscapePath(u.Path)
+	return u, nil
+}
+
+// openS3 downloads an "s3://bucket/key" location from the configured object store.
+func (f BasicFetcher) openS3(u *url.URL) (io.ReadCloser, error) {
+	config := f.Config.S3
+	if config == nil {
+		return nil, util.Errorf("%q: no S3 endpoint is configured", u.String())
+	}
+	if u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return nil, util.Errorf("%q: S3 locations must name a bucket and a key", u.String())
+	}
+	object, err := config.objectURL(u.Host, u.Path)
+	if err != nil {
+		return nil, err
+	}
+	return f.openHTTP(object, func(req *http.Request) error {
+		creds, err := config.credentials()
+		if err != nil {
+			return err
+		}
+		signS3Request(req, creds, config.region(), time.Now())
+		return nil
+	})
+}
+
+// signS3Request adds an AWS Signature Version 4 authorization to a request without a
+// body. The host, the range and the x-amz-* headers are signed.
+func signS3Request(req *http.Request, creds S3Credentials, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), region)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadSHA256)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		emptyPayloadSHA256,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes every byte except the unreserved characters of RFC 3986, and
+// slashes if escapeSlash is false, as Signature Version 4 requires.
+func s3Escape(s string, escapeSlash bool) string {
+	var escaped []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(escaped)
+}
+
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3Escape(path, false)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
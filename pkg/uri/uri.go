@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/square/p2/pkg/util"
 )
@@ -22,8 +23,48 @@ type Fetcher interface {
 	CopyLocal(srcUri, dstPath string) error
 }
 
+// SupportedSchemes are the URI schemes that the default fetcher can fetch. The empty
+// scheme denotes a local path. "s3" can only be fetched once an S3Config is set.
+var SupportedSchemes = []string{"", "file", "http", "https", "s3"}
+
+// IsSupportedScheme returns true if the default fetcher can fetch URIs with the given
+// scheme.
+func IsSupportedScheme(scheme string) bool {
+	for _, supported := range SupportedSchemes {
+		if scheme == supported {
+			return true
+		}
+	}
+	return false
+}
+
 // A default fetcher, if the user doesn't want to set any options.
-var DefaultFetcher Fetcher = BasicFetcher{http.DefaultClient}
+var DefaultFetcher Fetcher = BasicFetcher{Client: http.DefaultClient}
+
+// RegistryLocation returns the location of the artifact with the given hex encoded
+// SHA256 in a registry, which is <registry>/sha256/<sha256>.
+func RegistryLocation(registry string, sha256 string) string {
+	return strings.TrimSuffix(registry, "/") + "/sha256/" + strings.ToLower(sha256)
+}
+
+// A DigestFetcher is a Fetcher that can make use of the SHA256 that the data at a URI
+// is expected to have, such as a cache that stores data by its digest.
+type DigestFetcher interface {
+	Fetcher
+
+	// OpenDigest is like Open, but the data may come from anywhere that has data with
+	// the given hex encoded SHA256. The caller must still verify the data.
+	OpenDigest(uri string, sha256 string) (io.ReadCloser, error)
+}
+
+// OpenDigest opens the URI with the fetcher, using the expected SHA256 of its data if
+// the fetcher is a DigestFetcher and the SHA256 is not empty.
+func OpenDigest(fetcher Fetcher, uri string, sha256 string) (io.ReadCloser, error) {
+	if digestFetcher, ok := fetcher.(DigestFetcher); ok && sha256 != "" {
+		return digestFetcher.OpenDigest(uri, sha256)
+	}
+	return fetcher.Open(uri)
+}
 
 // URICopy Wraps opening and copying content from URIs. Will attempt
 // directly perform file copies if the uri is begins with file://, otherwise
@@ -31,9 +72,14 @@ var DefaultFetcher Fetcher = BasicFetcher{http.DefaultClient}
 var URICopy = DefaultFetcher.CopyLocal
 
 // BasicFetcher can access "file" and "http" schemes using the OS and
-// a provided HTTP client, respectively.
+// a provided HTTP client, respectively, and "s3" if Config.S3 is set. HTTP
+// downloads are retried and limited according to Config; use NewFetcher to
+// enforce its limits.
 type BasicFetcher struct {
 	Client *http.Client
+	Config FetcherConfig
+
+	limits *fetchLimits
 }
 
 func (f BasicFetcher) Open(srcUri string) (io.ReadCloser, error) {
@@ -49,19 +95,9 @@ func (f BasicFetcher) Open(srcUri string) (io.ReadCloser, error) {
 		}
 		return os.Open(u.Path)
 	case "http", "https":
-		resp, err := f.Client.Get(u.String())
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return nil, util.Errorf(
-				"%q: HTTP server returned status: %s",
-				u.String(),
-				resp.Status,
-			)
-		}
-		return resp.Body, nil
+		return f.openHTTP(u, nil)
+	case "s3":
+		return f.openS3(u)
 	default:
 		return nil, util.Errorf("%q: unknown scheme %s", u.String(), u.Scheme)
 	}
@@ -67,3 +67,26 @@ func TestCorrectlyPullsFilesOverHTTP(t *testing.T) {
 
 	Assert(t).AreEqual(string(thisContents), string(copiedContents), "Should have downloaded the file correctly")
 }
+
+func TestMirrorFetcherFallsBackThroughRewrites(t *testing.T) {
+	thisFile := util.From(runtime.Caller(0)).Filename
+	dir := filepath.Dir(thisFile)
+	rewrites := []Rewrite{
+		{From: "https://artifacts.invalid/", To: "file:///nonexistent/"},
+		{From: "https://artifacts.invalid/", To: "file://" + dir + "/"},
+		{From: "https://other/", To: "file:///"},
+	}
+	location := "https://artifacts.invalid/" + filepath.Base(thisFile)
+	Assert(t).AreEqual(len(Mirrors(rewrites, location)), 2, "only the matching rewrites should give mirrors")
+
+	fetcher := MirrorFetcher{Fetcher: BasicFetcher{Client: http.DefaultClient}, Rewrites: rewrites}
+	// the location itself cannot be resolved, so the second mirror must be used
+	data, err := fetcher.Open(location)
+	Assert(t).IsNil(err, "the file should have been fetched from a mirror")
+	defer data.Close()
+	contents, err := ioutil.ReadAll(data)
+	Assert(t).IsNil(err, "the mirrored file could not be read")
+	thisContents, err := ioutil.ReadFile(thisFile)
+	Assert(t).IsNil(err, "the original file could not be read")
+	Assert(t).AreEqual(string(contents), string(thisContents), "the mirror served the wrong contents")
+}
@@ -27,16 +27,24 @@
 //   yaml.Unmarshal(readConfigFile(), &config)
 //   err := param.Parse(config.Params)
 //
+// Parameters that can be read while Reload() runs must be read with the Get functions:
+//
+//   if numUsed >= param.GetInt(threshhold) { ... }
+//
 package param
 
 import (
 	"flag"
 	"fmt"
+	"sync"
 )
 
 // DefaultParams holds the default set of parameters, used by all package-level functions.
 var DefaultParams flag.FlagSet
 
+// defaultLock guards the values of the default parameters against Reload().
+var defaultLock sync.RWMutex
+
 // Values is a type alias that can be used to help document the configuration values that
 // are meant to be define parameters.
 type Values map[string]string
@@ -66,9 +74,46 @@ func String(name string, value string) *string {
 	return DefaultParams.String(name, value, "")
 }
 
+// GetBool reads a "bool"-typed parameter of the default set.
+func GetBool(p *bool) bool {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return *p
+}
+
+// GetFloat64 reads a "float64"-typed parameter of the default set.
+func GetFloat64(p *float64) float64 {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return *p
+}
+
+// GetInt reads an "int"-typed parameter of the default set.
+func GetInt(p *int) int {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return *p
+}
+
+// GetInt64 reads an "int64"-typed parameter of the default set.
+func GetInt64(p *int64) int64 {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return *p
+}
+
+// GetString reads a "string"-typed parameter of the default set.
+func GetString(p *string) string {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+	return *p
+}
+
 // Parse parses the parameter assignments for the default set of parameters. See
 // ParseFlags().
 func Parse(values Values) error {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
 	return ParseFlags(&DefaultParams, values)
 }
 
@@ -79,11 +124,36 @@ func ParseFlags(f *flag.FlagSet, values Values) error {
 			return fmt.Errorf("%s: no such parameter", name)
 		}
 	}
-	var err error
 	for name, value := range values {
-		err = f.Set(name, value)
+		err := f.Set(name, value)
 		if err != nil {
-			err = fmt.Errorf("%s: %s", name, err)
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Reload replaces the parameter assignments for the default set of parameters. See
+// ReloadFlags(). Readers using the Get functions never see a partially reloaded set.
+func Reload(values Values) error {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+	return ReloadFlags(&DefaultParams, values)
+}
+
+// ReloadFlags resets every parameter defined by a FlagSet to its default value, then
+// parses a map of parameter assignments. If any assignment is invalid, the previous
+// values are restored and an error is returned.
+func ReloadFlags(f *flag.FlagSet, values Values) error {
+	previous := make(map[string]string)
+	f.VisitAll(func(fl *flag.Flag) {
+		previous[fl.Name] = fl.Value.String()
+		fl.Value.Set(fl.DefValue)
+	})
+	err := ParseFlags(f, values)
+	if err != nil {
+		for name, value := range previous {
+			f.Set(name, value)
 		}
 	}
 	return err